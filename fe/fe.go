@@ -7,7 +7,7 @@ package main
 import (
 	"auth"
 	"billing"
-	"bytes"
+	"bufio"
 	"configfile"
 	"context"
 	"cydb"
@@ -17,15 +17,18 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/rakyll/magicmime"
+	"io"
 	"io/ioutil"
 	"jobs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"outbound"
 	"services"
 	"storage"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -43,6 +46,7 @@ type FEConfiguration struct {
 	Billing  billing.BillingConfig   `json:"billing"`
 	Storage  storage.StorageConfig   `json:"storage"`
 	Services services.ServicesConfig `json:"services"`
+	Outbound outbound.OutboundConfig `json:"outbound"`
 }
 
 var apiVersion = "1.0"
@@ -55,11 +59,38 @@ func getAuthTokenFromRequest(req *http.Request) string {
 }
 
 func getAuthTokenFromURL(req *http.Request) string {
-	body, _ := ioutil.ReadAll(req.Body)
 	vars := mux.Vars(req)
-	authToken := vars["authToken"]
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-	return authToken
+	return vars["authToken"]
+}
+
+/*
+ * retryAfterWriter adds a Retry-After header to a 503 FE answers with
+ * because a call made for the request hit an open circuit breaker; it says
+ * how long that breaker stays open.
+ */
+type retryAfterWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w retryAfterWriter) WriteHeader(statusCode int) {
+	if statusCode == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+		if retryAfter := outbound.RetryHint(w.ctx); retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)+1))
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w retryAfterWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func retryAfterMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := outbound.WithRetryHint(req.Context())
+		next.ServeHTTP(retryAfterWriter{ResponseWriter: w, ctx: ctx}, req.WithContext(ctx))
+	})
 }
 
 /* Authentication Functions */
@@ -73,40 +104,137 @@ func checkClientPermission(req *http.Request, w http.ResponseWriter) (bool, stri
 	}
 }
 
+/*
+ * Clients bypass the result cache of deterministic services with
+ * "Cache-Control: no-cache"; such jobs always run on a job server.
+ */
+func useResultCache(req *http.Request) bool {
+	for _, directive := range strings.Split(req.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache", "no-store":
+			return false
+		}
+	}
+	return true
+}
+
 /* File Functions */
+
+/*
+ * The largest upload FE accepts for a job: that of storage, or less if the
+ * job's service takes less.
+ */
+func uploadLimit(serviceLimit int64) int64 {
+	limit := storage.MaxUploadSize()
+	if serviceLimit > 0 && serviceLimit < limit {
+		limit = serviceLimit
+	}
+	return limit
+}
+
+/*
+ * Uploads and downloads are streamed, so reading and writing them may take
+ * as long as a transfer to storage instead of the server's timeouts.
+ */
+func extendTransferDeadlines(w http.ResponseWriter) {
+	deadline := time.Now().Add(storage.TransferTimeout())
+	controller := http.NewResponseController(w)
+	if err := controller.SetReadDeadline(deadline); err != nil {
+		data.Logger.Printf("Can't extend the read deadline: %s", err)
+	}
+	if err := controller.SetWriteDeadline(deadline); err != nil {
+		data.Logger.Printf("Can't extend the write deadline: %s", err)
+	}
+}
+
+/*
+ * Only the first bytes are looked at to tell the MIME type, the rest is
+ * passed on to storage as it arrives. It returns false if there is no data.
+ */
+func sniffMimeType(body *bufio.Reader) (bool, string) {
+	head, _ := body.Peek(storage.SniffLength)
+	if len(head) == 0 {
+		return false, ""
+	}
+	mimeType, err := magicmime.TypeByBuffer(head)
+	if err != nil {
+		mimeType = "application/octet-stream"
+	}
+	return true, mimeType
+}
+
+/*
+ * Storage tells why it refuses an upload; the reason is passed on to the
+ * client.
+ */
+func refuseUpload(w http.ResponseWriter, responseCode int, reason string) {
+	if reason == "" {
+		w.WriteHeader(responseCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(responseCode)
+	json.NewEncoder(w).Encode(data.UploadRejection{Reason: reason})
+}
+
+/*
+ * runUploadedJob starts the job once its data is stored completely.
+ */
+func runUploadedJob(ctx context.Context, uploadId string, stored data.StorageServerUploadResponse, useCache bool) (int, data.JobResult) {
+	uploadHash := ""
+	if useCache {
+		uploadHash = stored.SHA256
+	}
+	responseCode, jobData := jobs.JobDataUploaded(uploadId, stored.BinaryDataId, uploadHash)
+	if responseCode != http.StatusAccepted {
+		data.Logger.Printf("JobDataUploaded")
+		return responseCode, data.JobResult{}
+	}
+	responseCode, jobResponse := jobs.RunJob(ctx, jobData)
+	if responseCode != http.StatusAccepted {
+		data.Logger.Printf("RunJob-Error")
+	}
+	return responseCode, jobResponse
+}
+
 func UploadFile(w http.ResponseWriter, req *http.Request) {
 	data.Logger.Printf("UploadFile called")
+	extendTransferDeadlines(w)
 	clientPermitted, authToken := checkClientPermission(req, w)
 	if clientPermitted {
 		vars := mux.Vars(req)
 		uploadId := vars["uploadId"]
 		data.Logger.Printf("UploadID=%d, authToken=%s", uploadId, authToken)
 		_, applicationId, applicationInstanceId := auth.DecodeAndCheckAuthToken(authToken)
-		binaryData, err := ioutil.ReadAll(req.Body)
-		if err == nil && jobs.CanUploadBinaryData(applicationId, applicationInstanceId, uploadId) {
-			if storage.CanUploadBinaryData(applicationId, applicationInstanceId, uploadId, 1024, "image/jpg") {
-				success, identifier, _ := storage.UploadBinaryData(applicationId, applicationInstanceId, uploadId, binaryData)
-				if success {
-					responseCode, jobData := jobs.JobDataUploaded(uploadId, identifier)
+		if canUpload, serviceLimit, _ := jobs.CanUploadBinaryData(applicationId, applicationInstanceId, uploadId); canUpload {
+			limit := uploadLimit(serviceLimit)
+			if req.ContentLength > limit {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			body := bufio.NewReaderSize(req.Body, storage.SniffLength)
+			hasData, mimeType := sniffMimeType(body)
+			if !hasData {
+				w.WriteHeader(http.StatusExpectationFailed)
+				return
+			}
+			canUpload, reason := storage.CanUploadBinaryData(req.Context(), applicationId, applicationInstanceId, uploadId, req.ContentLength, mimeType)
+			if canUpload == http.StatusOK {
+				uploadResponse, reason, stored := storage.UploadBinaryData(req.Context(), applicationId, applicationInstanceId, uploadId, &storage.LimitedReader{Reader: body, Limit: limit}, req.ContentLength, mimeType)
+				if uploadResponse == http.StatusOK {
+					responseCode, jobResponse := runUploadedJob(req.Context(), uploadId, stored, useResultCache(req))
 					if responseCode == http.StatusAccepted {
-						responseCode, jobResponse := jobs.RunJob(jobData)
-						if responseCode == http.StatusAccepted {
-							w.Header().Set("Content-Type", "application/json; charset=utf-8")
-							w.WriteHeader(responseCode)
-							json.NewEncoder(w).Encode(jobResponse)
-						} else {
-							data.Logger.Printf("RunJob-Error")
-							w.WriteHeader(responseCode)
-						}
+						w.Header().Set("Content-Type", "application/json; charset=utf-8")
+						w.WriteHeader(responseCode)
+						json.NewEncoder(w).Encode(jobResponse)
 					} else {
-						data.Logger.Printf("JobDataUploaded")
 						w.WriteHeader(responseCode)
 					}
 				} else {
-					w.WriteHeader(http.StatusInsufficientStorage)
+					refuseUpload(w, uploadResponse, reason)
 				}
 			} else {
-				w.WriteHeader(http.StatusNotFound)
+				refuseUpload(w, canUpload, reason)
 			}
 		} else {
 			w.WriteHeader(http.StatusUnauthorized)
@@ -114,24 +242,214 @@ func UploadFile(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+/*
+ * Resumable uploads (tus 1.0.0, https://tus.io) go to the URL of single
+ * uploads: POST creates the upload with its Upload-Length, HEAD returns the
+ * offset reached and PATCH appends a chunk at that offset, optionally with
+ * an Upload-Checksum. A sha256 in the Upload-Metadata is checked against
+ * the complete upload. The job leaves JobStatusWaitingForFile only once the
+ * last chunk is stored and verified; partial uploads expire with the
+ * upload window of the job.
+ */
+const tusVersion = "1.0.0"
+
+func checkTusVersion(w http.ResponseWriter, req *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if req.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func setUploadOffsetHeaders(w http.ResponseWriter, upload storage.ResumableUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+/*
+ * resumableUploadTarget checks that the client may upload the job's data
+ * now and returns the size limit and the end of the upload window.
+ */
+func resumableUploadTarget(w http.ResponseWriter, req *http.Request) (bool, int, int, string, int64, time.Time) {
+	clientPermitted, authToken := checkClientPermission(req, w)
+	if !clientPermitted || !checkTusVersion(w, req) {
+		return false, 0, 0, "", 0, time.Time{}
+	}
+	uploadId := mux.Vars(req)["uploadId"]
+	_, applicationId, applicationInstanceId := auth.DecodeAndCheckAuthToken(authToken)
+	canUpload, serviceLimit, until := jobs.CanUploadBinaryData(applicationId, applicationInstanceId, uploadId)
+	if !canUpload {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false, 0, 0, "", 0, time.Time{}
+	}
+	return true, applicationId, applicationInstanceId, uploadId, uploadLimit(serviceLimit), until
+}
+
+func UploadOptions(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,checksum,expiration")
+	w.Header().Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(storage.MaxUploadSize(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func CreateUpload(w http.ResponseWriter, req *http.Request) {
+	permitted, applicationId, applicationInstanceId, uploadId, limit, until := resumableUploadTarget(w, req)
+	if !permitted {
+		return
+	}
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if length > limit {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if canUpload, reason := storage.CanUploadBinaryData(req.Context(), applicationId, applicationInstanceId, uploadId, length, ""); canUpload != http.StatusOK {
+		refuseUpload(w, canUpload, reason)
+		return
+	}
+	responseCode, reason, upload := storage.CreateResumableUpload(req.Context(), applicationId, applicationInstanceId, uploadId, length, until, req.Header.Get("Upload-Metadata"))
+	if responseCode != http.StatusCreated {
+		refuseUpload(w, responseCode, reason)
+		return
+	}
+	setUploadOffsetHeaders(w, upload)
+	w.Header().Set("Location", req.URL.Path)
+	w.WriteHeader(responseCode)
+}
+
+func UploadOffset(w http.ResponseWriter, req *http.Request) {
+	permitted, applicationId, applicationInstanceId, uploadId, _, _ := resumableUploadTarget(w, req)
+	if !permitted {
+		return
+	}
+	responseCode, upload := storage.ResumableUploadOffset(req.Context(), applicationId, applicationInstanceId, uploadId)
+	if responseCode == http.StatusOK {
+		setUploadOffsetHeaders(w, upload)
+	}
+	w.WriteHeader(responseCode)
+}
+
+func AppendUpload(w http.ResponseWriter, req *http.Request) {
+	extendTransferDeadlines(w)
+	permitted, applicationId, applicationInstanceId, uploadId, limit, _ := resumableUploadTarget(w, req)
+	if !permitted {
+		return
+	}
+	if req.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body := bufio.NewReaderSize(req.Body, storage.SniffLength)
+	if offset == 0 {
+		// The first chunk tells the MIME type of the whole upload.
+		responseCode, upload := storage.ResumableUploadOffset(req.Context(), applicationId, applicationInstanceId, uploadId)
+		if responseCode != http.StatusOK {
+			w.WriteHeader(responseCode)
+			return
+		}
+		if hasData, mimeType := sniffMimeType(body); hasData {
+			if canUpload, reason := storage.CanUploadBinaryData(req.Context(), applicationId, applicationInstanceId, uploadId, upload.Length, mimeType); canUpload != http.StatusOK {
+				refuseUpload(w, canUpload, reason)
+				return
+			}
+		}
+	}
+	responseCode, upload, stored := storage.AppendBinaryData(req.Context(), applicationId, applicationInstanceId, uploadId, offset, req.Header.Get("Upload-Checksum"), &storage.LimitedReader{Reader: body, Limit: limit}, req.ContentLength)
+	switch responseCode {
+	case http.StatusOK:
+		if responseCode, _ := runUploadedJob(req.Context(), uploadId, stored, useResultCache(req)); responseCode != http.StatusAccepted {
+			w.WriteHeader(responseCode)
+			return
+		}
+		setUploadOffsetHeaders(w, upload)
+		w.WriteHeader(http.StatusNoContent)
+	case http.StatusNoContent, http.StatusConflict:
+		setUploadOffsetHeaders(w, upload)
+		w.WriteHeader(responseCode)
+	default:
+		w.WriteHeader(responseCode)
+	}
+}
+
 func DownloadFile(w http.ResponseWriter, req *http.Request) {
 	data.Logger.Printf("Download called")
+	extendTransferDeadlines(w)
 	clientPermitted, authToken := checkClientPermission(req, w)
 	if clientPermitted {
 		vars := mux.Vars(req)
 		identifier := vars["identifier"]
 		data.Logger.Printf("UploadID=%d, authToken=%s", identifier, authToken)
 		_, applicationId, applicationInstanceId := auth.DecodeAndCheckAuthToken(authToken)
-		responseCode, data, contentType, _ := storage.RetrieveBinaryData(applicationId, applicationInstanceId, identifier)
-		if responseCode == http.StatusOK {
-			w.Header().Set("Content-Type", contentType)
-			w.Write(data)
-		} else {
-			w.WriteHeader(responseCode)
+		responseCode, binaryData, header := storage.RetrieveBinaryData(req.Context(), applicationId, applicationInstanceId, identifier, req.Header)
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(responseCode)
+		if binaryData != nil {
+			defer binaryData.Close()
+			if req.Method != "HEAD" {
+				io.Copy(w, binaryData)
+			}
 		}
 	}
 }
 
+/*
+ * DownloadURL signs a link with which the client, or whoever it passes the
+ * link to, downloads the data straight from storage. The query may ask for
+ * the seconds the link lasts ("ttl") and for a link that works only once
+ * ("once=true").
+ */
+func DownloadURL(w http.ResponseWriter, req *http.Request) {
+	data.Logger.Printf("DownloadURL called")
+	clientPermitted, authToken := checkClientPermission(req, w)
+	if clientPermitted {
+		identifier := mux.Vars(req)["identifier"]
+		_, applicationId, applicationInstanceId := auth.DecodeAndCheckAuthToken(authToken)
+		ttl, err := strconv.Atoi(req.URL.Query().Get("ttl"))
+		if err != nil || ttl < 0 {
+			ttl = 0
+		}
+		oneTime, _ := strconv.ParseBool(req.URL.Query().Get("once"))
+		signed, link := storage.SignedDownloadURL(applicationId, applicationInstanceId, identifier, time.Duration(ttl)*time.Second, oneTime)
+		if !signed {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(link)
+	}
+}
+
+/*
+ * DeleteFile removes uploaded data before it expires, e.g. once the
+ * client has its result.
+ */
+func DeleteFile(w http.ResponseWriter, req *http.Request) {
+	data.Logger.Printf("DeleteFile called")
+	clientPermitted, authToken := checkClientPermission(req, w)
+	if clientPermitted {
+		identifier := mux.Vars(req)["identifier"]
+		_, applicationId, applicationInstanceId := auth.DecodeAndCheckAuthToken(authToken)
+		w.WriteHeader(storage.DeleteBinaryData(req.Context(), applicationId, applicationInstanceId, identifier))
+	}
+}
+
 /* Job Related Functions */
 func getJobInfo(authToken string, w http.ResponseWriter, req *http.Request) (bool, int, int, int) {
 	_, applicationId, applicationInstanceId := auth.DecodeAndCheckAuthToken(authToken)
@@ -144,35 +462,99 @@ func getJobInfo(authToken string, w http.ResponseWriter, req *http.Request) (boo
 	return false, 0, 0, 0
 }
 
+/*
+ * Runs the job creation and returns the status code together with the value
+ * to send as JSON. A nil value means the status code is sent on its own.
+ */
+func newJobResponse(ctx context.Context, applicationId int, applicationInstanceId int, requestBody []byte, useCache bool) (int, interface{}) {
+	if jobs.IsScheduledRequest(requestBody) {
+		httpResponse, schedule, fieldErrors := jobs.CreateSchedule(applicationId, applicationInstanceId, requestBody)
+		if httpResponse == http.StatusCreated {
+			return httpResponse, schedule
+		} else if len(fieldErrors) > 0 {
+			return httpResponse, fieldErrors
+		}
+		return httpResponse, nil
+	}
+	if validationResponse, fieldErrors := jobs.ValidateJobRequest(requestBody); validationResponse == http.StatusUnprocessableEntity {
+		return validationResponse, fieldErrors
+	}
+	httpResponse, jobData, storageUploadInfo := jobs.CreateNewJob(ctx, applicationId, applicationInstanceId, requestBody, useCache)
+	if httpResponse == http.StatusOK {
+		var decodedResult interface{}
+		err := json.Unmarshal([]byte(jobData.Payload), &decodedResult)
+		if err == nil {
+			return httpResponse, decodedResult
+		}
+		return http.StatusInternalServerError, nil
+	} else if httpResponse == http.StatusNotAcceptable {
+		return httpResponse, jobs.UnmatchedRequirements(requestBody)
+	} else if httpResponse == http.StatusServiceUnavailable && jobData.JobId > 0 {
+		return httpResponse, jobData
+	} else if httpResponse == http.StatusAccepted || httpResponse == http.StatusCreated {
+		switch jobData.JobStatus {
+		case jobs.JobStatusWaitingForFile:
+			return httpResponse, storageUploadInfo
+		default:
+			return httpResponse, jobData
+		}
+	}
+	return httpResponse, nil
+}
+
+func writeJSONResponse(w http.ResponseWriter, httpResponse int, responseBody []byte) {
+	if responseBody != nil {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	w.WriteHeader(httpResponse)
+	if responseBody != nil {
+		w.Write(responseBody)
+	}
+}
+
+/*
+ * Job creating requests that carry an Idempotency-Key header are answered
+ * with the stored response of the first request when they are retried. The
+ * key is scoped to the application instance and the route, not to the auth
+ * token, which may have been renewed in between.
+ */
+func respondIdempotently(w http.ResponseWriter, req *http.Request, applicationId int, applicationInstanceId int, requestBody []byte, create func() (int, interface{})) {
+	var responseBody []byte
+	idempotencyKey := req.Header.Get("Idempotency-Key")
+	if len(idempotencyKey) > 128 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if idempotencyKey != "" {
+		routePath, _ := mux.CurrentRoute(req).GetPathTemplate()
+		proceed, httpResponse, storedBody := jobs.BeginIdempotentRequest(applicationId, applicationInstanceId, idempotencyKey, routePath, requestBody)
+		if !proceed {
+			if httpResponse >= 200 && httpResponse < 300 {
+				w.Header().Set("Idempotent-Replayed", "true")
+			}
+			writeJSONResponse(w, httpResponse, storedBody)
+			return
+		}
+	}
+	httpResponse, response := create()
+	if response != nil {
+		responseBody, _ = json.Marshal(response)
+	}
+	if idempotencyKey != "" {
+		jobs.FinishIdempotentRequest(applicationId, applicationInstanceId, idempotencyKey, httpResponse, responseBody)
+	}
+	writeJSONResponse(w, httpResponse, responseBody)
+}
+
 func JobNew(w http.ResponseWriter, req *http.Request) {
 	data.Logger.Printf("JobNew called")
 	clientPermitted, authToken := checkClientPermission(req, w)
 	if clientPermitted {
 		requestBody, _ := ioutil.ReadAll(req.Body)
 		_, applicationId, applicationInstanceId := auth.DecodeAndCheckAuthToken(authToken)
-		httpResponse, jobData, storageUploadInfo := jobs.CreateNewJob(applicationId, applicationInstanceId, requestBody)
-		if httpResponse == http.StatusOK {
-			var decodedResult interface{}
-			err := json.Unmarshal([]byte(jobData.Payload), &decodedResult)
-			if err == nil {
-				w.Header().Set("Content-Type", "application/json; charset=utf-8")
-				w.WriteHeader(httpResponse)
-				json.NewEncoder(w).Encode(decodedResult)
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
-		} else if httpResponse == http.StatusAccepted || httpResponse == http.StatusCreated {
-			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			w.WriteHeader(httpResponse)
-			switch jobData.JobStatus {
-			case jobs.JobStatusWaitingForFile:
-				json.NewEncoder(w).Encode(storageUploadInfo)
-			default:
-				json.NewEncoder(w).Encode(jobData)
-			}
-		} else {
-			w.WriteHeader(httpResponse)
-		}
+		respondIdempotently(w, req, applicationId, applicationInstanceId, requestBody, func() (int, interface{}) {
+			return newJobResponse(req.Context(), applicationId, applicationInstanceId, requestBody, useResultCache(req))
+		})
 	}
 }
 
@@ -182,7 +564,7 @@ func JobStatus(w http.ResponseWriter, req *http.Request) {
 	if clientPermitted {
 		success, applicationId, applicationInstanceId, jobId := getJobInfo(authToken, w, req)
 		if success {
-			httpResponse, jobStatus := jobs.JobStatus(applicationId, applicationInstanceId, jobId)
+			httpResponse, jobStatus := jobs.JobStatus(req.Context(), applicationId, applicationInstanceId, jobId)
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
 			w.WriteHeader(httpResponse)
 			json.NewEncoder(w).Encode(jobStatus)
@@ -199,7 +581,7 @@ func JobResult(w http.ResponseWriter, req *http.Request) {
 		success, applicationId, applicationInstanceId, jobId := getJobInfo(authToken, w, req)
 		if success {
 			var decodedResult interface{}
-			httpResponse, jobResult := jobs.JobResult(applicationId, applicationInstanceId, jobId)
+			httpResponse, jobResult := jobs.JobResult(req.Context(), applicationId, applicationInstanceId, jobId)
 			if jobResult != nil {
 				w.Header().Set("Content-Type", "application/json; charset=utf-8")
 			}
@@ -232,6 +614,143 @@ func JobDelete(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+/* Batch Related Functions */
+func BatchNew(w http.ResponseWriter, req *http.Request) {
+	data.Logger.Printf("BatchNew called")
+	clientPermitted, authToken := checkClientPermission(req, w)
+	if clientPermitted {
+		requestBody, _ := ioutil.ReadAll(req.Body)
+		_, applicationId, applicationInstanceId := auth.DecodeAndCheckAuthToken(authToken)
+		respondIdempotently(w, req, applicationId, applicationInstanceId, requestBody, func() (int, interface{}) {
+			httpResponse, batchResponse := jobs.CreateNewBatch(req.Context(), applicationId, applicationInstanceId, requestBody, useResultCache(req))
+			if httpResponse == http.StatusAccepted || len(batchResponse.Jobs) > 0 {
+				return httpResponse, batchResponse
+			}
+			return httpResponse, nil
+		})
+	}
+}
+
+func BatchStatus(w http.ResponseWriter, req *http.Request) {
+	data.Logger.Printf("BATCH-Status called")
+	clientPermitted, authToken := checkClientPermission(req, w)
+	if clientPermitted {
+		_, applicationId, applicationInstanceId := auth.DecodeAndCheckAuthToken(authToken)
+		httpResponse, batchStatus := jobs.BatchStatus(req.Context(), applicationId, applicationInstanceId, mux.Vars(req)["batchId"])
+		if httpResponse == http.StatusOK {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(httpResponse)
+			json.NewEncoder(w).Encode(batchStatus)
+		} else {
+			w.WriteHeader(httpResponse)
+		}
+	}
+}
+
+func BatchResult(w http.ResponseWriter, req *http.Request) {
+	data.Logger.Printf("BATCH-Result called")
+	clientPermitted, authToken := checkClientPermission(req, w)
+	if clientPermitted {
+		_, applicationId, applicationInstanceId := auth.DecodeAndCheckAuthToken(authToken)
+		httpResponse, batchResult := jobs.BatchResult(req.Context(), applicationId, applicationInstanceId, mux.Vars(req)["batchId"])
+		if httpResponse == http.StatusOK {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(httpResponse)
+			json.NewEncoder(w).Encode(batchResult)
+		} else {
+			w.WriteHeader(httpResponse)
+		}
+	}
+}
+
+func QueueStats(w http.ResponseWriter, req *http.Request) {
+	data.Logger.Printf("QueueStats called")
+	clientPermitted, authToken := checkClientPermission(req, w)
+	if clientPermitted {
+		_, applicationId, _ := auth.DecodeAndCheckAuthToken(authToken)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(jobs.ApplicationQueueStats(applicationId))
+	}
+}
+
+/*
+ * StorageUsage shows how much the application keeps in storage and how
+ * much its quota allows.
+ */
+func StorageUsage(w http.ResponseWriter, req *http.Request) {
+	data.Logger.Printf("StorageUsage called")
+	clientPermitted, authToken := checkClientPermission(req, w)
+	if clientPermitted {
+		_, applicationId, _ := auth.DecodeAndCheckAuthToken(authToken)
+		responseCode, usage := storage.StorageUsage(req.Context(), applicationId)
+		if responseCode != http.StatusOK {
+			w.WriteHeader(responseCode)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(usage)
+	}
+}
+
+/* Schedule Related Functions */
+func getScheduleInfo(authToken string, w http.ResponseWriter, req *http.Request) (bool, int, int, int) {
+	_, applicationId, applicationInstanceId := auth.DecodeAndCheckAuthToken(authToken)
+	scheduleId, err := strconv.Atoi(mux.Vars(req)["scheduleId"])
+	if err == nil {
+		return true, applicationId, applicationInstanceId, scheduleId
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	return false, 0, 0, 0
+}
+
+func ScheduleList(w http.ResponseWriter, req *http.Request) {
+	data.Logger.Printf("ScheduleList called")
+	clientPermitted, authToken := checkClientPermission(req, w)
+	if clientPermitted {
+		_, applicationId, applicationInstanceId := auth.DecodeAndCheckAuthToken(authToken)
+		httpResponse, schedules := jobs.ListSchedules(applicationId, applicationInstanceId)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(httpResponse)
+		json.NewEncoder(w).Encode(schedules)
+	}
+}
+
+func ScheduleRuns(w http.ResponseWriter, req *http.Request) {
+	data.Logger.Printf("ScheduleRuns called")
+	clientPermitted, authToken := checkClientPermission(req, w)
+	if clientPermitted {
+		success, applicationId, applicationInstanceId, scheduleId := getScheduleInfo(authToken, w, req)
+		if success {
+			httpResponse, runs := jobs.ScheduleRuns(applicationId, applicationInstanceId, scheduleId)
+			if httpResponse == http.StatusOK {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(httpResponse)
+				json.NewEncoder(w).Encode(runs)
+			} else {
+				w.WriteHeader(httpResponse)
+			}
+		}
+	}
+}
+
+func ScheduleCancel(w http.ResponseWriter, req *http.Request) {
+	data.Logger.Printf("ScheduleCancel called")
+	clientPermitted, authToken := checkClientPermission(req, w)
+	if clientPermitted {
+		success, applicationId, applicationInstanceId, scheduleId := getScheduleInfo(authToken, w, req)
+		if success {
+			httpResponse, schedule := jobs.CancelSchedule(applicationId, applicationInstanceId, scheduleId)
+			if httpResponse == http.StatusOK {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(httpResponse)
+				json.NewEncoder(w).Encode(schedule)
+			} else {
+				w.WriteHeader(httpResponse)
+			}
+		}
+	}
+}
+
 /* Main Functions */
 func GoHome(w http.ResponseWriter, req *http.Request) {
 	http.Redirect(w, req, "http://www.marcurie.eu/", 301)
@@ -255,26 +774,17 @@ func Authenticate(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+/*
+ * Lists every service type with the versions, capabilities and labels its
+ * instances registered with; the service's own description is passed on as
+ * service_about. Clients use these to fill in a job's service_requirements.
+ */
 func AvailableServices(w http.ResponseWriter, req *http.Request) {
 	data.Logger.Printf("AvailableServices called")
 	clientPermitted, _ := checkClientPermission(req, w)
 	if clientPermitted {
-		var emptyArray []string = make([]string, 0, 1)
-		var retServices []interface{}
-		var serviceInfo interface{}
-		availableServices := jobs.AvailableServices()
-		for _, service := range availableServices {
-			err := json.Unmarshal([]byte(service.About), &serviceInfo)
-			if err == nil {
-				retServices = append(retServices, serviceInfo)
-			}
-		}
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		if retServices != nil {
-			json.NewEncoder(w).Encode(retServices)
-		} else {
-			json.NewEncoder(w).Encode(emptyArray)
-		}
+		json.NewEncoder(w).Encode(jobs.ServiceOffers())
 	} else {
 		w.WriteHeader(http.StatusUnauthorized)
 	}
@@ -293,12 +803,14 @@ func main() {
 		os.Exit(1)
 	}
 	cydb.OpenDatabase(configuration.Database)
+	outbound.Init(configuration.Outbound)
 	storage.InitStorage(configuration.Storage)
 	jobs.InitJobs(configuration.Jobs)
 	flag.DurationVar(&wait, "graceful-timeout", time.Second*15, "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m")
 	flag.Parse()
 
 	router := mux.NewRouter()
+	router.Use(retryAfterMiddleware)
 	router.HandleFunc("/", GoHome)
 
 	/* AUTHENTICATION METHODS */
@@ -313,9 +825,29 @@ func main() {
 	router.HandleFunc(rootURL+"/job/result/{authToken}/{jobId}", JobResult)
 	router.HandleFunc(rootURL+"/job/delete/{authToken}/{jobId}", JobDelete)
 
+	/* Batch Related Methods */
+	router.HandleFunc(rootURL+"/jobs/batch/{authToken}", BatchNew).Methods("POST")
+	router.HandleFunc(rootURL+"/jobs/batch/status/{authToken}/{batchId}", BatchStatus)
+	router.HandleFunc(rootURL+"/jobs/batch/result/{authToken}/{batchId}", BatchResult)
+	router.HandleFunc(rootURL+"/jobs/queue-stats/{authToken}", QueueStats)
+
+	/* Schedule Related Methods */
+	router.HandleFunc(rootURL+"/job/schedules/{authToken}", ScheduleList)
+	router.HandleFunc(rootURL+"/job/schedule/runs/{authToken}/{scheduleId}", ScheduleRuns)
+	router.HandleFunc(rootURL+"/job/schedule/cancel/{authToken}/{scheduleId}", ScheduleCancel)
+
 	/* UPLOAD METHODS */
+	// tus requests carry a Tus-Resumable header; everything else is a
+	// single upload.
+	router.HandleFunc(rootURL+"/upload/{authToken}/{uploadId}", UploadOptions).Methods("OPTIONS")
+	router.HandleFunc(rootURL+"/upload/{authToken}/{uploadId}", CreateUpload).Methods("POST").Headers("Tus-Resumable", "")
+	router.HandleFunc(rootURL+"/upload/{authToken}/{uploadId}", UploadOffset).Methods("HEAD").Headers("Tus-Resumable", "")
+	router.HandleFunc(rootURL+"/upload/{authToken}/{uploadId}", AppendUpload).Methods("PATCH").Headers("Tus-Resumable", "")
 	router.HandleFunc(rootURL+"/upload/{authToken}/{uploadId}", UploadFile)
+	router.HandleFunc(rootURL+"/download/{authToken}/{identifier}", DeleteFile).Methods("DELETE")
 	router.HandleFunc(rootURL+"/download/{authToken}/{identifier}", DownloadFile)
+	router.HandleFunc(rootURL+"/download-url/{authToken}/{identifier}", DownloadURL)
+	router.HandleFunc(rootURL+"/storage/usage/{authToken}", StorageUsage)
 
 	/* Prepare our server */
 	myAddr := fmt.Sprintf("%s:%d", configuration.Me.InternalHost, configuration.Me.InternalPort)
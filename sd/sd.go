@@ -5,6 +5,7 @@ Copyright (c) 2018 Imdat Solak
 package main
 
 import (
+	"cluster"
 	"configfile"
 	"context"
 	"cydb"
@@ -17,6 +18,13 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"outbound"
+	"registry"
+	"schema"
+	"sdauth"
+	"sdclient"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -26,22 +34,167 @@ type MyConfig struct {
 }
 
 type SDConfiguration struct {
-	Me                MyConfig            `json:"me"`
-	Database          cydb.DatabaseConfig `json:"database"`
-	HeartbeatInterval int                 `json:"heartbeat_interval"`
+	Me                MyConfig                  `json:"me"`
+	Database          cydb.DatabaseConfig       `json:"database"`
+	HeartbeatInterval int                       `json:"heartbeat_interval"`
+	Outbound          outbound.OutboundConfig   `json:"outbound"`
+	LeaseTTL          int                       `json:"lease_ttl"`
+	LeaseMaxTTL       int                       `json:"lease_max_ttl"`
+	HeartbeatProbing  bool                      `json:"heartbeat_probing"`
+	ProbeConcurrency  int                       `json:"probe_concurrency"`
+	DrainTimeout      int                       `json:"drain_timeout"`
+	LongPollMaxWait   int                       `json:"long_poll_max_wait"`
+	Cluster           cluster.ClusterConfig     `json:"cluster"`
+	Registration      sdauth.RegistrationConfig `json:"registration"`
 }
 
+const (
+	defaultProbeConcurrency = 16
+	defaultLeaseTTL         = 30
+	defaultLeaseMaxTTL      = 300
+	defaultDrainTimeout     = 600
+	defaultLongPollMaxWait  = 300
+)
+
 var apiVersion = "1.0"
 var rootURL = "/" + apiVersion
 var configuration SDConfiguration
-var currentServices data.ServiceInfoList
+var services *registry.Registry
+
+/*
+ * members is nil unless cluster peers are configured. A single SD keeps its
+ * registry in the AvailableServices table; a cluster replicates it between
+ * its members instead and needs no database.
+ */
+var members *cluster.Node
+
+func leaseTTL() int {
+	if configuration.LeaseTTL > 0 {
+		return configuration.LeaseTTL
+	}
+	return defaultLeaseTTL
+}
+
+func leaseMaxTTL() int {
+	if configuration.LeaseMaxTTL > 0 {
+		return configuration.LeaseMaxTTL
+	}
+	return defaultLeaseMaxTTL
+}
+
+func drainTimeout() int {
+	if configuration.DrainTimeout > 0 {
+		return configuration.DrainTimeout
+	}
+	return defaultDrainTimeout
+}
+
+func longPollMaxWait() time.Duration {
+	if configuration.LongPollMaxWait > 0 {
+		return time.Duration(configuration.LongPollMaxWait) * time.Second
+	}
+	return defaultLongPollMaxWait * time.Second
+}
+
+/*
+ * The wait parameter is a duration ("90s", "5m") or a number of seconds. It
+ * defaults to, and is capped at, long_poll_max_wait.
+ */
+func longPollWait(req *http.Request) time.Duration {
+	wait := longPollMaxWait()
+	if waitParam := req.URL.Query().Get("wait"); waitParam != "" {
+		if seconds, err := strconv.Atoi(waitParam); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		} else if duration, err := time.ParseDuration(waitParam); err == nil {
+			wait = duration
+		}
+	}
+	if wait <= 0 || wait > longPollMaxWait() {
+		wait = longPollMaxWait()
+	}
+	return wait
+}
+
+/*
+ * Only the leader probes, expires and changes the registry; the other
+ * members get its copy.
+ */
+func isLeader() bool {
+	return members == nil || members.IsLeader()
+}
+
+/*
+ * Requests that change the registry are handled by the leader. Other
+ * members pass them on.
+ */
+func leaderOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if isLeader() {
+			handler(w, req)
+		} else if authenticated, credential := authenticate(w, req, "forward"); authenticated {
+			req.Header.Del(sdauth.ForwardedCredentialHeader)
+			if credential != nil {
+				req.Header.Set(sdauth.ForwardedCredentialHeader, credential.Name)
+			}
+			members.Forward(w, req)
+		}
+	}
+}
+
+/*
+ * Requests that change the registry must be made with one of the configured
+ * credentials, if registration.require_auth is set. A request a cluster
+ * member forwarded was already authenticated by that member.
+ */
+func authenticate(w http.ResponseWriter, req *http.Request, event string) (bool, *sdauth.Credential) {
+	authenticated, credential := sdauth.Authenticate(req, members != nil && members.IsPeerRequest(req))
+	if !authenticated {
+		sdauth.Audit(req, event, "denied: no valid credentials", nil, data.ServiceInfo{})
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	return authenticated, credential
+}
+
+/*
+ * Credentials may only touch services on their hosts and of their service
+ * types.
+ */
+func permitted(w http.ResponseWriter, req *http.Request, event string, credential *sdauth.Credential, service data.ServiceInfo) bool {
+	allowed, reason := credential.Permits(service)
+	if !allowed {
+		sdauth.Audit(req, event, "denied: "+reason, credential, service)
+		w.WriteHeader(http.StatusForbidden)
+	}
+	return allowed
+}
+
+/*
+ * A change is only confirmed once a majority of the cluster has it. If that
+ * fails the caller gets a 503 and should retry; registering and
+ * deregistering again is harmless.
+ */
+func committed(w http.ResponseWriter) bool {
+	if members == nil || members.Commit() {
+		return true
+	}
+	data.Logger.Printf("SD: change not replicated to a majority of the cluster")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	return false
+}
+
+func probeConcurrency() int {
+	if configuration.ProbeConcurrency > 0 {
+		return configuration.ProbeConcurrency
+	}
+	return defaultProbeConcurrency
+}
 
 func isServiceStillAlive(aService data.ServiceInfo) bool {
 	var heartbeatURL string
 	heartbeatURL = aService.HeartbeatURL
 	req, err := http.NewRequest("GET", heartbeatURL, nil)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := outbound.Do("heartbeat", req, true)
 	if err == nil {
 		defer resp.Body.Close()
 		if resp.StatusCode == http.StatusOK {
@@ -52,106 +205,287 @@ func isServiceStillAlive(aService data.ServiceInfo) bool {
 	return false
 }
 
-func allServicesAreStillAvailable() bool {
-	var newS data.ServiceInfoList = make(data.ServiceInfoList, 0, 1)
+/*
+ * Probes every service with a heartbeat URL, several at a time. Each probe
+ * is bounded by the timeout of the outbound "heartbeat" target, so a slow
+ * service no longer delays the others. Services that answer get their lease
+ * extended, the others are removed.
+ */
+func allServicesAreStillAvailable() {
+	var wg sync.WaitGroup
+	var dead []string
+	var deadMutex sync.Mutex
 
-	for _, aService := range currentServices {
-		if isServiceStillAlive(aService) {
-			newS = append(newS, aService)
+	slots := make(chan struct{}, probeConcurrency())
+	for _, aService := range services.Snapshot().Services {
+		if aService.HeartbeatURL == "" {
+			continue
 		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(aService data.ServiceInfo) {
+			defer wg.Done()
+			if isServiceStillAlive(aService) {
+				services.Extend(aService.InstanceId)
+			} else {
+				sdauth.Audit(nil, "remove", "heartbeat failed", nil, aService)
+				deadMutex.Lock()
+				dead = append(dead, aService.InstanceId)
+				deadMutex.Unlock()
+			}
+			<-slots
+		}(aService)
 	}
-	if len(currentServices) != len(newS) {
-		currentServices = newS
-		return false
-	} else {
-		return true
+	wg.Wait()
+	if len(dead) > 0 {
+		services.Remove(dead...)
 	}
 }
 
 func regularlyCheckServiceStatus() {
 	for {
-		if !allServicesAreStillAvailable() {
-			cydb.UpdateAvailableServices(currentServices)
+		if isLeader() {
+			allServicesAreStillAvailable()
 		}
 		time.Sleep(time.Duration(configuration.HeartbeatInterval) * time.Second)
 	}
 }
 
-func appendNewService(newService data.ServiceInfo) data.ServiceInfoList {
-	var newServiceServer string = newService.Server
-	var newServicePort int = newService.Port
-	var newS data.ServiceInfoList = make(data.ServiceInfoList, 0, len(currentServices))
-
-	for _, existingService := range currentServices {
-		if existingService.Port > 0 && (existingService.Server != newServiceServer || existingService.Port != newServicePort) {
-			newS = append(newS, existingService)
+func regularlyExpireLeases() {
+	for {
+		time.Sleep(time.Second)
+		if !isLeader() {
+			continue
+		}
+		if expired := services.Expire(time.Now()); len(expired) > 0 {
+			data.Logger.Printf("SD: %d service leases expired", len(expired))
+			for _, service := range expired {
+				sdauth.Audit(nil, "remove", "lease expired", nil, service)
+			}
 		}
 	}
-	return append(newS, newService)
+}
+
+/*
+ * Stores every new version of the registry, so it survives a restart.
+ */
+func persistRegistryChanges() {
+	changes, _ := services.Watch()
+	for snapshot := range changes {
+		cydb.UpdateAvailableServices(snapshot.Services)
+	}
 }
 
 func updateAvailableServices() {
 	var las data.ServiceInfoList = cydb.LastAvailableServices()
 	if las != nil {
-		currentServices = las
-		if !allServicesAreStillAvailable() {
-			cydb.UpdateAvailableServices(currentServices)
-		}
-	} else {
-		currentServices = make(data.ServiceInfoList, 0, 100)
+		services.Load(las)
 	}
 }
 
+/*
+ * Every answer carries the registry version in X-SD-Index. A request with
+ * ?index=<that version> blocks until the registry changes or the wait time
+ * is over, like a Consul blocking query.
+ */
 func GetAvailableServices(w http.ResponseWriter, req *http.Request) {
 	data.Logger.Printf("SD: Someone asking for AVAILABLE-SERVICES\n")
+	snapshot := services.Snapshot()
+	if index, err := strconv.ParseUint(req.URL.Query().Get("index"), 10, 64); err == nil && index == snapshot.Version {
+		snapshot = services.Wait(index, longPollWait(req), req.Context().Done())
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set(sdclient.IndexHeader, strconv.FormatUint(snapshot.Version, 10))
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(currentServices)
+	json.NewEncoder(w).Encode(snapshot.Services)
 }
 
 func RegisterService(w http.ResponseWriter, req *http.Request) {
 	var serviceData data.ServiceInfo
+	authenticated, credential := authenticate(w, req, "register")
+	if !authenticated {
+		return
+	}
 	err := json.NewDecoder(req.Body).Decode(&serviceData)
+	if err == nil && len(serviceData.RequestSchema) > 0 {
+		if ok, _ := schema.Parse(serviceData.RequestSchema); !ok {
+			data.Logger.Printf("Register Err: invalid request schema for service type %d", serviceData.ServiceType)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if err == nil && serviceData.Version != "" {
+		if ok, _ := data.ParseVersion(serviceData.Version); !ok {
+			data.Logger.Printf("Register Err: invalid version %q for service type %d", serviceData.Version, serviceData.ServiceType)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
 	if err == nil {
-		data.Logger.Printf("Registering Service:", serviceData)
-		currentServices = appendNewService(serviceData)
-		cydb.UpdateAvailableServices(currentServices)
+		if !permitted(w, req, "register", credential, serviceData) {
+			return
+		}
+		registered, serviceLease := services.Register(serviceData)
+		data.Logger.Printf("Registered Service %d at %s as instance %s", registered.ServiceType, registry.Address(registered), registered.InstanceId)
+		sdauth.Audit(req, "register", "ok", credential, registered)
+		if !committed(w) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(serviceLease)
 	} else {
 		data.Logger.Printf("Register Err %s", err)
 		w.WriteHeader(http.StatusBadRequest)
 	}
 }
 
+/*
+ * Services renew their lease well before it expires, e.g. after a third of
+ * its TTL. An unknown lease means the service was removed (or SD restarted)
+ * and has to register again.
+ */
+func RenewLease(w http.ResponseWriter, req *http.Request) {
+	leaseId := mux.Vars(req)["leaseId"]
+	authenticated, credential := authenticate(w, req, "renew")
+	if !authenticated {
+		return
+	}
+	if found, service := services.InstanceForLease(leaseId); found && !permitted(w, req, "renew", credential, service) {
+		return
+	}
+	renewed, serviceLease := services.Renew(leaseId)
+	if renewed {
+		if !committed(w) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(serviceLease)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func DeregisterService(w http.ResponseWriter, req *http.Request) {
+	leaseId := mux.Vars(req)["leaseId"]
+	authenticated, credential := authenticate(w, req, "deregister")
+	if !authenticated {
+		return
+	}
+	if found, service := services.InstanceForLease(leaseId); found && !permitted(w, req, "deregister", credential, service) {
+		return
+	}
+	deregistered, service := services.Deregister(leaseId)
+	if deregistered {
+		data.Logger.Printf("Deregistered Service %d at %s", service.ServiceType, registry.Address(service))
+		sdauth.Audit(req, "deregister", "ok", credential, service)
+		if !committed(w) {
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+/*
+ * DELETE /register-service/{id} removes the instance right away. With
+ * ?drain=true it is only marked as draining: FE sends it no new jobs, but
+ * it stays registered for the jobs it is still running until it deletes
+ * itself or the drain timeout is over.
+ */
+func UnregisterService(w http.ResponseWriter, req *http.Request) {
+	instanceId := mux.Vars(req)["id"]
+	authenticated, credential := authenticate(w, req, "unregister")
+	if !authenticated {
+		return
+	}
+	found, service := services.Instance(instanceId)
+	if found && !permitted(w, req, "unregister", credential, service) {
+		return
+	}
+	if drain, _ := strconv.ParseBool(req.URL.Query().Get("drain")); drain {
+		drained, service := services.Drain(instanceId, drainTimeout())
+		if drained {
+			data.Logger.Printf("Draining Service %d at %s", service.ServiceType, registry.Address(service))
+			sdauth.Audit(req, "drain", "ok", credential, service)
+			if !committed(w) {
+				return
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(service)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	} else if services.Remove(instanceId) {
+		data.Logger.Printf("Unregistered Service instance %s", instanceId)
+		sdauth.Audit(req, "unregister", "ok", credential, service)
+		if !committed(w) {
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
 func main() {
 	var wait time.Duration
+	var configFile string
 	configuration = SDConfiguration{}
 	data.Logger = log.New(os.Stdout, "MARCURIE (sd) - ", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
-	if configfile.ReadConfiguration("config.json", &configuration) == false {
-		data.Logger.Printf("Missing my config file in local directory")
-		os.Exit(1)
-	}
-	cydb.OpenDatabase(configuration.Database)
 	flag.DurationVar(&wait, "graceful-timeout", time.Second*15, "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m")
+	flag.StringVar(&configFile, "config", "config.json", "the configuration file, e.g. one per cluster member when running several SDs on one host")
 	flag.Parse()
+	if configfile.ReadConfiguration(configFile, &configuration) == false {
+		data.Logger.Printf("Missing my config file %s", configFile)
+		os.Exit(1)
+	}
+	outbound.Init(configuration.Outbound)
+	if !sdauth.Init(configuration.Registration) {
+		os.Exit(1)
+	}
+	myAddr := fmt.Sprintf("%s:%d", configuration.Me.Host, configuration.Me.Port)
 
 	router := mux.NewRouter()
 
-	router.HandleFunc(rootURL+"/register-service", RegisterService)
+	router.HandleFunc(rootURL+"/register-service", leaderOnly(RegisterService))
+	router.HandleFunc(rootURL+"/register-service/{id}", leaderOnly(UnregisterService)).Methods("DELETE")
 	router.HandleFunc(rootURL+"/available-services", GetAvailableServices)
+	router.HandleFunc(rootURL+"/renew/{leaseId}", leaderOnly(RenewLease)).Methods("PUT", "POST")
+	router.HandleFunc(rootURL+"/deregister/{leaseId}", leaderOnly(DeregisterService)).Methods("DELETE", "POST")
 
-	go regularlyCheckServiceStatus()
+	services = registry.New(leaseTTL(), leaseMaxTTL())
+	if len(configuration.Cluster.Peers) > 0 {
+		if !cluster.ValidSecret(configuration.Cluster.Secret) {
+			data.Logger.Printf("cluster.secret must be set to a secret of your own, the same on every member")
+			os.Exit(1)
+		}
+		members = cluster.New(configuration.Cluster, myAddr, rootURL, services)
+		router.HandleFunc(rootURL+"/cluster/vote", members.VoteHandler).Methods("POST")
+		router.HandleFunc(rootURL+"/cluster/append", members.AppendHandler).Methods("POST")
+		router.HandleFunc(rootURL+"/cluster/status", members.StatusHandler).Methods("GET")
+		members.Start()
+	} else {
+		cydb.OpenDatabase(configuration.Database)
+		updateAvailableServices()
+		go persistRegistryChanges()
+	}
+	if configuration.HeartbeatProbing {
+		go regularlyCheckServiceStatus()
+	}
+	go regularlyExpireLeases()
 	/* Prepare our server */
-	myAddr := fmt.Sprintf("%s:%d", configuration.Me.Host, configuration.Me.Port)
 	srv := &http.Server{
 		Addr: myAddr,
 		// Good practice to set timeouts to avoid Slowloris attacks.
-		WriteTimeout: time.Second * 15,
+		WriteTimeout: time.Second*15 + longPollMaxWait(),
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
 		Handler:      router, // Pass our instance of gorilla/mux in.
 	}
-	updateAvailableServices()
 
 	// Run our server in a goroutine so that it doesn't block.
 	go func() {
@@ -160,6 +494,32 @@ func main() {
 		}
 	}()
 
+	/*
+	 * Services that authenticate with client certificates register on the
+	 * TLS listener; everything else is served there as well.
+	 */
+	var tlsSrv *http.Server
+	if tlsSettings := sdauth.TLSSettings(); tlsSettings.ListenPort > 0 {
+		ok, tlsConfig := sdauth.ServerTLSConfig()
+		if !ok {
+			data.Logger.Printf("Can't read the client CA file %s", tlsSettings.ClientCAFile)
+			os.Exit(1)
+		}
+		tlsSrv = &http.Server{
+			Addr:         fmt.Sprintf("%s:%d", configuration.Me.Host, tlsSettings.ListenPort),
+			TLSConfig:    tlsConfig,
+			WriteTimeout: srv.WriteTimeout,
+			ReadTimeout:  srv.ReadTimeout,
+			IdleTimeout:  srv.IdleTimeout,
+			Handler:      router,
+		}
+		go func() {
+			if err := tlsSrv.ListenAndServeTLS(tlsSettings.CertFile, tlsSettings.KeyFile); err != nil {
+				data.Logger.Println(err)
+			}
+		}()
+	}
+
 	c := make(chan os.Signal, 1)
 	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
 	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
@@ -174,10 +534,15 @@ func main() {
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
 	srv.Shutdown(ctx)
+	if tlsSrv != nil {
+		tlsSrv.Shutdown(ctx)
+	}
 	// Optionally, you could run srv.Shutdown in a goroutine and block on
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
 	data.Logger.Println("shutting down")
-	cydb.CloseDatabase()
+	if members == nil {
+		cydb.CloseDatabase()
+	}
 	os.Exit(0)
 }
@@ -14,3 +14,11 @@ func RecordJobDone(jobInfo data.TempJobInfo) bool {
 	success, _ := cydb.RecordJobDoneInDB(jobInfo.JobId)
 	return success
 }
+
+/*
+ * Jobs answered from the result cache never reach a job server; they are
+ * recorded as cache hits instead of done jobs.
+ */
+func RecordCacheHit(jobInfo data.TempJobInfo, cacheKey string, result string) bool {
+	return cydb.RecordCacheHitInDB(jobInfo, cacheKey, result)
+}
@@ -0,0 +1,351 @@
+/*
+Blobcrypt : Encryption of the blobs ss keeps at rest.
+
+Every blob is encrypted with a data key of its own, which is kept wrapped,
+i.e. encrypted, with the key of the application the blob belongs to. The
+blob is cut into chunks of ChunkSize bytes, each sealed with AES-256-GCM on
+its own, so it can be encrypted while it streams in and any range of it
+decrypted without reading the rest:
+
+	chunk i = AES-GCM(data key, nonce = i, plaintext, aad = last chunk?)
+
+The last chunk is marked, so a blob that was cut short does not decrypt.
+Once the application's key is gone, the data keys and with them the blobs
+can no longer be read.
+*/
+package blobcrypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	ChunkSize = 64 * 1024
+	KeySize   = 32
+	Overhead  = 16
+)
+
+var ErrCorrupt = errors.New("encrypted blob is corrupt or was changed")
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(chunk int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(chunk))
+	return nonce
+}
+
+func chunkAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+/*
+ * WrapKey encrypts a data key with an application's key; context ties the
+ * wrapped key to its blob, so it can't be used for another one.
+ */
+func WrapKey(applicationKey []byte, dataKey []byte, context []byte) ([]byte, error) {
+	aead, err := newAEAD(applicationKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, context), nil
+}
+
+func UnwrapKey(applicationKey []byte, wrapped []byte, context []byte) ([]byte, error) {
+	aead, err := newAEAD(applicationKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrCorrupt
+	}
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], context)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return dataKey, nil
+}
+
+/*
+ * chunks is the number of chunks of size bytes; even no data takes one.
+ */
+func chunks(size int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + ChunkSize - 1) / ChunkSize
+}
+
+func EncryptedSize(size int64) int64 {
+	return size + chunks(size)*Overhead
+}
+
+type encryptingReader struct {
+	source *bufio.Reader
+	aead   cipher.AEAD
+	chunk  int64
+	plain  []byte
+	sealed []byte
+	out    []byte
+	done   bool
+}
+
+/*
+ * NewEncryptingReader returns the encrypted data read from source. Errors
+ * of the source are passed on as they are.
+ */
+func NewEncryptingReader(source io.Reader, dataKey []byte) (io.Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptingReader{source: bufio.NewReaderSize(source, ChunkSize), aead: aead, plain: make([]byte, ChunkSize)}, nil
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.source, e.plain)
+		last := false
+		switch err {
+		case io.EOF, io.ErrUnexpectedEOF:
+			last = true
+		case nil:
+			// A full chunk is the last one if nothing follows.
+			if _, err := e.source.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		default:
+			return 0, err
+		}
+		e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.chunk), e.plain[:n], chunkAAD(last))
+		e.out = e.sealed
+		e.chunk++
+		e.done = last
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+var ErrTooLong = errors.New("more data than the blob holds")
+
+/*
+ * ChunkWriter encrypts a blob of size bytes that arrives in pieces, such as
+ * a resumable upload, writing each chunk to out once it is complete. The
+ * start of a chunk that is not complete yet is only handed out by Pending,
+ * sealed on its own under a random nonce that no chunk has, to be passed to
+ * the ChunkWriter that carries on from offset.
+ */
+type ChunkWriter struct {
+	out     io.Writer
+	aead    cipher.AEAD
+	size    int64
+	offset  int64
+	pending []byte
+	sealed  []byte
+}
+
+func pendingAAD(chunk int64) []byte {
+	aad := make([]byte, 9)
+	aad[0] = 2
+	binary.BigEndian.PutUint64(aad[1:], uint64(chunk))
+	return aad
+}
+
+func NewChunkWriter(out io.Writer, dataKey []byte, size int64, offset int64, pending []byte) (*ChunkWriter, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	w := &ChunkWriter{out: out, aead: aead, size: size, offset: offset, pending: make([]byte, 0, ChunkSize)}
+	switch {
+	case len(pending) > 0:
+		if len(pending) < aead.NonceSize() {
+			return nil, ErrCorrupt
+		}
+		w.pending, err = aead.Open(w.pending, pending[:aead.NonceSize()], pending[aead.NonceSize():], pendingAAD(offset/ChunkSize))
+		if err != nil || int64(len(w.pending)) != offset%ChunkSize {
+			return nil, ErrCorrupt
+		}
+	case offset%ChunkSize != 0 && offset != size:
+		return nil, ErrCorrupt
+	}
+	return w, nil
+}
+
+/*
+ * Write fails with ErrTooLong once p goes past the end of the blob; the
+ * last chunk is written as soon as its last byte is.
+ */
+func (w *ChunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.offset >= w.size {
+			return written, ErrTooLong
+		}
+		n := ChunkSize - len(w.pending)
+		if remaining := w.size - w.offset; int64(n) > remaining {
+			n = int(remaining)
+		}
+		if n > len(p) {
+			n = len(p)
+		}
+		w.pending = append(w.pending, p[:n]...)
+		w.offset += int64(n)
+		written += n
+		p = p[n:]
+		if len(w.pending) == ChunkSize || w.offset == w.size {
+			last := w.offset == w.size
+			w.sealed = w.aead.Seal(w.sealed[:0], chunkNonce((w.offset-1)/ChunkSize), w.pending, chunkAAD(last))
+			if _, err := w.out.Write(w.sealed); err != nil {
+				return written, err
+			}
+			w.pending = w.pending[:0]
+		}
+	}
+	return written, nil
+}
+
+/*
+ * Pending returns the start of the incomplete chunk sealed, nil if there
+ * is none. Chunk nonces begin with four zero bytes, so the random nonce
+ * gets its top bit set.
+ */
+func (w *ChunkWriter) Pending() ([]byte, error) {
+	if len(w.pending) == 0 {
+		return nil, nil
+	}
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	nonce[0] |= 0x80
+	return w.aead.Seal(nonce, nonce, w.pending, pendingAAD(w.offset/ChunkSize)), nil
+}
+
+/*
+ * WrittenSize is how much a ChunkWriter has written of the encrypted blob
+ * of size bytes once it took offset bytes: the chunks complete so far.
+ */
+func WrittenSize(offset int64, size int64) int64 {
+	if offset >= size {
+		return EncryptedSize(size)
+	}
+	return offset / ChunkSize * (ChunkSize + Overhead)
+}
+
+/*
+ * CiphertextRange returns the part of the encrypted blob, offset and
+ * length, that holds length bytes of the plaintext of size bytes from
+ * offset on.
+ */
+func CiphertextRange(offset int64, length int64, size int64) (int64, int64) {
+	first := offset / ChunkSize
+	last := (offset + length - 1) / ChunkSize
+	if length == 0 {
+		last = first
+	}
+	start := first * (ChunkSize + Overhead)
+	end := (last + 1) * (ChunkSize + Overhead)
+	if encrypted := EncryptedSize(size); end > encrypted {
+		end = encrypted
+	}
+	return start, end - start
+}
+
+type decryptingReader struct {
+	source    io.Reader
+	aead      cipher.AEAD
+	chunk     int64
+	lastChunk int64
+	final     int64
+	sealed    []byte
+	plain     []byte
+	out       []byte
+	skip      int
+}
+
+/*
+ * NewRangeDecrypter returns length bytes of the plaintext from offset on,
+ * reading from source the ciphertext CiphertextRange named. size is the
+ * size of the whole plaintext. A blob that was changed fails to read with
+ * ErrCorrupt.
+ */
+func NewRangeDecrypter(source io.Reader, dataKey []byte, offset int64, length int64, size int64) (io.Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	first := offset / ChunkSize
+	last := first
+	if length > 0 {
+		last = (offset + length - 1) / ChunkSize
+	}
+	d := &decryptingReader{source: source, aead: aead, chunk: first, lastChunk: last, final: chunks(size) - 1, sealed: make([]byte, ChunkSize+Overhead), skip: int(offset % ChunkSize)}
+	return io.LimitReader(d, length), nil
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.chunk > d.lastChunk {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.source, d.sealed)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if d.chunk != d.final {
+				return 0, ErrCorrupt
+			}
+		} else if err != nil {
+			return 0, err
+		}
+		plain, err := d.aead.Open(d.plain[:0], chunkNonce(d.chunk), d.sealed[:n], chunkAAD(d.chunk == d.final))
+		if err != nil {
+			return 0, ErrCorrupt
+		}
+		d.plain = plain
+		d.out = plain
+		if d.skip > 0 {
+			if d.skip > len(d.out) {
+				return 0, ErrCorrupt
+			}
+			d.out = d.out[d.skip:]
+			d.skip = 0
+		}
+		d.chunk++
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
@@ -0,0 +1,227 @@
+package blobcrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testPlaintext(t *testing.T, size int) []byte {
+	t.Helper()
+	plain := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, plain); err != nil {
+		t.Fatal(err)
+	}
+	return plain
+}
+
+func encrypt(t *testing.T, key []byte, plain []byte) []byte {
+	t.Helper()
+	sealed, err := NewEncryptingReader(bytes.NewReader(plain), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := ioutil.ReadAll(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+func decrypt(key []byte, ciphertext []byte, offset int64, length int64, size int64) ([]byte, error) {
+	plain, err := NewRangeDecrypter(bytes.NewReader(ciphertext), key, offset, length, size)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(plain)
+}
+
+func TestRoundTripAtChunkBoundaries(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 2 * ChunkSize, 3*ChunkSize + 5} {
+		plain := testPlaintext(t, size)
+		ciphertext := encrypt(t, key, plain)
+		if int64(len(ciphertext)) != EncryptedSize(int64(size)) {
+			t.Errorf("size %d: %d bytes encrypted, EncryptedSize says %d", size, len(ciphertext), EncryptedSize(int64(size)))
+		}
+		if size > 16 && bytes.Contains(ciphertext, plain[:size/2]) {
+			t.Errorf("size %d: plaintext found in the ciphertext", size)
+		}
+		got, err := decrypt(key, ciphertext, 0, int64(size), int64(size))
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("size %d: decrypted %d bytes, %v", size, len(got), err)
+		}
+	}
+}
+
+func TestRanges(t *testing.T) {
+	key := testKey(t)
+	size := int64(3*ChunkSize + 100)
+	plain := testPlaintext(t, int(size))
+	ciphertext := encrypt(t, key, plain)
+	for _, r := range [][2]int64{
+		{0, 1}, {0, ChunkSize}, {ChunkSize - 1, 2}, {ChunkSize, ChunkSize},
+		{ChunkSize + 10, ChunkSize}, {3 * ChunkSize, 100}, {size - 1, 1}, {5, size - 5}, {ChunkSize, 0},
+	} {
+		offset, length := r[0], r[1]
+		start, sealedLength := CiphertextRange(offset, length, size)
+		if start < 0 || start+sealedLength > int64(len(ciphertext)) {
+			t.Fatalf("range %d+%d: ciphertext range %d+%d is out of bounds", offset, length, start, sealedLength)
+		}
+		got, err := decrypt(key, ciphertext[start:start+sealedLength], offset, length, size)
+		if err != nil || !bytes.Equal(got, plain[offset:offset+length]) {
+			t.Errorf("range %d+%d: got %d bytes, %v", offset, length, len(got), err)
+		}
+	}
+}
+
+func TestChangedCiphertextIsCorrupt(t *testing.T) {
+	key := testKey(t)
+	plain := testPlaintext(t, 3*ChunkSize)
+	ciphertext := encrypt(t, key, plain)
+	sealedChunk := ChunkSize + Overhead
+	size := int64(len(plain))
+
+	expectCorrupt := func(name string, ciphertext []byte, size int64) {
+		t.Helper()
+		if _, err := decrypt(key, ciphertext, 0, size, size); err != ErrCorrupt {
+			t.Errorf("%s: got %v, want ErrCorrupt", name, err)
+		}
+	}
+	expectCorrupt("last chunk cut off", ciphertext[:2*sealedChunk], size)
+	expectCorrupt("last byte cut off", ciphertext[:len(ciphertext)-1], size)
+	// Cut at a chunk boundary and passed off as a shorter blob, the last
+	// chunk left is not marked as the last one.
+	expectCorrupt("cut short with a matching size", ciphertext[:2*sealedChunk], 2*ChunkSize)
+
+	reordered := append([]byte(nil), ciphertext[sealedChunk:2*sealedChunk]...)
+	reordered = append(reordered, ciphertext[:sealedChunk]...)
+	reordered = append(reordered, ciphertext[2*sealedChunk:]...)
+	expectCorrupt("chunks swapped", reordered, size)
+
+	flipped := append([]byte(nil), ciphertext...)
+	flipped[sealedChunk+7] ^= 1
+	expectCorrupt("bit flipped", flipped, size)
+
+	if _, err := decrypt(testKey(t), ciphertext, 0, size, size); err != ErrCorrupt {
+		t.Errorf("other key: got %v, want ErrCorrupt", err)
+	}
+}
+
+/*
+ * Writing a blob in pieces, each with a new ChunkWriter that continues
+ * from Pending, gives the same ciphertext as encrypting it at once.
+ */
+func TestChunkWriterResumes(t *testing.T) {
+	key := testKey(t)
+	size := int64(3*ChunkSize + 7)
+	plain := testPlaintext(t, int(size))
+	var file bytes.Buffer
+	var pending []byte
+	offset := int64(0)
+	for _, piece := range []int64{1000, ChunkSize, 1, ChunkSize - 1001, 3, ChunkSize - 3, 7} {
+		w, err := NewChunkWriter(&file, key, size, offset, pending)
+		if err != nil {
+			t.Fatalf("at %d: %s", offset, err)
+		}
+		if n, err := w.Write(plain[offset : offset+piece]); err != nil || int64(n) != piece {
+			t.Fatalf("at %d: wrote %d, %v", offset, n, err)
+		}
+		offset += piece
+		if pending, err = w.Pending(); err != nil {
+			t.Fatal(err)
+		}
+		if int64(file.Len()) != WrittenSize(offset, size) {
+			t.Fatalf("at %d: %d bytes written, WrittenSize says %d", offset, file.Len(), WrittenSize(offset, size))
+		}
+		if offset%ChunkSize == 0 || offset == size {
+			if pending != nil {
+				t.Fatalf("at %d: pending data without an incomplete chunk", offset)
+			}
+		} else if pending[0]&0x80 == 0 || bytes.Contains(pending, plain[offset-offset%ChunkSize:offset]) {
+			t.Fatalf("at %d: pending data not sealed under a nonce of its own", offset)
+		}
+	}
+	if offset != size {
+		t.Fatalf("test pieces add up to %d, not %d", offset, size)
+	}
+	if !bytes.Equal(file.Bytes(), encrypt(t, key, plain)) {
+		t.Fatal("pieced ciphertext differs from the one encrypted at once")
+	}
+	if got, err := decrypt(key, file.Bytes(), 0, size, size); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("pieced blob decrypted to %d bytes, %v", len(got), err)
+	}
+}
+
+func TestChunkWriterRefusesBadState(t *testing.T) {
+	key := testKey(t)
+	size := int64(2 * ChunkSize)
+	var file bytes.Buffer
+	w, _ := NewChunkWriter(&file, key, size, 0, nil)
+	w.Write(make([]byte, 100))
+	pending, _ := w.Pending()
+
+	if _, err := NewChunkWriter(&file, key, size, 100, pending); err != nil {
+		t.Fatalf("pending data refused: %s", err)
+	}
+	if _, err := NewChunkWriter(&file, key, size, 99, pending); err != ErrCorrupt {
+		t.Errorf("pending data at another offset: got %v", err)
+	}
+	if _, err := NewChunkWriter(&file, key, size, ChunkSize+100, pending); err != ErrCorrupt {
+		t.Errorf("pending data of another chunk: got %v", err)
+	}
+	if _, err := NewChunkWriter(&file, key, size, 100, nil); err != ErrCorrupt {
+		t.Errorf("missing pending data: got %v", err)
+	}
+	changed := append([]byte(nil), pending...)
+	changed[len(changed)-1] ^= 1
+	if _, err := NewChunkWriter(&file, key, size, 100, changed); err != ErrCorrupt {
+		t.Errorf("changed pending data: got %v", err)
+	}
+	if _, err := NewChunkWriter(&file, testKey(t), size, 100, pending); err != ErrCorrupt {
+		t.Errorf("pending data under another key: got %v", err)
+	}
+}
+
+func TestChunkWriterTooLong(t *testing.T) {
+	key := testKey(t)
+	var file bytes.Buffer
+	w, _ := NewChunkWriter(&file, key, 10, 0, nil)
+	if n, err := w.Write(make([]byte, 11)); err != ErrTooLong || n != 10 {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	if n, err := w.Write([]byte{0}); err != ErrTooLong || n != 0 {
+		t.Fatalf("wrote %d past the end, %v", n, err)
+	}
+}
+
+func TestWrapKey(t *testing.T) {
+	applicationKey, dataKey := testKey(t), testKey(t)
+	wrapped, err := WrapKey(applicationKey, dataKey, []byte("1_2_blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unwrapped, err := UnwrapKey(applicationKey, wrapped, []byte("1_2_blob")); err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Fatalf("unwrap returned %v", err)
+	}
+	if _, err := UnwrapKey(applicationKey, wrapped, []byte("1_2_other")); err != ErrCorrupt {
+		t.Errorf("key of another blob unwrapped: %v", err)
+	}
+	if _, err := UnwrapKey(testKey(t), wrapped, []byte("1_2_blob")); err != ErrCorrupt {
+		t.Errorf("key unwrapped with another application key: %v", err)
+	}
+	if _, err := UnwrapKey(applicationKey, wrapped[:5], []byte("1_2_blob")); err != ErrCorrupt {
+		t.Errorf("short wrapped key: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package blobcrypt
+
+import (
+	"data"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ * The keyring file holds the key of every application that may store
+ * data, 32 bytes in hex, with an id of the key:
+ *
+ *	{ "applications" : { "1" : { "key_id" : "2026-10", "key" : "<hex>" } } }
+ *
+ * A blob remembers the id of the key its data key was wrapped with. Once
+ * the entry of its application is removed or has another id, the blob can
+ * no longer be read. The file is read again whenever it changes; a file
+ * that can't be read leaves the keys as they were.
+ */
+type KeyringEntry struct {
+	KeyId string `json:"key_id"`
+	Key   string `json:"key"`
+}
+
+type keyringFile struct {
+	Applications map[int]KeyringEntry `json:"applications"`
+}
+
+type applicationKey struct {
+	id  string
+	key []byte
+}
+
+type Keyring struct {
+	filename string
+	mutex    sync.Mutex
+	modified time.Time
+	size     int64
+	keys     map[int]applicationKey
+}
+
+func readKeyring(filename string) (map[int]applicationKey, error) {
+	var file keyringFile
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	keys := make(map[int]applicationKey)
+	for applicationId, entry := range file.Applications {
+		key, err := hex.DecodeString(entry.Key)
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("the key of application %d is not %d bytes in hex", applicationId, KeySize)
+		}
+		if entry.KeyId == "" {
+			return nil, fmt.Errorf("the key of application %d has no key_id", applicationId)
+		}
+		keys[applicationId] = applicationKey{id: entry.KeyId, key: key}
+	}
+	return keys, nil
+}
+
+func OpenKeyring(filename string) (*Keyring, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := readKeyring(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{filename: filename, modified: info.ModTime(), size: info.Size(), keys: keys}, nil
+}
+
+/*
+ * Key returns the id and the key of an application, false if it has none.
+ */
+func (k *Keyring) Key(applicationId int) (bool, string, []byte) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if info, err := os.Stat(k.filename); err == nil && (!info.ModTime().Equal(k.modified) || info.Size() != k.size) {
+		k.modified = info.ModTime()
+		k.size = info.Size()
+		if keys, err := readKeyring(k.filename); err == nil {
+			k.keys = keys
+			data.Logger.Printf("BLOBCRYPT: keyring %s read again", k.filename)
+		} else {
+			data.Logger.Printf("BLOBCRYPT: keyring %s not read again: %s", k.filename, err)
+		}
+	}
+	key, found := k.keys[applicationId]
+	return found, key.id, key.key
+}
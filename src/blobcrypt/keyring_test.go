@@ -0,0 +1,117 @@
+package blobcrypt
+
+import (
+	"bytes"
+	"data"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	if data.Logger == nil {
+		data.Logger = log.New(ioutil.Discard, "", 0)
+	}
+}
+
+/*
+ * writeKeyring writes the keyring with the given modification time, so a
+ * rewrite within the same second is noticed too.
+ */
+func writeKeyring(t *testing.T, filename string, content string, modified time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filename, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func keyringEntry(applicationId int, keyId string, key []byte) string {
+	return fmt.Sprintf(`{ "applications" : { "%d" : { "key_id" : "%s", "key" : "%s" } } }`, applicationId, keyId, hex.EncodeToString(key))
+}
+
+func TestOpenKeyringRefusesBadFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"garbage":    "garbage",
+		"short key":  `{ "applications" : { "1" : { "key_id" : "a", "key" : "abcd" } } }`,
+		"no key id":  keyringEntry(1, "", make([]byte, KeySize)),
+		"not in hex": `{ "applications" : { "1" : { "key_id" : "a", "key" : "` + string(bytes.Repeat([]byte("zz"), KeySize)) + `" } } }`,
+	} {
+		filename := filepath.Join(dir, "keyring.json")
+		writeKeyring(t, filename, content, time.Now())
+		if _, err := OpenKeyring(filename); err == nil {
+			t.Errorf("%s: keyring opened", name)
+		}
+	}
+	if _, err := OpenKeyring(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing keyring opened")
+	}
+}
+
+/*
+ * A blob's data key is wrapped with the application key of the moment;
+ * once the keyring has another key or none for the application, the blob
+ * can no longer be read.
+ */
+func TestKeyringRotationShredsBlobs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "keyring.json")
+	oldKey := testKey(t)
+	start := time.Now().Add(-time.Hour)
+	writeKeyring(t, filename, keyringEntry(1, "2026-01", oldKey), start)
+	keyring, err := OpenKeyring(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasKey, keyId, applicationKey := keyring.Key(1)
+	if !hasKey || keyId != "2026-01" || !bytes.Equal(applicationKey, oldKey) {
+		t.Fatalf("key of application 1 is %v, %q", hasKey, keyId)
+	}
+	if hasKey, _, _ := keyring.Key(2); hasKey {
+		t.Fatal("application 2 has a key")
+	}
+
+	dataKey := testKey(t)
+	plain := testPlaintext(t, ChunkSize+1)
+	ciphertext := encrypt(t, dataKey, plain)
+	wrapped, err := WrapKey(applicationKey, dataKey, []byte("1_2_blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An unreadable file leaves the keys as they were.
+	writeKeyring(t, filename, "garbage", start.Add(time.Minute))
+	if hasKey, keyId, _ := keyring.Key(1); !hasKey || keyId != "2026-01" {
+		t.Fatalf("unreadable keyring changed the key to %v, %q", hasKey, keyId)
+	}
+
+	writeKeyring(t, filename, keyringEntry(1, "2026-02", testKey(t)), start.Add(2*time.Minute))
+	hasKey, keyId, applicationKey = keyring.Key(1)
+	if !hasKey || keyId != "2026-02" {
+		t.Fatalf("rotated key not read: %v, %q", hasKey, keyId)
+	}
+	if _, err := UnwrapKey(applicationKey, wrapped, []byte("1_2_blob")); err != ErrCorrupt {
+		t.Fatalf("data key unwrapped with the rotated key: %v", err)
+	}
+
+	writeKeyring(t, filename, `{ "applications" : {} }`, start.Add(3*time.Minute))
+	if hasKey, _, _ := keyring.Key(1); hasKey {
+		t.Fatal("removed key still found")
+	}
+
+	// Only the old key, gone from the keyring, still reads the blob.
+	unwrapped, err := UnwrapKey(oldKey, wrapped, []byte("1_2_blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decrypt(unwrapped, ciphertext, 0, int64(len(plain)), int64(len(plain))); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("blob not readable with the old key: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Blobstore : Where the storage server keeps its data.
+
+A BlobStore keeps blobs under keys. Putting a blob is atomic: readers see
+either the previous blob or the complete new one, and a Put whose reader
+fails stores nothing. There are three stores, chosen by the "type" of the
+configuration:
+
+	local              files in sharded directories below "path"
+	s3                 objects in an S3-compatible bucket, e.g. MinIO
+	content-addressed  files below "path" named by their SHA-256, so equal
+	                   blobs are stored once whatever their keys
+*/
+package blobstore
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	TypeLocal            = "local"
+	TypeS3               = "s3"
+	TypeContentAddressed = "content-addressed"
+)
+
+const (
+	defaultShardDepth = 2
+	maxShardDepth     = 8
+)
+
+var ErrNotFound = errors.New("blob not found")
+var ErrInvalidKey = errors.New("invalid blob key")
+
+type BlobStoreConfig struct {
+	Type       string   `json:"type"`
+	Path       string   `json:"path"`
+	ShardDepth int      `json:"shard_depth"`
+	S3         S3Config `json:"s3"`
+}
+
+type BlobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+type BlobStore interface {
+	/*
+	 * Put stores everything read from data under key, replacing the blob
+	 * that was there, and returns its size.
+	 */
+	Put(key string, data io.Reader) (int64, error)
+	/*
+	 * Get returns the blob for reading; the caller has to close it.
+	 */
+	Get(key string) (io.ReadCloser, BlobInfo, error)
+	/*
+	 * GetRange returns length bytes of the blob starting at offset, which
+	 * have to lie within the blob; the caller has to close them.
+	 */
+	GetRange(key string, offset int64, length int64) (io.ReadCloser, error)
+	Stat(key string) (BlobInfo, error)
+	Delete(key string) error
+}
+
+/*
+ * New creates the configured store; without a type it is a local one.
+ * stagingPath is where the S3 store spools uploads before sending them.
+ */
+func New(config BlobStoreConfig, stagingPath string) (BlobStore, error) {
+	switch config.Type {
+	case "", TypeLocal:
+		return newLocalStore(config)
+	case TypeContentAddressed:
+		return newContentAddressedStore(config)
+	case TypeS3:
+		return newS3Store(config.S3, stagingPath)
+	}
+	return nil, fmt.Errorf("unknown blob store type %q", config.Type)
+}
+
+/*
+ * Keys are used as file and object names, so they are restricted to
+ * letters, digits, "_", "-" and "." and must not start with a ".".
+ */
+func validKey(key string) bool {
+	if key == "" || len(key) > 200 || key[0] == '.' {
+		return false
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func shardDepth(config BlobStoreConfig) int {
+	if config.ShardDepth > 0 && config.ShardDepth <= maxShardDepth {
+		return config.ShardDepth
+	}
+	return defaultShardDepth
+}
+
+/*
+ * shards spreads names over directories by their hash, two hex digits per
+ * level: "ab/cd" for a depth of 2.
+ */
+func shards(name string, depth int) []string {
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))
+	parts := make([]string, depth)
+	for i := range parts {
+		parts[i] = digest[2*i : 2*i+2]
+	}
+	return parts
+}
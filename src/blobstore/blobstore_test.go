@@ -0,0 +1,126 @@
+package blobstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+/*
+ * failingReader returns its data and then fails, like a client that went
+ * away in the middle of an upload.
+ */
+type failingReader struct {
+	data io.Reader
+}
+
+var errReadFailed = errors.New("read failed")
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errReadFailed
+	}
+	return n, err
+}
+
+func readBlob(t *testing.T, store BlobStore, key string) []byte {
+	t.Helper()
+	blob, info, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("get %s: %s", key, err)
+	}
+	defer blob.Close()
+	content, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("read %s: %s", key, err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Fatalf("%s has size %d, read %d bytes", key, info.Size, len(content))
+	}
+	return content
+}
+
+/*
+ * testStore runs the checks every store has to pass.
+ */
+func testStore(t *testing.T, store BlobStore) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	size, err := store.Put("1_2_blob", bytes.NewReader(content))
+	if err != nil || size != int64(len(content)) {
+		t.Fatalf("put returned %d, %v", size, err)
+	}
+	if got := readBlob(t, store, "1_2_blob"); !bytes.Equal(got, content) {
+		t.Fatal("blob read back differs")
+	}
+	if info, err := store.Stat("1_2_blob"); err != nil || info.Size != int64(len(content)) {
+		t.Fatalf("stat returned %+v, %v", info, err)
+	}
+
+	part, err := store.GetRange("1_2_blob", 15, 10)
+	if err != nil {
+		t.Fatalf("get range: %s", err)
+	}
+	got, _ := ioutil.ReadAll(part)
+	part.Close()
+	if string(got) != "5678901234" {
+		t.Fatalf("range read %q", got)
+	}
+
+	replacement := []byte("replaced")
+	if _, err := store.Put("1_2_blob", bytes.NewReader(replacement)); err != nil {
+		t.Fatalf("replacing put: %s", err)
+	}
+	if got := readBlob(t, store, "1_2_blob"); !bytes.Equal(got, replacement) {
+		t.Fatalf("replaced blob reads %q", got)
+	}
+
+	if _, err := store.Put("1_2_blob", &failingReader{data: bytes.NewReader(content)}); err == nil {
+		t.Fatal("put with a failing reader succeeded")
+	}
+	if got := readBlob(t, store, "1_2_blob"); !bytes.Equal(got, replacement) {
+		t.Fatal("failed put changed the blob")
+	}
+	if _, err := store.Put("1_2_other", &failingReader{data: bytes.NewReader(content)}); err == nil {
+		t.Fatal("put with a failing reader succeeded")
+	}
+	if _, err := store.Stat("1_2_other"); err != ErrNotFound {
+		t.Fatalf("failed put stored a blob: %v", err)
+	}
+
+	if err := store.Delete("1_2_blob"); err != nil {
+		t.Fatalf("delete: %s", err)
+	}
+	if _, _, err := store.Get("1_2_blob"); err != ErrNotFound {
+		t.Fatalf("get of a deleted blob returned %v", err)
+	}
+	if err := store.Delete("1_2_blob"); err != ErrNotFound {
+		t.Fatalf("second delete returned %v", err)
+	}
+
+	for _, key := range []string{"", ".hidden", "../escape", "a/b"} {
+		if _, err := store.Put(key, bytes.NewReader(content)); err != ErrInvalidKey {
+			t.Errorf("put with key %q returned %v", key, err)
+		}
+	}
+}
+
+func TestNewUnknownType(t *testing.T) {
+	if _, err := New(BlobStoreConfig{Type: "tape"}, t.TempDir()); err == nil {
+		t.Fatal("unknown store type accepted")
+	}
+}
+
+func TestShards(t *testing.T) {
+	parts := shards("1_2_blob", 3)
+	if len(parts) != 3 {
+		t.Fatalf("got %d shards", len(parts))
+	}
+	for _, part := range parts {
+		if len(part) != 2 {
+			t.Fatalf("shard %q is not two hex digits", part)
+		}
+	}
+}
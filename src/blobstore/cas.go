@@ -0,0 +1,202 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+ * ContentAddressedStore keeps each distinct blob once, in objects/ under
+ * its SHA-256; a key is a symbolic link in refs/ to its object. Every object
+ * has a directory next to it with an empty file for each key that refers to
+ * it, and is removed together with its last key.
+ *
+ *	objects/3f/a0/3fa0...          the blob
+ *	objects/3f/a0/3fa0....keys/k   k refers to it
+ *	refs/<shards of k>/k           link to objects/3f/a0/3fa0...
+ */
+type ContentAddressedStore struct {
+	root  string
+	depth int
+	mutex sync.Mutex
+}
+
+func newContentAddressedStore(config BlobStoreConfig) (*ContentAddressedStore, error) {
+	if config.Path == "" {
+		return nil, errors.New("the content-addressed blob store needs a path")
+	}
+	for _, dir := range []string{"objects", "refs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(config.Path, dir), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &ContentAddressedStore{root: config.Path, depth: shardDepth(config)}, nil
+}
+
+func (s *ContentAddressedStore) objectPath(digest string) string {
+	parts := []string{s.root, "objects"}
+	for i := 0; i < s.depth; i++ {
+		parts = append(parts, digest[2*i:2*i+2])
+	}
+	return filepath.Join(append(parts, digest)...)
+}
+
+func (s *ContentAddressedStore) refPath(key string) string {
+	return filepath.Join(append(append([]string{s.root, "refs"}, shards(key, s.depth)...), key)...)
+}
+
+/*
+ * objectOf returns the object the key refers to, "" if it has none.
+ */
+func (s *ContentAddressedStore) objectOf(key string) string {
+	ref := s.refPath(key)
+	target, err := os.Readlink(ref)
+	if err != nil {
+		return ""
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(ref), target)
+	}
+	return target
+}
+
+/*
+ * release drops the key's claim on the object and removes the object if no
+ * other key refers to it: its directory of keys can only be removed once
+ * it is empty.
+ */
+func (s *ContentAddressedStore) release(object string, key string) {
+	os.Remove(filepath.Join(object+".keys", key))
+	if os.Remove(object+".keys") == nil {
+		os.Remove(object)
+	}
+}
+
+func (s *ContentAddressedStore) Put(key string, data io.Reader) (int64, error) {
+	if !validKey(key) {
+		return 0, ErrInvalidKey
+	}
+	f, err := ioutil.TempFile(filepath.Join(s.root, "tmp"), "put-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	object := s.objectPath(fmt.Sprintf("%x", hash.Sum(nil)))
+	ref := s.refPath(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := os.Stat(object); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(object), 0700); err != nil {
+			return 0, err
+		}
+		if err := os.Rename(f.Name(), object); err != nil {
+			return 0, err
+		}
+	} else if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(object+".keys", 0700); err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(object+".keys", key), nil, 0600); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(ref), 0700); err != nil {
+		return 0, err
+	}
+	target, err := filepath.Rel(filepath.Dir(ref), object)
+	if err != nil {
+		return 0, err
+	}
+	// The link is made in tmp/ and renamed over the old one, so the key
+	// always refers to a complete object.
+	link := f.Name() + ".link"
+	if err := os.Symlink(target, link); err != nil {
+		return 0, err
+	}
+	previous := s.objectOf(key)
+	if err := os.Rename(link, ref); err != nil {
+		os.Remove(link)
+		return 0, err
+	}
+	if previous != "" && previous != object {
+		s.release(previous, key)
+	}
+	return size, nil
+}
+
+/*
+ * The modification time of a blob is that of its key, not of the object
+ * it shares with others.
+ */
+func (s *ContentAddressedStore) Get(key string) (io.ReadCloser, BlobInfo, error) {
+	if !validKey(key) {
+		return nil, BlobInfo{}, ErrInvalidKey
+	}
+	blob, info, err := openBlob(s.refPath(key))
+	if err == nil {
+		if linkInfo, err := os.Lstat(s.refPath(key)); err == nil {
+			info.ModTime = linkInfo.ModTime()
+		}
+	}
+	return blob, info, err
+}
+
+func (s *ContentAddressedStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+	return openBlobRange(s.refPath(key), offset, length)
+}
+
+func (s *ContentAddressedStore) Stat(key string) (BlobInfo, error) {
+	if !validKey(key) {
+		return BlobInfo{}, ErrInvalidKey
+	}
+	fileInfo, err := os.Stat(s.refPath(key))
+	if os.IsNotExist(err) {
+		return BlobInfo{}, ErrNotFound
+	} else if err != nil {
+		return BlobInfo{}, err
+	}
+	info := BlobInfo{Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}
+	if linkInfo, err := os.Lstat(s.refPath(key)); err == nil {
+		info.ModTime = linkInfo.ModTime()
+	}
+	return info, nil
+}
+
+func (s *ContentAddressedStore) Delete(key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	object := s.objectOf(key)
+	if object == "" {
+		return ErrNotFound
+	}
+	if err := os.Remove(s.refPath(key)); err != nil {
+		return err
+	}
+	s.release(object, key)
+	return nil
+}
@@ -0,0 +1,98 @@
+package blobstore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestContentAddressedStore(t *testing.T) *ContentAddressedStore {
+	t.Helper()
+	store, err := New(BlobStoreConfig{Type: TypeContentAddressed, Path: t.TempDir()}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.(*ContentAddressedStore)
+}
+
+/*
+ * objects returns the blobs kept in objects/, without their directories of
+ * keys.
+ */
+func objects(t *testing.T, store *ContentAddressedStore) []string {
+	t.Helper()
+	var found []string
+	filepath.Walk(filepath.Join(store.root, "objects"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && !strings.Contains(path, ".keys") {
+			found = append(found, path)
+		}
+		return nil
+	})
+	return found
+}
+
+func TestContentAddressedStore(t *testing.T) {
+	store := newTestContentAddressedStore(t)
+	testStore(t, store)
+	if found := objects(t, store); len(found) != 0 {
+		t.Fatalf("objects left behind: %v", found)
+	}
+	if spooled, _ := ioutil.ReadDir(filepath.Join(store.root, "tmp")); len(spooled) != 0 {
+		t.Fatalf("%d temporary files left behind", len(spooled))
+	}
+}
+
+func TestContentAddressedStoreSharesObjects(t *testing.T) {
+	store := newTestContentAddressedStore(t)
+	for _, key := range []string{"1_2_first", "1_2_second"} {
+		if _, err := store.Put(key, strings.NewReader("same content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found := objects(t, store)
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("same content")))
+	if len(found) != 1 || filepath.Base(found[0]) != digest {
+		t.Fatalf("objects are %v, want one named %s", found, digest)
+	}
+
+	if err := store.Delete("1_2_first"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readBlob(t, store, "1_2_second"); string(got) != "same content" {
+		t.Fatalf("remaining key reads %q", got)
+	}
+	if _, _, err := store.Get("1_2_first"); err != ErrNotFound {
+		t.Fatalf("deleted key returned %v", err)
+	}
+
+	if err := store.Delete("1_2_second"); err != nil {
+		t.Fatal(err)
+	}
+	if found := objects(t, store); len(found) != 0 {
+		t.Fatalf("object kept after its last key was deleted: %v", found)
+	}
+}
+
+func TestContentAddressedStoreReplaceReleasesObject(t *testing.T) {
+	store := newTestContentAddressedStore(t)
+	store.Put("1_2_first", strings.NewReader("old content"))
+	store.Put("1_2_second", strings.NewReader("old content"))
+	store.Put("1_2_first", strings.NewReader("new content"))
+	if len(objects(t, store)) != 2 {
+		t.Fatal("old object dropped while another key refers to it")
+	}
+	store.Put("1_2_second", strings.NewReader("new content"))
+	found := objects(t, store)
+	if len(found) != 1 || filepath.Base(found[0]) != fmt.Sprintf("%x", sha256.Sum256([]byte("new content"))) {
+		t.Fatalf("objects are %v, want only the new one", found)
+	}
+	for _, key := range []string{"1_2_first", "1_2_second"} {
+		if got := readBlob(t, store, key); string(got) != "new content" {
+			t.Fatalf("%s reads %q", key, got)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package blobstore
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+ * LocalStore keeps every blob in a file of its own, spread over sharded
+ * directories so none of them grows too large. Blobs are written to a
+ * temporary file next to their final place and renamed when complete.
+ */
+type LocalStore struct {
+	root  string
+	depth int
+}
+
+func newLocalStore(config BlobStoreConfig) (*LocalStore, error) {
+	if config.Path == "" {
+		return nil, errors.New("the local blob store needs a path")
+	}
+	if err := os.MkdirAll(config.Path, 0700); err != nil {
+		return nil, err
+	}
+	return &LocalStore{root: config.Path, depth: shardDepth(config)}, nil
+}
+
+func (s *LocalStore) path(key string) string {
+	return filepath.Join(append(append([]string{s.root}, shards(key, s.depth)...), key)...)
+}
+
+/*
+ * writeAtomically copies data to a temporary file in the directory of
+ * filename, syncs it and renames it to filename.
+ */
+func writeAtomically(filename string, data io.Reader) (int64, error) {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	f, err := ioutil.TempFile(dir, ".put-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	size, err := io.Copy(f, data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, os.Rename(f.Name(), filename)
+}
+
+func (s *LocalStore) Put(key string, data io.Reader) (int64, error) {
+	if !validKey(key) {
+		return 0, ErrInvalidKey
+	}
+	return writeAtomically(s.path(key), data)
+}
+
+func openBlob(filename string) (io.ReadCloser, BlobInfo, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, BlobInfo{}, ErrNotFound
+	} else if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	fileInfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, BlobInfo{}, err
+	}
+	return f, BlobInfo{Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}, nil
+}
+
+func (s *LocalStore) Get(key string) (io.ReadCloser, BlobInfo, error) {
+	if !validKey(key) {
+		return nil, BlobInfo{}, ErrInvalidKey
+	}
+	return openBlob(s.path(key))
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func openBlobRange(filename string, offset int64, length int64) (io.ReadCloser, error) {
+	blob, _, err := openBlob(filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := blob.(*os.File).Seek(offset, io.SeekStart); err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return readCloser{io.LimitReader(blob, length), blob}, nil
+}
+
+func (s *LocalStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+	return openBlobRange(s.path(key), offset, length)
+}
+
+func (s *LocalStore) Stat(key string) (BlobInfo, error) {
+	if !validKey(key) {
+		return BlobInfo{}, ErrInvalidKey
+	}
+	fileInfo, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return BlobInfo{}, ErrNotFound
+	} else if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Size: fileInfo.Size(), ModTime: fileInfo.ModTime()}, nil
+}
+
+func (s *LocalStore) Delete(key string) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
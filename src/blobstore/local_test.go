@@ -0,0 +1,87 @@
+package blobstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestLocalStore(t *testing.T) *LocalStore {
+	t.Helper()
+	store, err := New(BlobStoreConfig{Type: TypeLocal, Path: t.TempDir()}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.(*LocalStore)
+}
+
+/*
+ * leftovers returns the temporary files of puts found below root.
+ */
+func leftovers(t *testing.T, root string) []string {
+	t.Helper()
+	var found []string
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(info.Name(), ".put-") {
+			found = append(found, path)
+		}
+		return nil
+	})
+	return found
+}
+
+func TestLocalStore(t *testing.T) {
+	store := newTestLocalStore(t)
+	testStore(t, store)
+	if found := leftovers(t, store.root); len(found) != 0 {
+		t.Fatalf("temporary files left behind: %v", found)
+	}
+}
+
+func TestLocalStoreShardsFiles(t *testing.T) {
+	store := newTestLocalStore(t)
+	if _, err := store.Put("1_2_blob", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	expected := filepath.Join(append(append([]string{store.root}, shards("1_2_blob", defaultShardDepth)...), "1_2_blob")...)
+	if _, err := os.Stat(expected); err != nil {
+		t.Fatalf("blob not stored at %s: %s", expected, err)
+	}
+}
+
+/*
+ * While a put is in progress the old blob stays readable; the new data is
+ * only in a temporary file, which is gone once the put failed.
+ */
+func TestLocalStorePutIsAtomic(t *testing.T) {
+	store := newTestLocalStore(t)
+	if _, err := store.Put("1_2_blob", strings.NewReader("old")); err != nil {
+		t.Fatal(err)
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := store.Put("1_2_blob", &failingReader{data: reader})
+		done <- err
+	}()
+	writer.Write(bytes.Repeat([]byte("new"), 1000))
+	if got := readBlob(t, store, "1_2_blob"); string(got) != "old" {
+		t.Fatalf("blob reads %q while a put is in progress", got)
+	}
+	writer.Close()
+	if err := <-done; err == nil {
+		t.Fatal("put with a failing reader succeeded")
+	}
+	reader.Close()
+	if got := readBlob(t, store, "1_2_blob"); string(got) != "old" {
+		t.Fatalf("blob reads %q after a failed put", got)
+	}
+	if found := leftovers(t, store.root); len(found) != 0 {
+		t.Fatalf("temporary files left behind: %v", found)
+	}
+}
@@ -0,0 +1,302 @@
+package blobstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"outbound"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+	s3Target        = "blobstore"
+	emptyPayloadSHA = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+/*
+ * Objects are addressed path-style (endpoint/bucket/key), which MinIO and
+ * most other S3-compatible servers expect, unless virtual_host_style is set
+ * (bucket.endpoint/key), as for AWS itself. Requests go through the
+ * outbound target "blobstore", whose timeout has to allow for the largest
+ * blobs.
+ */
+type S3Config struct {
+	Endpoint         string `json:"endpoint"`
+	Region           string `json:"region"`
+	Bucket           string `json:"bucket"`
+	Prefix           string `json:"prefix"`
+	AccessKey        string `json:"access_key"`
+	SecretKey        string `json:"secret_key"`
+	VirtualHostStyle bool   `json:"virtual_host_style"`
+}
+
+/*
+ * S3Store keeps blobs as objects of a bucket. As S3 needs the length and
+ * hash of an object before it is sent, a blob is spooled to a file in the
+ * staging path first; a PUT of an object is atomic.
+ */
+type S3Store struct {
+	config      S3Config
+	endpoint    *url.URL
+	stagingPath string
+}
+
+func newS3Store(config S3Config, stagingPath string) (*S3Store, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+	if config.Bucket == "" || config.AccessKey == "" || config.SecretKey == "" {
+		return nil, errors.New("the S3 blob store needs a bucket, access_key and secret_key")
+	}
+	if config.Region == "" {
+		config.Region = defaultS3Region
+	}
+	if err := os.MkdirAll(stagingPath, 0700); err != nil {
+		return nil, err
+	}
+	return &S3Store{config: config, endpoint: endpoint, stagingPath: stagingPath}, nil
+}
+
+func (s *S3Store) objectURL(key string) *url.URL {
+	objectURL := *s.endpoint
+	objectPath := strings.TrimSuffix(objectURL.Path, "/")
+	if s.config.VirtualHostStyle {
+		objectURL.Host = s.config.Bucket + "." + objectURL.Host
+	} else {
+		objectPath += "/" + s.config.Bucket
+	}
+	objectURL.Path = objectPath + "/" + s.config.Prefix + key
+	objectURL.RawPath = uriEncode(objectURL.Path, false)
+	return &objectURL
+}
+
+/*
+ * uriEncode encodes as SigV4 wants it: everything but unreserved
+ * characters, and "/" unless encodeSlash is set.
+ */
+func uriEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, c := range []byte(value) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			encoded.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			encoded.WriteByte(c)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return encoded.String()
+}
+
+func hmacSHA256(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+/*
+ * sign adds an AWS Signature Version 4 to the request. payloadSHA is the
+ * hex SHA-256 of the body.
+ */
+func (s *S3Store) sign(req *http.Request, payloadSHA string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadSHA)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadSHA + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		payloadSHA,
+	}, "\n")
+	scope := day + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest))),
+	}, "\n")
+	signingKey := hmacSHA256([]byte("AWS4"+s.config.SecretKey), day)
+	signingKey = hmacSHA256(signingKey, s.config.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := fmt.Sprintf("%x", hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+func (s *S3Store) request(method string, key string) (*http.Request, error) {
+	req, err := http.NewRequest(method, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = s.objectURL(key)
+	req.Host = req.URL.Host
+	return req, nil
+}
+
+func s3Error(method string, key string, res *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("S3 %s %s: %s %s", method, key, res.Status, strings.TrimSpace(string(body)))
+}
+
+func (s *S3Store) Put(key string, data io.Reader) (int64, error) {
+	if !validKey(key) {
+		return 0, ErrInvalidKey
+	}
+	spool, err := ioutil.TempFile(s.stagingPath, ".s3-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), data)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	req, err := s.request("PUT", key)
+	if err != nil {
+		return 0, err
+	}
+	req.Body = spool
+	req.ContentLength = size
+	req.GetBody = func() (io.ReadCloser, error) {
+		return os.Open(spool.Name())
+	}
+	s.sign(req, fmt.Sprintf("%x", hash.Sum(nil)), time.Now())
+	res, err := outbound.Do(s3Target, req, true)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, s3Error("PUT", key, res)
+	}
+	return size, nil
+}
+
+func blobInfoFromHeaders(res *http.Response) BlobInfo {
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return BlobInfo{Size: res.ContentLength, ModTime: modTime}
+}
+
+func (s *S3Store) Get(key string) (io.ReadCloser, BlobInfo, error) {
+	if !validKey(key) {
+		return nil, BlobInfo{}, ErrInvalidKey
+	}
+	req, err := s.request("GET", key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	s.sign(req, emptyPayloadSHA, time.Now())
+	res, err := outbound.Do(s3Target, req, true)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, blobInfoFromHeaders(res), nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, BlobInfo{}, ErrNotFound
+	}
+	defer res.Body.Close()
+	return nil, BlobInfo{}, s3Error("GET", key, res)
+}
+
+/*
+ * The Range header is not signed, which S3 allows.
+ */
+func (s *S3Store) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	if !validKey(key) {
+		return nil, ErrInvalidKey
+	}
+	req, err := s.request("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	s.sign(req, emptyPayloadSHA, time.Now())
+	res, err := outbound.Do(s3Target, req, true)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.StatusCode == http.StatusPartialContent:
+		return res.Body, nil
+	case res.StatusCode == http.StatusOK && offset == 0:
+		// The whole object, which holds the range at its start.
+		return readCloser{io.LimitReader(res.Body, length), res.Body}, nil
+	case res.StatusCode == http.StatusNotFound:
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	defer res.Body.Close()
+	return nil, s3Error("GET", key, res)
+}
+
+func (s *S3Store) Stat(key string) (BlobInfo, error) {
+	if !validKey(key) {
+		return BlobInfo{}, ErrInvalidKey
+	}
+	req, err := s.request("HEAD", key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	s.sign(req, emptyPayloadSHA, time.Now())
+	res, err := outbound.Do(s3Target, req, true)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return blobInfoFromHeaders(res), nil
+	case http.StatusNotFound:
+		return BlobInfo{}, ErrNotFound
+	}
+	return BlobInfo{}, s3Error("HEAD", key, res)
+}
+
+/*
+ * S3 answers a DELETE of a missing object with 204 as well, so Delete
+ * looks for the object first to report ErrNotFound.
+ */
+func (s *S3Store) Delete(key string) error {
+	if _, err := s.Stat(key); err != nil {
+		return err
+	}
+	req, err := s.request("DELETE", key)
+	if err != nil {
+		return err
+	}
+	s.sign(req, emptyPayloadSHA, time.Now())
+	res, err := outbound.Do(s3Target, req, true)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return s3Error("DELETE", key, res)
+	}
+	return nil
+}
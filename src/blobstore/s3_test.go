@@ -0,0 +1,216 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "test-access-key"
+	testSecretKey = "test-secret-key"
+	testRegion    = "eu-test-1"
+	testBucket    = "blobs"
+)
+
+/*
+ * fakeS3 is a bucket that only takes requests with a valid AWS Signature
+ * Version 4, which it checks on its own rather than with the code under
+ * test.
+ */
+type fakeS3 struct {
+	mutex    sync.Mutex
+	objects  map[string][]byte
+	modified map[string]time.Time
+	rejected []string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{objects: make(map[string][]byte), modified: make(map[string]time.Time)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func sha256Hex(data []byte) string {
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+func hmacOf(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+/*
+ * verify returns why the signature of a request is not valid, "" if it is.
+ */
+func (f *fakeS3) verify(req *http.Request, body []byte) string {
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 ") {
+		return "no SigV4 authorization"
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(authorization, "AWS4-HMAC-SHA256 "), ",") {
+		if parts := strings.SplitN(strings.TrimSpace(field), "=", 2); len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	amzDate := req.Header.Get("X-Amz-Date")
+	signedAt, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || time.Since(signedAt) > 15*time.Minute || time.Until(signedAt) > 15*time.Minute {
+		return "bad X-Amz-Date " + amzDate
+	}
+	scope := amzDate[:8] + "/" + testRegion + "/s3/aws4_request"
+	if fields["Credential"] != testAccessKey+"/"+scope {
+		return "bad credential " + fields["Credential"]
+	}
+	payloadSHA := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadSHA != sha256Hex(body) {
+		return "payload hash does not match the body"
+	}
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	var canonicalHeaders strings.Builder
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	for _, required := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !strings.Contains(";"+fields["SignedHeaders"]+";", ";"+required+";") {
+			return required + " is not signed"
+		}
+	}
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), fields["SignedHeaders"], payloadSHA}, "\n")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	key := hmacOf([]byte("AWS4"+testSecretKey), amzDate[:8])
+	key = hmacOf(key, testRegion)
+	key = hmacOf(key, "s3")
+	key = hmacOf(key, "aws4_request")
+	if !hmac.Equal([]byte(fields["Signature"]), []byte(hex.EncodeToString(hmacOf(key, stringToSign)))) {
+		return "signature does not match"
+	}
+	return ""
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if reason := f.verify(req, body); reason != "" {
+		f.mutex.Lock()
+		f.rejected = append(f.rejected, reason)
+		f.mutex.Unlock()
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, "/"+testBucket+"/") {
+		http.Error(w, "<Error><Code>NoSuchBucket</Code></Error>", http.StatusNotFound)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/"+testBucket+"/")
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	object, exists := f.objects[name]
+	switch req.Method {
+	case "PUT":
+		f.objects[name] = body
+		f.modified[name] = time.Now()
+	case "GET", "HEAD":
+		if !exists {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, req, "", f.modified[name], bytes.NewReader(object))
+	case "DELETE":
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestS3Store(t *testing.T, server *httptest.Server, secretKey string) *S3Store {
+	t.Helper()
+	config := S3Config{Endpoint: server.URL, Region: testRegion, Bucket: testBucket, Prefix: "ss/", AccessKey: testAccessKey, SecretKey: secretKey}
+	store, err := New(BlobStoreConfig{Type: TypeS3, S3: config}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.(*S3Store)
+}
+
+func TestS3Store(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3Store(t, server, testSecretKey)
+	testStore(t, store)
+	if len(fake.rejected) != 0 {
+		t.Fatalf("fake S3 rejected requests: %v", fake.rejected)
+	}
+	if spooled, _ := ioutil.ReadDir(store.stagingPath); len(spooled) != 0 {
+		t.Fatalf("%d spool files left behind", len(spooled))
+	}
+}
+
+func TestS3StoreUsesPrefix(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3Store(t, server, testSecretKey)
+	if _, err := store.Put("1_2_blob", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.objects["ss/1_2_blob"]) != "data" {
+		t.Fatalf("objects are %v", fake.objects)
+	}
+}
+
+func TestS3StoreWrongSecret(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3Store(t, server, "wrong-secret")
+	if _, err := store.Put("1_2_blob", strings.NewReader("data")); err == nil {
+		t.Fatal("put with a wrong secret succeeded")
+	}
+	if len(fake.rejected) != 1 || fake.rejected[0] != "signature does not match" {
+		t.Fatalf("fake S3 rejected %v", fake.rejected)
+	}
+	if len(fake.objects) != 0 {
+		t.Fatal("object stored without a valid signature")
+	}
+}
+
+func TestS3ObjectURL(t *testing.T) {
+	store := &S3Store{config: S3Config{Bucket: "bucket", Prefix: "p/"}}
+	store.endpoint, _ = url.Parse("https://s3.example.com/base/")
+	if got := store.objectURL("1_2_blob").String(); got != "https://s3.example.com/base/bucket/p/1_2_blob" {
+		t.Errorf("path-style URL is %s", got)
+	}
+	store.config.VirtualHostStyle = true
+	if got := store.objectURL("1_2_blob").String(); got != "https://bucket.s3.example.com/base/p/1_2_blob" {
+		t.Errorf("virtual-host-style URL is %s", got)
+	}
+}
+
+func TestS3InvalidConfig(t *testing.T) {
+	for _, config := range []S3Config{
+		{Endpoint: "s3.example.com", Bucket: "b", AccessKey: "a", SecretKey: "s"},
+		{Endpoint: "https://s3.example.com", AccessKey: "a", SecretKey: "s"},
+		{Endpoint: "https://s3.example.com", Bucket: "b"},
+	} {
+		if _, err := newS3Store(config, t.TempDir()); err == nil {
+			t.Errorf("config %+v accepted", config)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+/*
+Cluster : Replicates the service registry between the SD servers of a cluster.
+
+Membership is static: every SD lists the other members in its configuration.
+The members elect a leader the way Raft does, with terms, randomized
+election timeouts and one vote per term for a candidate that is at least as
+up to date as the voter. Only the leader changes the registry; the other
+members forward registrations, renewals and deregistrations to it and
+answer reads from their own copy.
+
+Instead of shipping a log of single changes the leader sends its whole
+registry state, leases included, to every member that does not have its
+latest revision, and an empty heartbeat to the others. A change counts as
+committed once a majority of the members has it. Terms and votes are kept
+in memory only; the registry is soft state that services renew anyway, so
+after a restart of the whole cluster they simply register again.
+
+Calls between members use the timeout of the outbound target "cluster" but
+not its circuit breakers: heartbeats already retry every interval, and a
+member that comes back has to be reached right away. Members only accept
+votes, appends and forwarded requests that carry the cluster's secret, so
+a cluster can't run without one.
+*/
+package cluster
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"data"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"outbound"
+	"registry"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHeartbeatInterval = 500
+	defaultElectionTimeout   = 2000
+	defaultCommitTimeout     = 2000
+	peerTarget               = "cluster"
+	forwardedHeader          = "X-SD-Forwarded"
+	secretHeader             = "X-SD-Cluster-Secret"
+	exampleSecret            = "change-me"
+)
+
+const (
+	RoleFollower  = "follower"
+	RoleCandidate = "candidate"
+	RoleLeader    = "leader"
+)
+
+/*
+ * Members are given as host:port, like the listen address of each SD; times
+ * in milliseconds. Zero values fall back to the defaults above.
+ */
+type ClusterConfig struct {
+	Peers             []string `json:"peers"`
+	HeartbeatInterval int      `json:"heartbeat_interval"`
+	ElectionTimeout   int      `json:"election_timeout"`
+	CommitTimeout     int      `json:"commit_timeout"`
+	Secret            string   `json:"secret"`
+}
+
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	StateTerm uint64 `json:"state_term"`
+	Revision  uint64 `json:"revision"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+/*
+ * An append request without a state is a heartbeat.
+ */
+type AppendRequest struct {
+	Term      uint64          `json:"term"`
+	Leader    string          `json:"leader"`
+	StateTerm uint64          `json:"state_term"`
+	State     *registry.State `json:"state,omitempty"`
+}
+
+type AppendResponse struct {
+	Term      uint64 `json:"term"`
+	Success   bool   `json:"success"`
+	StateTerm uint64 `json:"state_term"`
+	Revision  uint64 `json:"revision"`
+}
+
+type Status struct {
+	Id       string   `json:"id"`
+	Role     string   `json:"role"`
+	Term     uint64   `json:"term"`
+	Leader   string   `json:"leader"`
+	Revision uint64   `json:"revision"`
+	Version  uint64   `json:"version"`
+	Peers    []string `json:"peers"`
+}
+
+/*
+ * How far a member's registry is: the term of the leader that produced it
+ * and its revision.
+ */
+type position struct {
+	stateTerm uint64
+	revision  uint64
+}
+
+func (p position) atLeast(other position) bool {
+	return p.stateTerm > other.stateTerm || (p.stateTerm == other.stateTerm && p.revision >= other.revision)
+}
+
+type Node struct {
+	mutex            sync.Mutex
+	id               string
+	rootURL          string
+	config           ClusterConfig
+	registry         *registry.Registry
+	role             string
+	term             uint64
+	votedFor         string
+	leader           string
+	stateTerm        uint64
+	electionDeadline time.Time
+	matched          map[string]position
+	lastAck          map[string]time.Time
+	kicks            map[string]chan struct{}
+	acked            chan struct{}
+	client           *http.Client
+}
+
+func withDefault(value int, defaultValue int) time.Duration {
+	if value > 0 {
+		return time.Duration(value) * time.Millisecond
+	}
+	return time.Duration(defaultValue) * time.Millisecond
+}
+
+/*
+ * ValidSecret tells whether a secret may protect a cluster: it must be set
+ * and not the one the documentation used as an example.
+ */
+func ValidSecret(secret string) bool {
+	return secret != "" && secret != exampleSecret
+}
+
+/*
+ * New returns the cluster member with the given address (host:port); its
+ * peers are reached below rootURL, e.g. "/1.0". Start begins taking part
+ * in elections.
+ */
+func New(config ClusterConfig, id string, rootURL string, r *registry.Registry) *Node {
+	peers := make([]string, 0, len(config.Peers))
+	for _, peer := range config.Peers {
+		if peer != id {
+			peers = append(peers, peer)
+		}
+	}
+	config.Peers = peers
+	return &Node{
+		id:       id,
+		rootURL:  rootURL,
+		config:   config,
+		registry: r,
+		role:     RoleFollower,
+		matched:  make(map[string]position),
+		lastAck:  make(map[string]time.Time),
+		kicks:    make(map[string]chan struct{}),
+		acked:    make(chan struct{}),
+		client:   &http.Client{Timeout: outbound.Timeout(peerTarget)},
+	}
+}
+
+func (n *Node) heartbeatInterval() time.Duration {
+	return withDefault(n.config.HeartbeatInterval, defaultHeartbeatInterval)
+}
+
+func (n *Node) electionTimeout() time.Duration {
+	return withDefault(n.config.ElectionTimeout, defaultElectionTimeout)
+}
+
+func (n *Node) commitTimeout() time.Duration {
+	return withDefault(n.config.CommitTimeout, defaultCommitTimeout)
+}
+
+func (n *Node) majority() int {
+	return (len(n.config.Peers)+1)/2 + 1
+}
+
+/*
+ * The mutex must be held.
+ */
+func (n *Node) resetElectionDeadline() {
+	timeout := n.electionTimeout()
+	n.electionDeadline = time.Now().Add(timeout + time.Duration(rand.Int63n(int64(timeout))))
+}
+
+/*
+ * The mutex must be held.
+ */
+func (n *Node) position() position {
+	return position{stateTerm: n.stateTerm, revision: n.registry.Revision()}
+}
+
+/*
+ * Adopts a newer term seen in a message. The mutex must be held.
+ */
+func (n *Node) observeTerm(term uint64) {
+	if term > n.term {
+		if n.role == RoleLeader {
+			data.Logger.Printf("CLUSTER: stepping down, term %d is over", n.term)
+		}
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		n.role = RoleFollower
+	}
+}
+
+func (n *Node) Start() {
+	n.mutex.Lock()
+	n.resetElectionDeadline()
+	n.mutex.Unlock()
+	go n.run()
+}
+
+func (n *Node) run() {
+	for {
+		time.Sleep(n.heartbeatInterval() / 5)
+		n.mutex.Lock()
+		if n.role == RoleLeader {
+			n.checkQuorum()
+			n.mutex.Unlock()
+		} else if time.Now().After(n.electionDeadline) {
+			request := n.becomeCandidate()
+			n.mutex.Unlock()
+			n.campaign(request)
+		} else {
+			n.mutex.Unlock()
+		}
+	}
+}
+
+/*
+ * A leader that has not heard from a majority for an election timeout is
+ * probably cut off and steps down. The mutex must be held.
+ */
+func (n *Node) checkQuorum() {
+	reachable := 1
+	for _, peer := range n.config.Peers {
+		if time.Since(n.lastAck[peer]) < n.electionTimeout() {
+			reachable++
+		}
+	}
+	if reachable < n.majority() {
+		data.Logger.Printf("CLUSTER: lost contact to the majority, stepping down in term %d", n.term)
+		n.role = RoleFollower
+		n.leader = ""
+		n.resetElectionDeadline()
+	}
+}
+
+/*
+ * The mutex must be held.
+ */
+func (n *Node) becomeCandidate() VoteRequest {
+	n.term++
+	n.role = RoleCandidate
+	n.votedFor = n.id
+	n.leader = ""
+	n.resetElectionDeadline()
+	data.Logger.Printf("CLUSTER: %s asking for votes in term %d", n.id, n.term)
+	p := n.position()
+	return VoteRequest{Term: n.term, Candidate: n.id, StateTerm: p.stateTerm, Revision: p.revision}
+}
+
+func (n *Node) campaign(request VoteRequest) {
+	votes := make(chan bool, len(n.config.Peers))
+	for _, peer := range n.config.Peers {
+		go func(peer string) {
+			var response VoteResponse
+			if !n.call(peer, "/cluster/vote", request, &response) {
+				votes <- false
+				return
+			}
+			n.mutex.Lock()
+			n.observeTerm(response.Term)
+			n.mutex.Unlock()
+			votes <- response.Granted
+		}(peer)
+	}
+	granted := 1
+	for range n.config.Peers {
+		if <-votes {
+			granted++
+		}
+		if granted >= n.majority() {
+			break
+		}
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if granted >= n.majority() && n.role == RoleCandidate && n.term == request.Term {
+		n.becomeLeader()
+	}
+}
+
+/*
+ * The new leader's registry becomes the cluster's: it is tagged with the new
+ * term, so every follower gets sent a full copy. The mutex must be held.
+ */
+func (n *Node) becomeLeader() {
+	data.Logger.Printf("CLUSTER: %s is the leader in term %d", n.id, n.term)
+	n.role = RoleLeader
+	n.leader = n.id
+	n.stateTerm = n.term
+	now := time.Now()
+	for _, peer := range n.config.Peers {
+		n.matched[peer] = position{}
+		n.lastAck[peer] = now
+		n.kicks[peer] = make(chan struct{}, 1)
+		go n.replicateTo(peer, n.term, n.kicks[peer])
+	}
+}
+
+func (n *Node) isLeaderIn(term uint64) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.role == RoleLeader && n.term == term
+}
+
+func (n *Node) replicateTo(peer string, term uint64, kick chan struct{}) {
+	for n.isLeaderIn(term) {
+		n.sendAppend(peer, term)
+		select {
+		case <-kick:
+		case <-time.After(n.heartbeatInterval()):
+		}
+	}
+}
+
+func (n *Node) sendAppend(peer string, term uint64) {
+	var response AppendResponse
+
+	n.mutex.Lock()
+	request := AppendRequest{Term: term, Leader: n.id, StateTerm: n.stateTerm}
+	if n.matched[peer] != n.position() {
+		state := n.registry.Export()
+		request.State = &state
+	}
+	n.mutex.Unlock()
+	if !n.call(peer, "/cluster/append", request, &response) {
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.observeTerm(response.Term)
+	if n.role != RoleLeader || n.term != term {
+		return
+	}
+	n.lastAck[peer] = time.Now()
+	if response.Success {
+		n.matched[peer] = position{stateTerm: response.StateTerm, revision: response.Revision}
+		close(n.acked)
+		n.acked = make(chan struct{})
+	}
+}
+
+func (n *Node) call(peer string, path string, request interface{}, response interface{}) bool {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return false
+	}
+	req, err := http.NewRequest("POST", "http://"+peer+n.rootURL+path, bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(secretHeader, n.config.Secret)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(response) == nil
+}
+
+/*
+ * IsPeerRequest tells whether a request comes from another member. Without
+ * a secret no request is taken for one.
+ */
+func (n *Node) IsPeerRequest(req *http.Request) bool {
+	secret := req.Header.Get(secretHeader)
+	return n.config.Secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(n.config.Secret)) == 1
+}
+
+/*
+ * An append installs whatever registry it carries, so votes and appends are
+ * only taken from members; without a secret, from nobody.
+ */
+func (n *Node) peerAllowed(w http.ResponseWriter, req *http.Request) bool {
+	if n.IsPeerRequest(req) {
+		return true
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
+
+func (n *Node) IsLeader() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.role == RoleLeader
+}
+
+func (n *Node) Leader() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.leader
+}
+
+/*
+ * Commit sends the leader's latest changes to the other members right away
+ * and waits until a majority has them. It fails if that takes longer than
+ * the commit timeout or the member is not the leader (anymore).
+ */
+func (n *Node) Commit() bool {
+	deadline := time.NewTimer(n.commitTimeout())
+	defer deadline.Stop()
+
+	n.mutex.Lock()
+	term := n.term
+	target := n.position()
+	for _, kick := range n.kicks {
+		select {
+		case kick <- struct{}{}:
+		default:
+		}
+	}
+	for {
+		if n.role != RoleLeader || n.term != term {
+			n.mutex.Unlock()
+			return false
+		}
+		replicated := 1
+		for _, peer := range n.config.Peers {
+			if n.matched[peer].atLeast(target) {
+				replicated++
+			}
+		}
+		if replicated >= n.majority() {
+			n.mutex.Unlock()
+			return true
+		}
+		acked := n.acked
+		n.mutex.Unlock()
+		select {
+		case <-acked:
+		case <-deadline.C:
+			return false
+		}
+		n.mutex.Lock()
+	}
+}
+
+/*
+ * Forward hands a request that changes the registry to the leader and
+ * relays its answer. Without a known leader, or if the request was already
+ * forwarded once, it answers 503.
+ */
+func (n *Node) Forward(w http.ResponseWriter, req *http.Request) {
+	leader := n.Leader()
+	if leader == "" || leader == n.id || req.Header.Get(forwardedHeader) != "" {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: leader})
+	req.Header.Set(forwardedHeader, n.id)
+	req.Header.Set(secretHeader, n.config.Secret)
+	proxy.ServeHTTP(w, req)
+}
+
+func (n *Node) VoteHandler(w http.ResponseWriter, req *http.Request) {
+	var request VoteRequest
+	if !n.peerAllowed(w, req) {
+		return
+	}
+	if json.NewDecoder(req.Body).Decode(&request) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	n.mutex.Lock()
+	n.observeTerm(request.Term)
+	candidate := position{stateTerm: request.StateTerm, revision: request.Revision}
+	granted := request.Term == n.term && (n.votedFor == "" || n.votedFor == request.Candidate) && candidate.atLeast(n.position())
+	if granted {
+		n.votedFor = request.Candidate
+		n.resetElectionDeadline()
+	}
+	response := VoteResponse{Term: n.term, Granted: granted}
+	n.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (n *Node) AppendHandler(w http.ResponseWriter, req *http.Request) {
+	var request AppendRequest
+	if !n.peerAllowed(w, req) {
+		return
+	}
+	if json.NewDecoder(req.Body).Decode(&request) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	n.mutex.Lock()
+	n.observeTerm(request.Term)
+	success := request.Term == n.term
+	if success {
+		if n.role != RoleFollower || n.leader != request.Leader {
+			data.Logger.Printf("CLUSTER: following %s in term %d", request.Leader, request.Term)
+		}
+		n.role = RoleFollower
+		n.leader = request.Leader
+		n.resetElectionDeadline()
+		if request.State != nil {
+			n.registry.Import(*request.State)
+			n.stateTerm = request.StateTerm
+		}
+	}
+	p := n.position()
+	response := AppendResponse{Term: n.term, Success: success, StateTerm: p.stateTerm, Revision: p.revision}
+	n.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (n *Node) StatusHandler(w http.ResponseWriter, req *http.Request) {
+	n.mutex.Lock()
+	status := Status{Id: n.id, Role: n.role, Term: n.term, Leader: n.leader, Revision: n.registry.Revision(), Version: n.registry.Snapshot().Version, Peers: n.config.Peers}
+	n.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,314 @@
+package cluster
+
+import (
+	"bytes"
+	"data"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"registry"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRootURL = "/1.0"
+
+func init() {
+	data.Logger = log.New(ioutil.Discard, "", 0)
+}
+
+type testMember struct {
+	node     *Node
+	registry *registry.Registry
+	server   *httptest.Server
+	cut      int32
+}
+
+/*
+ * A member whose network is cut neither sends nor receives anything, like
+ * one that crashed; it keeps running, though.
+ */
+func (m *testMember) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(&m.cut) != 0 {
+		return nil, http.ErrServerClosed
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (m *testMember) cutOff() {
+	atomic.StoreInt32(&m.cut, 1)
+	m.server.CloseClientConnections()
+	m.server.Close()
+}
+
+func (m *testMember) term() uint64 {
+	m.node.mutex.Lock()
+	defer m.node.mutex.Unlock()
+	return m.node.term
+}
+
+/*
+ * register stands in for the handlers of SD that change the registry: the
+ * leader registers and commits, the other members forward.
+ */
+func (m *testMember) register(w http.ResponseWriter, req *http.Request) {
+	if !m.node.IsLeader() {
+		m.node.Forward(w, req)
+		return
+	}
+	var service data.ServiceInfo
+	if json.NewDecoder(req.Body).Decode(&service) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	service, _ = m.registry.Register(service)
+	if !m.node.Commit() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	json.NewEncoder(w).Encode(service)
+}
+
+/*
+ * startCluster runs count members on localhost. Every test uses a secret
+ * of its own, so members left over from an earlier test that still run
+ * can't join in if their addresses are reused.
+ */
+func startCluster(t *testing.T, count int) []*testMember {
+	t.Helper()
+	members := make([]*testMember, count)
+	var peers []string
+	for i := range members {
+		server := httptest.NewUnstartedServer(nil)
+		members[i] = &testMember{server: server, registry: registry.New(10, 60)}
+		peers = append(peers, server.Listener.Addr().String())
+	}
+	config := ClusterConfig{Peers: peers, HeartbeatInterval: 50, ElectionTimeout: 200, CommitTimeout: 2000, Secret: t.Name()}
+	for i, m := range members {
+		m.node = New(config, peers[i], testRootURL, m.registry)
+		m.node.client.Transport = m
+		mux := http.NewServeMux()
+		mux.HandleFunc(testRootURL+"/cluster/vote", m.node.VoteHandler)
+		mux.HandleFunc(testRootURL+"/cluster/append", m.node.AppendHandler)
+		mux.HandleFunc(testRootURL+"/cluster/status", m.node.StatusHandler)
+		mux.HandleFunc(testRootURL+"/register", m.register)
+		m.server.Config.Handler = mux
+		m.server.Start()
+		t.Cleanup(m.server.Close)
+	}
+	for _, m := range members {
+		m.node.Start()
+	}
+	return members
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+/*
+ * leaderOf returns the only leader among the members that all follow it,
+ * nil while there is none.
+ */
+func leaderOf(members []*testMember) *testMember {
+	var leader *testMember
+	for _, m := range members {
+		if m.node.IsLeader() {
+			if leader != nil {
+				return nil
+			}
+			leader = m
+		}
+	}
+	if leader == nil {
+		return nil
+	}
+	for _, m := range members {
+		if m.node.Leader() != leader.node.id {
+			return nil
+		}
+	}
+	return leader
+}
+
+func waitForLeader(t *testing.T, members []*testMember) *testMember {
+	t.Helper()
+	var leader *testMember
+	waitFor(t, "a leader", func() bool {
+		leader = leaderOf(members)
+		return leader != nil
+	})
+	return leader
+}
+
+func hasService(r *registry.Registry, instanceId string) bool {
+	found, _ := r.Instance(instanceId)
+	return found
+}
+
+func registerAt(t *testing.T, m *testMember, port int) (int, data.ServiceInfo) {
+	t.Helper()
+	var service data.ServiceInfo
+	body, _ := json.Marshal(data.ServiceInfo{ServiceType: 1, Server: "127.0.0.1", Port: port, LeaseTTL: 10})
+	resp, err := http.Post(m.server.URL+testRootURL+"/register", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		json.NewDecoder(resp.Body).Decode(&service)
+	}
+	return resp.StatusCode, service
+}
+
+func TestElectsOneLeader(t *testing.T) {
+	members := startCluster(t, 3)
+	leader := waitForLeader(t, members)
+	term := leader.term()
+	// With heartbeats going, the leader stays in office.
+	time.Sleep(600 * time.Millisecond)
+	if leaderOf(members) != leader {
+		t.Fatal("the leader changed without a failure")
+	}
+	if leader.term() != term {
+		t.Fatalf("term went from %d to %d without a failure", term, leader.term())
+	}
+}
+
+func TestCommitReplicatesRegistry(t *testing.T) {
+	members := startCluster(t, 3)
+	leader := waitForLeader(t, members)
+	service, _ := leader.registry.Register(data.ServiceInfo{ServiceType: 1, Server: "127.0.0.1", Port: 9000, LeaseTTL: 10})
+	if !leader.node.Commit() {
+		t.Fatal("commit failed")
+	}
+	replicated := 0
+	for _, m := range members {
+		if hasService(m.registry, service.InstanceId) {
+			replicated++
+		}
+	}
+	if replicated < 2 {
+		t.Fatalf("committed change is on %d members, not a majority", replicated)
+	}
+	waitFor(t, "the change on every member", func() bool {
+		for _, m := range members {
+			if !hasService(m.registry, service.InstanceId) || m.registry.Revision() != leader.registry.Revision() {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestFollowerForwardsToLeader(t *testing.T) {
+	members := startCluster(t, 3)
+	leader := waitForLeader(t, members)
+	for i, m := range members {
+		if m == leader {
+			continue
+		}
+		code, service := registerAt(t, m, 9000+i)
+		if code != http.StatusOK {
+			t.Fatalf("registration at follower %s got %d", m.node.id, code)
+		}
+		if !hasService(leader.registry, service.InstanceId) {
+			t.Fatalf("registration at follower %s did not reach the leader", m.node.id)
+		}
+	}
+}
+
+func TestForwardWithoutLeader(t *testing.T) {
+	r := registry.New(10, 60)
+	node := New(ClusterConfig{Peers: []string{"127.0.0.1:1", "127.0.0.1:2"}, Secret: t.Name()}, "127.0.0.1:3", testRootURL, r)
+	recorder := httptest.NewRecorder()
+	node.Forward(recorder, httptest.NewRequest("POST", testRootURL+"/register", nil))
+	if recorder.Code != http.StatusServiceUnavailable || recorder.Header().Get("Retry-After") == "" {
+		t.Fatalf("forward without a leader got %d, Retry-After %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+}
+
+/*
+ * Once the leader is cut off, the others elect a new one in a later term
+ * that keeps the committed registry and takes new registrations, and the
+ * old leader steps down.
+ */
+func TestFailover(t *testing.T) {
+	members := startCluster(t, 3)
+	leader := waitForLeader(t, members)
+	code, registered := registerAt(t, leader, 9000)
+	if code != http.StatusOK {
+		t.Fatalf("registration got %d", code)
+	}
+	oldTerm := leader.term()
+
+	leader.cutOff()
+	var remaining []*testMember
+	for _, m := range members {
+		if m != leader {
+			remaining = append(remaining, m)
+		}
+	}
+	newLeader := waitForLeader(t, remaining)
+	if newTerm := newLeader.term(); newTerm <= oldTerm {
+		t.Fatalf("new leader in term %d, the old one was in %d", newTerm, oldTerm)
+	}
+	if !hasService(newLeader.registry, registered.InstanceId) {
+		t.Fatal("committed registration lost in the failover")
+	}
+	for _, m := range remaining {
+		if code, _ := registerAt(t, m, 9001); code != http.StatusOK {
+			t.Fatalf("registration at %s after the failover got %d", m.node.id, code)
+		}
+	}
+	waitFor(t, "the old leader to step down", func() bool { return !leader.node.IsLeader() })
+}
+
+func TestMessagesNeedSecret(t *testing.T) {
+	members := startCluster(t, 3)
+	leader := waitForLeader(t, members)
+	state := leader.registry.Export()
+	for _, secret := range []string{"", "wrong"} {
+		body, _ := json.Marshal(AppendRequest{Term: 1000, Leader: "127.0.0.1:1", StateTerm: 1000, State: &state})
+		req, _ := http.NewRequest("POST", members[0].server.URL+testRootURL+"/cluster/append", bytes.NewReader(body))
+		if secret != "" {
+			req.Header.Set(secretHeader, secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("append with secret %q got %d", secret, resp.StatusCode)
+		}
+	}
+	if leaderOf(members) != leader {
+		t.Fatal("a refused append changed the leader")
+	}
+
+	node := New(ClusterConfig{Peers: []string{"127.0.0.1:1"}}, "127.0.0.1:2", testRootURL, registry.New(10, 60))
+	recorder := httptest.NewRecorder()
+	node.AppendHandler(recorder, httptest.NewRequest("POST", testRootURL+"/cluster/append", bytes.NewReader([]byte("{}"))))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("member without a secret took an append: %d", recorder.Code)
+	}
+}
+
+func TestValidSecret(t *testing.T) {
+	for secret, valid := range map[string]bool{"": false, exampleSecret: false, "3c1d6a": true} {
+		if ValidSecret(secret) != valid {
+			t.Errorf("ValidSecret(%q) is %v", secret, !valid)
+		}
+	}
+}
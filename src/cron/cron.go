@@ -0,0 +1,149 @@
+/*
+Cron : Parses classic five field cron expressions (minute, hour, day of
+month, month, day of week) and computes their next occurrence.
+
+Fields support "*", single values, ranges ("1-5"), lists ("1,15") and steps
+("0-30/10" means 0, 10, 20 and 30; a step after "*" or a single value runs to
+the end of the field's range). Day of week runs from 0 (Sunday) to 7 (Sunday
+again).
+As in cron, a job runs when either the day of month or the day of week
+matches if both of them are restricted. The shortcuts @yearly, @monthly,
+@weekly, @daily and @hourly are accepted as well.
+*/
+package cron
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Schedule struct {
+	minute     [60]bool
+	hour       [24]bool
+	dayOfMonth [32]bool
+	month      [13]bool
+	dayOfWeek  [8]bool
+	anyDom     bool
+	anyDow     bool
+}
+
+var shortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+/*
+ * Occurrences further away than this are not searched for; expressions like
+ * "0 0 30 2 *" never match.
+ */
+const searchLimitYears = 5
+
+func parseField(field string, min int, max int, set []bool) bool {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[slash+1:])
+			if err != nil || step <= 0 {
+				return false
+			}
+			part = part[:slash]
+		}
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			low, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return false
+			}
+			high = low
+			if len(bounds) == 2 {
+				high, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return false
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return false
+		}
+		for value := low; value <= high; value += step {
+			set[value] = true
+		}
+	}
+	return true
+}
+
+func Parse(spec string) (bool, *Schedule) {
+	var s Schedule
+
+	spec = strings.TrimSpace(spec)
+	if expanded, isShortcut := shortcuts[spec]; isShortcut {
+		spec = expanded
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return false, nil
+	}
+	if !parseField(fields[0], 0, 59, s.minute[:]) ||
+		!parseField(fields[1], 0, 23, s.hour[:]) ||
+		!parseField(fields[2], 1, 31, s.dayOfMonth[:]) ||
+		!parseField(fields[3], 1, 12, s.month[:]) ||
+		!parseField(fields[4], 0, 7, s.dayOfWeek[:]) {
+		return false, nil
+	}
+	if s.dayOfWeek[7] {
+		s.dayOfWeek[0] = true
+	}
+	s.anyDom = fields[2] == "*"
+	s.anyDow = fields[4] == "*"
+	return true, &s
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	domMatches := s.dayOfMonth[t.Day()]
+	dowMatches := s.dayOfWeek[int(t.Weekday())]
+	if s.anyDom || s.anyDow {
+		return domMatches && dowMatches
+	}
+	return domMatches || dowMatches
+}
+
+/*
+ * Next returns the first occurrence strictly after t, in t's location. It
+ * returns the zero time if there is none within the search limit.
+ */
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc).Add(time.Minute)
+	limit := t.AddDate(searchLimitYears, 0, 0)
+	for t.Before(limit) {
+		if !s.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if !s.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
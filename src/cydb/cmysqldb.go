@@ -5,8 +5,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -74,6 +75,21 @@ func LoginApplication(applicationLogin string, applicationSecret string) (bool,
 	return false, -1
 }
 
+/*
+ * ApplicationQueueSettings returns the plan of an application, which decides
+ * its priority class, and its weight within that class.
+ */
+func ApplicationQueueSettings(applicationId int) (bool, string, int) {
+	var plan string
+	var queueWeight int
+
+	err := mysql_db.QueryRow("SELECT plan, queueWeight from Applications where applicationId = ?", applicationId).Scan(&plan, &queueWeight)
+	if err == nil {
+		return true, plan, queueWeight
+	}
+	return false, "", 0
+}
+
 func getApplicationInstanceId(applicationId int, applicationInstanceUID string) int {
 	var applicationInstanceId int = -1
 
@@ -115,7 +131,7 @@ func AddNewJobInfo(jobData data.TempJobInfo) int {
 	var reqData string
 	re := regexp.MustCompile(`\r?\n`)
 	reqData = re.ReplaceAllString(jobData.RequestData, " ")
-	insert, err := mysql_db.Query("INSERT INTO TempJobs VALUES(0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?)", jobData.ApplicationId, jobData.ApplicationInstanceId, jobData.JobUID, jobData.JobStatus, jobData.RequestType, jobData.RequestStartTime, jobData.RequestSize, reqData, jobData.UploadId, jobData.RequestEndTime, jobData.ProcessingTime, jobData.JobResultData, jobData.UploadIdentifier)
+	insert, err := mysql_db.Query("INSERT INTO TempJobs VALUES(0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?)", jobData.ApplicationId, jobData.ApplicationInstanceId, jobData.JobUID, jobData.JobStatus, jobData.RequestType, jobData.RequestStartTime, jobData.RequestSize, reqData, jobData.UploadId, jobData.RequestEndTime, jobData.ProcessingTime, jobData.JobResultData, jobData.UploadIdentifier, jobData.ServiceServer, jobData.ServicePort, jobData.ServiceActionURL)
 	if err == nil {
 		var jobId int = -1
 		defer insert.Close()
@@ -129,6 +145,59 @@ func AddNewJobInfo(jobData data.TempJobInfo) int {
 	return -1
 }
 
+/*
+ * AddNewJobInfos inserts several jobs with a single statement and returns
+ * their jobIds in the same order. A jobId of -1 marks a job that could not
+ * be found again after the insert.
+ */
+func AddNewJobInfos(jobs []data.TempJobInfo) []int {
+	var jobIds []int = make([]int, len(jobs))
+	var placeholders []string
+	var values []interface{}
+	var uids []interface{}
+	var positions map[string]int = make(map[string]int)
+
+	re := regexp.MustCompile(`\r?\n`)
+	for i, jobData := range jobs {
+		jobIds[i] = -1
+		reqData := re.ReplaceAllString(jobData.RequestData, " ")
+		placeholders = append(placeholders, "(0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?)")
+		values = append(values, jobData.ApplicationId, jobData.ApplicationInstanceId, jobData.JobUID, jobData.JobStatus, jobData.RequestType, jobData.RequestStartTime, jobData.RequestSize, reqData, jobData.UploadId, jobData.RequestEndTime, jobData.ProcessingTime, jobData.JobResultData, jobData.UploadIdentifier, jobData.ServiceServer, jobData.ServicePort, jobData.ServiceActionURL)
+		uids = append(uids, jobData.JobUID)
+		positions[jobData.JobUID] = i
+	}
+	if len(jobs) == 0 {
+		return jobIds
+	}
+	insert, err := mysql_db.Query("INSERT INTO TempJobs VALUES"+strings.Join(placeholders, ", "), values...)
+	if err != nil {
+		data.Logger.Printf("Bulk INSERT TempJobs: Err %s", err)
+		return jobIds
+	}
+	insert.Close()
+	rows, err := mysql_db.Query("SELECT jobId, jobUID from TempJobs WHERE jobUID IN (?"+strings.Repeat(", ?", len(uids)-1)+")", uids...)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var jobId int
+			var jobUID string
+			if rows.Scan(&jobId, &jobUID) == nil {
+				jobIds[positions[jobUID]] = jobId
+			}
+		}
+	}
+	return jobIds
+}
+
+func UpdateJobResultDataPtr(jobId int, jobResultDataPtr string) {
+	update, err := mysql_db.Query("UPDATE TempJobs SET jobResultDataPtr = ? where jobId = ?", jobResultDataPtr, jobId)
+	if err == nil {
+		defer update.Close()
+	} else {
+		data.Logger.Printf("TempJobs UPDATE ERROR, %s", err)
+	}
+}
+
 func DeleteJobInfo(jobId int) {
 }
 
@@ -144,7 +213,7 @@ func UpdateJobUploadIdentifier(jobId int, uploadIdentifier string) bool {
 func JobFullDataForUploadId(uploadId string) (bool, data.TempJobInfo) {
 	var resultInfo data.TempJobInfo
 
-	err := mysql_db.QueryRow("SELECT jobId, applicationId, applicationInstanceId, jobUID, jobStatus, requestType, requestStartTime, requestSize, requestData, uploadId, requestEndTime, processingTime, jobResultDataPtr, jobResultRetrieved, uploadIdentifier from TempJobs where uploadId = ?", uploadId).Scan(
+	err := mysql_db.QueryRow("SELECT jobId, applicationId, applicationInstanceId, jobUID, jobStatus, requestType, requestStartTime, requestSize, requestData, uploadId, requestEndTime, processingTime, jobResultDataPtr, jobResultRetrieved, uploadIdentifier, serviceServer, servicePort, serviceActionURL from TempJobs where uploadId = ?", uploadId).Scan(
 		&resultInfo.JobId,
 		&resultInfo.ApplicationId,
 		&resultInfo.ApplicationInstanceId,
@@ -159,7 +228,10 @@ func JobFullDataForUploadId(uploadId string) (bool, data.TempJobInfo) {
 		&resultInfo.ProcessingTime,
 		&resultInfo.JobResultData,
 		&resultInfo.JobResultRetrieved,
-		&resultInfo.UploadIdentifier)
+		&resultInfo.UploadIdentifier,
+		&resultInfo.ServiceServer,
+		&resultInfo.ServicePort,
+		&resultInfo.ServiceActionURL)
 	if err == nil {
 		return true, resultInfo
 	} else {
@@ -171,10 +243,15 @@ func JobFullDataForUploadId(uploadId string) (bool, data.TempJobInfo) {
 func JobSummaryForUploadId(uploadId string) (bool, data.TempJobInfo) {
 	var resultInfo data.TempJobInfo
 
-	err := mysql_db.QueryRow("SELECT applicationId, applicationInstanceId, uploadId from TempJobs where uploadId = ?", uploadId).Scan(
+	err := mysql_db.QueryRow("SELECT applicationId, applicationInstanceId, uploadId, jobStatus, requestStartTime, requestType, serviceServer, servicePort from TempJobs where uploadId = ?", uploadId).Scan(
 		&resultInfo.ApplicationId,
 		&resultInfo.ApplicationInstanceId,
-		&resultInfo.UploadId)
+		&resultInfo.UploadId,
+		&resultInfo.JobStatus,
+		&resultInfo.RequestStartTime,
+		&resultInfo.RequestType,
+		&resultInfo.ServiceServer,
+		&resultInfo.ServicePort)
 	if err == nil {
 		return true, resultInfo
 	} else {
@@ -185,12 +262,17 @@ func JobSummaryForUploadId(uploadId string) (bool, data.TempJobInfo) {
 func JobSummaryForJobId(jobId int) (bool, data.TempJobInfo) {
 	var resultInfo data.TempJobInfo
 
-	err := mysql_db.QueryRow("SELECT jobId, applicationId, applicationInstanceId, jobStatus, uploadId from TempJobs where jobId = ?", jobId).Scan(
+	err := mysql_db.QueryRow("SELECT jobId, applicationId, applicationInstanceId, jobStatus, requestType, uploadId, jobResultDataPtr, serviceServer, servicePort, serviceActionURL from TempJobs where jobId = ?", jobId).Scan(
 		&resultInfo.JobId,
 		&resultInfo.ApplicationId,
 		&resultInfo.ApplicationInstanceId,
 		&resultInfo.JobStatus,
-		&resultInfo.UploadId)
+		&resultInfo.RequestType,
+		&resultInfo.UploadId,
+		&resultInfo.JobResultData,
+		&resultInfo.ServiceServer,
+		&resultInfo.ServicePort,
+		&resultInfo.ServiceActionURL)
 	if err == nil {
 		return true, resultInfo
 	} else {
@@ -201,7 +283,7 @@ func JobSummaryForJobId(jobId int) (bool, data.TempJobInfo) {
 func JobFullDataForJobId(jobId int) (bool, data.TempJobInfo) {
 	var resultInfo data.TempJobInfo
 
-	err := mysql_db.QueryRow("SELECT jobId, applicationId, applicationInstanceId, jobUID, jobStatus, requestType, requestStartTime, requestSize, requestData, uploadId, requestEndTime, processingTime, jobResultDataPtr, jobResultRetrieved, uploadIdentifier from TempJobs where jobId = ?", jobId).Scan(
+	err := mysql_db.QueryRow("SELECT jobId, applicationId, applicationInstanceId, jobUID, jobStatus, requestType, requestStartTime, requestSize, requestData, uploadId, requestEndTime, processingTime, jobResultDataPtr, jobResultRetrieved, uploadIdentifier, serviceServer, servicePort, serviceActionURL from TempJobs where jobId = ?", jobId).Scan(
 		&resultInfo.JobId,
 		&resultInfo.ApplicationId,
 		&resultInfo.ApplicationInstanceId,
@@ -216,7 +298,10 @@ func JobFullDataForJobId(jobId int) (bool, data.TempJobInfo) {
 		&resultInfo.ProcessingTime,
 		&resultInfo.JobResultData,
 		&resultInfo.JobResultRetrieved,
-		&resultInfo.UploadIdentifier)
+		&resultInfo.UploadIdentifier,
+		&resultInfo.ServiceServer,
+		&resultInfo.ServicePort,
+		&resultInfo.ServiceActionURL)
 	if err == nil {
 		return true, resultInfo
 	} else {
@@ -269,33 +354,426 @@ func RecordJobDoneInDB(jobId int) (bool, int) {
 }
 
 /*
- * Service Discovery Related Database Methods
+ * Result Cache Related Database Functions
  */
+func CachedResultForKey(cacheKey string, now time.Time) (bool, string, time.Time) {
+	var result string
+	var expires time.Time
+
+	err := mysql_db.QueryRow("SELECT result, expires from ResultCache where cacheKey = ? and expires > ?", cacheKey, now).Scan(&result, &expires)
+	if err == nil {
+		return true, result, expires
+	}
+	return false, "", expires
+}
+
+func StoreCachedResult(cacheKey string, serviceType int, result string, expires time.Time) {
+	replace, err := mysql_db.Query("REPLACE INTO ResultCache VALUES(?, ?, ?, ?)", cacheKey, serviceType, result, expires)
+	if err == nil {
+		defer replace.Close()
+	} else {
+		data.Logger.Printf("REPLACE ResultCache: Err %s", err)
+	}
+}
 
-func cleanServicesTable() {
-	delete, err := mysql_db.Query("DELETE FROM AvailableServices")
+func DeleteExpiredCachedResults(now time.Time) {
+	delete, err := mysql_db.Query("DELETE FROM ResultCache where expires <= ?", now)
 	if err == nil {
 		defer delete.Close()
 	}
 }
 
-func UpdateAvailableServices(services data.ServiceInfoList) bool {
-	var serviceList []byte
-	var serviceJSON string
+func RecordCacheHitInDB(jobData data.TempJobInfo, cacheKey string, result string) bool {
+	insert, err := mysql_db.Query("INSERT INTO CacheHits VALUES(0, ?, ?, ?, ?, ?, ?, ?)", jobData.JobId, jobData.ApplicationId, jobData.ApplicationInstanceId, jobData.RequestType, cacheKey, result, time.Now())
+	if err == nil {
+		defer insert.Close()
+		return true
+	}
+	data.Logger.Printf("INSERT CacheHits: Err %s", err)
+	return false
+}
 
-	serviceList, err := json.Marshal(services)
+func CacheHitResultForJob(jobId int) (bool, string) {
+	var result string
+
+	err := mysql_db.QueryRow("SELECT result from CacheHits where jobId = ?", jobId).Scan(&result)
+	return err == nil, result
+}
+
+/*
+ * Batch Related Database Functions
+ */
+func AddNewBatch(batchUID string, applicationId int, applicationInstanceId int, jobIds []int) bool {
+	tx, err := mysql_db.Begin()
+	if err != nil {
+		return false
+	}
+	_, err = tx.Exec("INSERT INTO Batches VALUES(0, ?, ?, ?, ?)", batchUID, applicationId, applicationInstanceId, time.Now())
+	for position, jobId := range jobIds {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("INSERT INTO BatchJobs VALUES(?, ?, ?)", batchUID, position, jobId)
+	}
+	if err != nil {
+		data.Logger.Printf("INSERT Batches: Err %s", err)
+		tx.Rollback()
+		return false
+	}
+	return tx.Commit() == nil
+}
+
+func JobIdsForBatch(batchUID string) (bool, int, int, []int) {
+	var applicationId, applicationInstanceId int
+	var jobIds []int
+
+	err := mysql_db.QueryRow("SELECT applicationId, applicationInstanceId from Batches where batchUID = ?", batchUID).Scan(&applicationId, &applicationInstanceId)
+	if err != nil {
+		return false, -1, -1, nil
+	}
+	rows, err := mysql_db.Query("SELECT jobId from BatchJobs where batchUID = ? ORDER BY position", batchUID)
+	if err != nil {
+		return false, -1, -1, nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jobId int
+		if rows.Scan(&jobId) == nil {
+			jobIds = append(jobIds, jobId)
+		}
+	}
+	return true, applicationId, applicationInstanceId, jobIds
+}
+
+/*
+ * Pipeline Related Database Functions
+ */
+
+/*
+ * AddPipelineSteps records the steps of a pipeline that starts now, and the
+ * lease of the FE that runs it.
+ */
+func AddPipelineSteps(pipelineJobId int, stepNames []string, stepStatus int, owner string, now time.Time) bool {
+	tx, err := mysql_db.Begin()
+	if err != nil {
+		return false
+	}
+	if _, err = tx.Exec("INSERT INTO Pipelines VALUES(?, ?, ?)", pipelineJobId, owner, now); err != nil {
+		data.Logger.Printf("INSERT Pipelines: Err %s", err)
+		tx.Rollback()
+		return false
+	}
+	for stepIndex, stepName := range stepNames {
+		_, err = tx.Exec("INSERT INTO PipelineSteps VALUES(?, ?, ?, -1, ?, 0, '')", pipelineJobId, stepIndex, stepName, stepStatus)
+		if err != nil {
+			data.Logger.Printf("INSERT PipelineSteps: Err %s", err)
+			tx.Rollback()
+			return false
+		}
+	}
+	return tx.Commit() == nil
+}
+
+func UpdatePipelineStep(pipelineJobId int, stepIndex int, stepJobId int, stepStatus int, httpStatus int, result string) {
+	update, err := mysql_db.Query("UPDATE PipelineSteps SET stepJobId = ?, stepStatus = ?, httpStatus = ?, result = ? where pipelineJobId = ? and stepIndex = ?", stepJobId, stepStatus, httpStatus, result, pipelineJobId, stepIndex)
 	if err == nil {
-		serviceJSON = string(serviceList)
-		cleanServicesTable()
-		insert, err := mysql_db.Query("INSERT INTO AvailableServices VALUES(0, ?)", serviceJSON)
+		defer update.Close()
+	} else {
+		data.Logger.Printf("PipelineStep UPDATE ERROR, %s", err)
+	}
+}
+
+/*
+ * RenewPipelineLease fails once another FE took the pipeline over.
+ */
+func RenewPipelineLease(pipelineJobId int, owner string, now time.Time) bool {
+	result, err := mysql_db.Exec("UPDATE Pipelines SET heartbeat = ? where pipelineJobId = ? and owner = ?", now, pipelineJobId, owner)
+	if err != nil {
+		data.Logger.Printf("Pipelines UPDATE ERROR, %s", err)
+		return false
+	}
+	affected, err := result.RowsAffected()
+	return err == nil && affected == 1
+}
+
+/*
+ * StalePipelines returns the pipelines whose FE did not renew its lease
+ * since before.
+ */
+func StalePipelines(before time.Time) []int {
+	var pipelineJobIds []int
+
+	rows, err := mysql_db.Query("SELECT pipelineJobId from Pipelines where heartbeat < ?", before)
+	if err != nil {
+		data.Logger.Printf("Pipelines SELECT ERROR, %s", err)
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pipelineJobId int
+		if rows.Scan(&pipelineJobId) == nil {
+			pipelineJobIds = append(pipelineJobIds, pipelineJobId)
+		}
+	}
+	return pipelineJobIds
+}
+
+/*
+ * ClaimPipeline takes over a stale pipeline. It only succeeds if the lease
+ * is still older than before, so of several FEs only one gets it.
+ */
+func ClaimPipeline(pipelineJobId int, owner string, before time.Time, now time.Time) bool {
+	result, err := mysql_db.Exec("UPDATE Pipelines SET owner = ?, heartbeat = ? where pipelineJobId = ? and heartbeat < ?", owner, now, pipelineJobId, before)
+	if err != nil {
+		data.Logger.Printf("Pipelines UPDATE ERROR, %s", err)
+		return false
+	}
+	affected, err := result.RowsAffected()
+	return err == nil && affected == 1
+}
+
+func FinishPipeline(pipelineJobId int) {
+	if _, err := mysql_db.Exec("DELETE FROM Pipelines where pipelineJobId = ?", pipelineJobId); err != nil {
+		data.Logger.Printf("Pipelines DELETE ERROR, %s", err)
+	}
+}
+
+func PipelineStepsForJob(pipelineJobId int) (bool, []data.PipelineStepInfo) {
+	var steps []data.PipelineStepInfo
+
+	rows, err := mysql_db.Query("SELECT stepIndex, stepName, stepJobId, stepStatus, httpStatus, result from PipelineSteps where pipelineJobId = ? ORDER BY stepIndex", pipelineJobId)
+	if err != nil {
+		return false, nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var step data.PipelineStepInfo
+		err = rows.Scan(&step.StepIndex, &step.StepName, &step.JobId, &step.JobStatus, &step.HttpStatus, &step.Result)
 		if err == nil {
-			defer insert.Close()
-			return true
+			steps = append(steps, step)
 		}
 	}
+	return true, steps
+}
+
+/*
+ * Idempotency Related Database Functions
+ */
+
+const mysqlDuplicateEntry = 1062
+
+/*
+ * ReserveIdempotencyKey claims a key for a request that is about to be
+ * processed. It returns false if the key is already known for this
+ * application instance, including while the first request is still in
+ * progress, and an error if the database failed.
+ */
+func ReserveIdempotencyKey(applicationId int, applicationInstanceId int, idempotencyKey string, requestHash string) (bool, error) {
+	_, err := mysql_db.Exec("INSERT INTO IdempotencyKeys VALUES(?, ?, ?, ?, 0, '', '', ?)", applicationId, applicationInstanceId, idempotencyKey, requestHash, time.Now())
+	if err == nil {
+		return true, nil
+	}
+	if mysqlError, isMySQL := err.(*mysql.MySQLError); isMySQL && mysqlError.Number == mysqlDuplicateEntry {
+		return false, nil
+	}
+	data.Logger.Printf("IdempotencyKeys INSERT ERROR, %s", err)
+	return false, err
+}
+
+/*
+ * TakeOverIdempotencyKey claims a key whose request was reserved earlier
+ * than before and never finished. Of several requests only one gets it.
+ */
+func TakeOverIdempotencyKey(applicationId int, applicationInstanceId int, idempotencyKey string, requestHash string, before time.Time) bool {
+	result, err := mysql_db.Exec("UPDATE IdempotencyKeys SET requestHash = ?, creationDate = ? where applicationId = ? and applicationInstanceId = ? and idempotencyKey = ? and responseCode = 0 and creationDate < ?", requestHash, time.Now(), applicationId, applicationInstanceId, idempotencyKey, before)
+	if err != nil {
+		data.Logger.Printf("IdempotencyKeys UPDATE ERROR, %s", err)
+		return false
+	}
+	affected, err := result.RowsAffected()
+	return err == nil && affected == 1
+}
+
+func IdempotencyRecordForKey(applicationId int, applicationInstanceId int, idempotencyKey string) (bool, data.IdempotencyRecord) {
+	var record data.IdempotencyRecord
+
+	err := mysql_db.QueryRow("SELECT requestHash, responseCode, responseBody, responseHash, creationDate from IdempotencyKeys where applicationId = ? and applicationInstanceId = ? and idempotencyKey = ?", applicationId, applicationInstanceId, idempotencyKey).Scan(
+		&record.RequestHash,
+		&record.ResponseCode,
+		&record.ResponseBody,
+		&record.ResponseHash,
+		&record.CreationDate)
+	if err == nil {
+		return true, record
+	}
+	return false, record
+}
+
+func StoreIdempotentResponse(applicationId int, applicationInstanceId int, idempotencyKey string, responseCode int, responseBody string, responseHash string) bool {
+	update, err := mysql_db.Query("UPDATE IdempotencyKeys SET responseCode = ?, responseBody = ?, responseHash = ? where applicationId = ? and applicationInstanceId = ? and idempotencyKey = ?", responseCode, responseBody, responseHash, applicationId, applicationInstanceId, idempotencyKey)
+	if err == nil {
+		defer update.Close()
+		return true
+	}
+	data.Logger.Printf("IdempotencyKeys UPDATE ERROR, %s", err)
 	return false
 }
 
+func DeleteIdempotencyKey(applicationId int, applicationInstanceId int, idempotencyKey string) {
+	delete, err := mysql_db.Query("DELETE FROM IdempotencyKeys where applicationId = ? and applicationInstanceId = ? and idempotencyKey = ?", applicationId, applicationInstanceId, idempotencyKey)
+	if err == nil {
+		defer delete.Close()
+	}
+}
+
+/*
+ * Schedule Related Database Functions
+ */
+const scheduleColumns = "scheduleId, applicationId, applicationInstanceId, serviceType, requestData, notBefore, cronSpec, catchUp, nextRun, runCount, state, creationDate"
+
+func scanSchedule(scanner interface {
+	Scan(dest ...interface{}) error
+}) (bool, data.ScheduleInfo) {
+	var schedule data.ScheduleInfo
+
+	err := scanner.Scan(
+		&schedule.ScheduleId,
+		&schedule.ApplicationId,
+		&schedule.ApplicationInstanceId,
+		&schedule.ServiceType,
+		&schedule.RequestData,
+		&schedule.NotBefore,
+		&schedule.Cron,
+		&schedule.CatchUp,
+		&schedule.NextRun,
+		&schedule.RunCount,
+		&schedule.State,
+		&schedule.CreationDate)
+	return err == nil, schedule
+}
+
+func querySchedules(query string, args ...interface{}) []data.ScheduleInfo {
+	var schedules []data.ScheduleInfo
+
+	rows, err := mysql_db.Query("SELECT "+scheduleColumns+" from Schedules "+query, args...)
+	if err != nil {
+		data.Logger.Printf("Schedules SELECT ERROR, %s", err)
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if found, schedule := scanSchedule(rows); found {
+			schedules = append(schedules, schedule)
+		}
+	}
+	return schedules
+}
+
+func AddSchedule(schedule data.ScheduleInfo) int {
+	result, err := mysql_db.Exec("INSERT INTO Schedules VALUES(0, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?)", schedule.ApplicationId, schedule.ApplicationInstanceId, schedule.ServiceType, schedule.RequestData, schedule.NotBefore, schedule.Cron, schedule.CatchUp, schedule.NextRun, schedule.State, schedule.CreationDate)
+	if err != nil {
+		data.Logger.Printf("INSERT Schedules: Err %s", err)
+		return -1
+	}
+	scheduleId, err := result.LastInsertId()
+	if err != nil {
+		return -1
+	}
+	return int(scheduleId)
+}
+
+func ScheduleForId(scheduleId int) (bool, data.ScheduleInfo) {
+	return scanSchedule(mysql_db.QueryRow("SELECT "+scheduleColumns+" from Schedules where scheduleId = ?", scheduleId))
+}
+
+func SchedulesForApplication(applicationId int, applicationInstanceId int) []data.ScheduleInfo {
+	return querySchedules("where applicationId = ? and applicationInstanceId = ? ORDER BY scheduleId", applicationId, applicationInstanceId)
+}
+
+func DueSchedules(now time.Time, activeState int) []data.ScheduleInfo {
+	return querySchedules("where state = ? and nextRun <= ? ORDER BY nextRun", activeState, now)
+}
+
+/*
+ * ClaimScheduleRuns moves a due schedule on to its next run. It only succeeds
+ * if the schedule is still active and due at dueRun, so when several FEs
+ * share the database every run is dispatched by exactly one of them.
+ */
+func ClaimScheduleRuns(scheduleId int, activeState int, dueRun time.Time, nextRun time.Time, runs int, state int) bool {
+	result, err := mysql_db.Exec("UPDATE Schedules SET nextRun = ?, runCount = runCount + ?, state = ? where scheduleId = ? and state = ? and nextRun = ?", nextRun, runs, state, scheduleId, activeState, dueRun)
+	if err != nil {
+		data.Logger.Printf("Schedules UPDATE ERROR, %s", err)
+		return false
+	}
+	affected, err := result.RowsAffected()
+	return err == nil && affected == 1
+}
+
+func UpdateScheduleState(scheduleId int, fromState int, toState int) bool {
+	result, err := mysql_db.Exec("UPDATE Schedules SET state = ? where scheduleId = ? and state = ?", toState, scheduleId, fromState)
+	if err != nil {
+		data.Logger.Printf("Schedules UPDATE ERROR, %s", err)
+		return false
+	}
+	affected, err := result.RowsAffected()
+	return err == nil && affected == 1
+}
+
+func AddScheduleRun(scheduleId int, runTime time.Time, jobId int, httpStatus int, result string) {
+	insert, err := mysql_db.Query("INSERT INTO ScheduleRuns VALUES(?, ?, ?, ?, ?)", scheduleId, runTime, jobId, httpStatus, result)
+	if err == nil {
+		defer insert.Close()
+	} else {
+		data.Logger.Printf("INSERT ScheduleRuns: Err %s", err)
+	}
+}
+
+func RunsForSchedule(scheduleId int) []data.ScheduleRunInfo {
+	var runs []data.ScheduleRunInfo
+
+	rows, err := mysql_db.Query("SELECT runTime, jobId, httpStatus, result from ScheduleRuns where scheduleId = ? ORDER BY runTime", scheduleId)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var run data.ScheduleRunInfo
+		if rows.Scan(&run.RunTime, &run.JobId, &run.HttpStatus, &run.Result) == nil {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+/*
+ * Service Discovery Related Database Methods
+ */
+
+/*
+ * Replaces the stored list in one transaction, so readers never see an empty
+ * table in between.
+ */
+func UpdateAvailableServices(services data.ServiceInfoList) bool {
+	serviceList, err := json.Marshal(services)
+	if err != nil {
+		return false
+	}
+	tx, err := mysql_db.Begin()
+	if err != nil {
+		return false
+	}
+	_, err = tx.Exec("DELETE FROM AvailableServices")
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO AvailableServices VALUES(0, ?)", string(serviceList))
+	}
+	if err != nil {
+		data.Logger.Printf("UPDATE AvailableServices: Err %s", err)
+		tx.Rollback()
+		return false
+	}
+	return tx.Commit() == nil
+}
+
 func LastAvailableServices() data.ServiceInfoList {
 	var serviceJSON string
 
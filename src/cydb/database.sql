@@ -48,7 +48,9 @@ CREATE TABLE Applications (
     applicationLogin VARCHAR(32) NOT NULL DEFAULT '',
     applicationSecret VARCHAR(32) NOT NULL DEFAULT '',
     userInfo VARCHAR(128) NOT NULL DEFAULT '',
-    disabled TINYINT NOT NULL DEFAULT 0
+    disabled TINYINT NOT NULL DEFAULT 0,
+    plan VARCHAR(32) NOT NULL DEFAULT 'standard',
+    queueWeight INT NOT NULL DEFAULT 1
 );
 
 
@@ -73,6 +75,25 @@ CREATE TABLE DoneJobs (
     processingTime INT(10) NOT NULL DEFAULT 0
 );
 
+CREATE TABLE CacheHits (
+    cacheHitId INT(10) NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    jobId INT(10) NOT NULL DEFAULT 0,
+    applicationId INT(10) NOT NULL DEFAULT 0,
+    applicationInstanceId INT(10) NOT NULL DEFAULT 0,
+    requestType INT NOT NULL DEFAULT 0,
+    cacheKey VARCHAR(64) NOT NULL DEFAULT '',
+    result MEDIUMTEXT NULL,
+    creationDate DATETIME NULL,
+    KEY (jobId)
+);
+
+CREATE TABLE ResultCache (
+    cacheKey VARCHAR(64) NOT NULL PRIMARY KEY,
+    serviceType INT NOT NULL DEFAULT 0,
+    result MEDIUMTEXT NULL,
+    expires DATETIME NULL
+);
+
 CREATE TABLE TempJobs (
     jobId INT(10) NOT NULL PRIMARY KEY AUTO_INCREMENT,
     applicationId INT(10) NOT NULL DEFAULT 0,
@@ -88,7 +109,81 @@ CREATE TABLE TempJobs (
     processingTime INT(10) NOT NULL DEFAULT 0,
     jobResultDataPtr VARCHAR(128) NOT NULL DEFAULT '',
     jobResultRetrieved INT NOT NULL DEFAULT 0,
-    uploadIdentifier VARCHAR(64) NULL DEFAULT ''
+    uploadIdentifier VARCHAR(64) NULL DEFAULT '',
+    serviceServer VARCHAR(128) NOT NULL DEFAULT '',
+    servicePort INT NOT NULL DEFAULT 0,
+    serviceActionURL VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+CREATE TABLE Batches (
+    batchId INT(10) NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    batchUID VARCHAR(48) NOT NULL DEFAULT '',
+    applicationId INT(10) NOT NULL DEFAULT 0,
+    applicationInstanceId INT(10) NOT NULL DEFAULT 0,
+    creationDate DATETIME NULL,
+    UNIQUE KEY (batchUID)
+);
+
+CREATE TABLE BatchJobs (
+    batchUID VARCHAR(48) NOT NULL DEFAULT '',
+    position INT NOT NULL DEFAULT 0,
+    jobId INT(10) NOT NULL DEFAULT 0,
+    PRIMARY KEY (batchUID, position)
+);
+
+CREATE TABLE PipelineSteps (
+    pipelineJobId INT(10) NOT NULL DEFAULT 0,
+    stepIndex INT NOT NULL DEFAULT 0,
+    stepName VARCHAR(64) NOT NULL DEFAULT '',
+    stepJobId INT(10) NOT NULL DEFAULT -1,
+    stepStatus INT NOT NULL DEFAULT 0,
+    httpStatus INT NOT NULL DEFAULT 0,
+    result MEDIUMTEXT NULL,
+    PRIMARY KEY (pipelineJobId, stepIndex)
+);
+
+CREATE TABLE Pipelines (
+    pipelineJobId INT(10) NOT NULL PRIMARY KEY,
+    owner VARCHAR(48) NOT NULL DEFAULT '',
+    heartbeat DATETIME NULL
+);
+
+CREATE TABLE IdempotencyKeys (
+    applicationId INT(10) NOT NULL DEFAULT 0,
+    applicationInstanceId INT(10) NOT NULL DEFAULT 0,
+    idempotencyKey VARCHAR(128) NOT NULL DEFAULT '',
+    requestHash VARCHAR(64) NOT NULL DEFAULT '',
+    responseCode INT NOT NULL DEFAULT 0,
+    responseBody MEDIUMTEXT NULL,
+    responseHash VARCHAR(64) NOT NULL DEFAULT '',
+    creationDate DATETIME NULL,
+    PRIMARY KEY (applicationId, applicationInstanceId, idempotencyKey)
+);
+
+CREATE TABLE Schedules (
+    scheduleId INT(10) NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    applicationId INT(10) NOT NULL DEFAULT 0,
+    applicationInstanceId INT(10) NOT NULL DEFAULT 0,
+    serviceType INT NOT NULL DEFAULT 0,
+    requestData TEXT NULL,
+    notBefore DATETIME NULL,
+    cronSpec VARCHAR(128) NOT NULL DEFAULT '',
+    catchUp VARCHAR(16) NOT NULL DEFAULT '',
+    nextRun DATETIME NULL,
+    runCount INT NOT NULL DEFAULT 0,
+    state INT NOT NULL DEFAULT 0,
+    creationDate DATETIME NULL,
+    KEY (state, nextRun),
+    KEY (applicationId, applicationInstanceId)
+);
+
+CREATE TABLE ScheduleRuns (
+    scheduleId INT(10) NOT NULL DEFAULT 0,
+    runTime DATETIME NULL,
+    jobId INT(10) NOT NULL DEFAULT -1,
+    httpStatus INT NOT NULL DEFAULT 0,
+    result MEDIUMTEXT NULL,
+    KEY (scheduleId, runTime)
 );
 
 CREATE TABLE AvailableServices (
@@ -1,8 +1,11 @@
 package data
 
 import (
+	"encoding/json"
 	"github.com/twinj/uuid"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,6 +25,9 @@ type TempJobInfo struct {
 	JobResultData         string
 	JobResultRetrieved    int
 	UploadIdentifier      string
+	ServiceServer         string
+	ServicePort           int
+	ServiceActionURL      string
 }
 
 type JobResult struct {
@@ -35,9 +41,21 @@ type UploadInfo struct {
 	UploadUntilDate time.Time `json:"upload_until"`
 }
 
+/*
+ * A link that downloads stored data straight from ss until it expires;
+ * a one-time link works only once.
+ */
+type SignedURL struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+	OneTime bool      `json:"one_time"`
+}
+
 type StorageServerUploadResponse struct {
 	BinaryDataId string    `json:"binary_data_id"`
 	Expires      time.Time `json:"expires"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256"`
 }
 
 type UploadIdT struct {
@@ -45,28 +63,234 @@ type UploadIdT struct {
 }
 
 type UploadCheckInfo struct {
-	UploadId  string `json:"upload_id"`
-	UploadLen int    `json:"data_size"`
-	MimeType  string `json:"mime_type"`
+	ApplicationId         int    `json:"application_id"`
+	ApplicationInstanceId int    `json:"application_instance_id"`
+	UploadId              string `json:"upload_id"`
+	UploadLen             int64  `json:"data_size"`
+	MimeType              string `json:"mime_type"`
+}
+
+/*
+ * What FE asks for when it has ss issue an upload id: the application that
+ * may use it until Expires, for data of one of MimeTypes (any if empty) of
+ * at most MaxSize bytes (ss's own limit if 0).
+ */
+type UploadIdRequest struct {
+	ApplicationId         int       `json:"application_id"`
+	ApplicationInstanceId int       `json:"application_instance_id"`
+	Expires               time.Time `json:"expires"`
+	MimeTypes             []string  `json:"mime_types"`
+	MaxSize               int64     `json:"max_size"`
+}
+
+/*
+ * What an application may keep in ss: bytes and objects in total and the
+ * size of a single object. A limit of 0 means there is none.
+ */
+type StorageQuota struct {
+	MaxBytes      int64 `json:"max_bytes"`
+	MaxObjects    int64 `json:"max_objects"`
+	MaxObjectSize int64 `json:"max_object_size"`
+}
+
+/*
+ * What an application keeps in ss, and what its uploads in progress have
+ * reserved of its quota.
+ */
+type StorageUsage struct {
+	ApplicationId   int          `json:"application_id"`
+	Bytes           int64        `json:"bytes"`
+	Objects         int64        `json:"objects"`
+	ReservedBytes   int64        `json:"reserved_bytes"`
+	ReservedObjects int64        `json:"reserved_objects"`
+	Quota           StorageQuota `json:"quota"`
+}
+
+/*
+ * The new expiry of stored data FE sends to ss; data whose expiry passed is
+ * removed.
+ */
+type BinaryDataExpiry struct {
+	Expires time.Time `json:"expires"`
+}
+
+/*
+ * Sent by ss together with the status of a refused upload.
+ */
+type UploadRejection struct {
+	Reason string `json:"reason"`
 }
 
 type ServiceInfo struct {
-	ServiceType     int      `json:"service_type"`
-	Description     string   `json:"service_description"`
-	Server          string   `json:"service_server"`
-	Port            int      `json:"service_port"`
-	ActionURL       string   `json:"service_action_url"`
-	HeartbeatURL    string   `json:"service_heartbeat_url"`
-	RequiresUpload  bool     `json:"service_requires_upload"`
-	RequestTypes    []string `json:"service_request_types"`
-	ReturnsDownload bool     `json:"service_returns_download"`
-	ResponseTypes   []string `json:"service_response_types"`
-	About           string   `json:"service_about"`
-	IsAsync         bool     `json:"service_is_async"`
+	ServiceType     int                 `json:"service_type"`
+	Description     string              `json:"service_description"`
+	Server          string              `json:"service_server"`
+	Port            int                 `json:"service_port"`
+	ActionURL       string              `json:"service_action_url"`
+	HeartbeatURL    string              `json:"service_heartbeat_url"`
+	RequiresUpload  bool                `json:"service_requires_upload"`
+	RequestTypes    []string            `json:"service_request_types"`
+	ReturnsDownload bool                `json:"service_returns_download"`
+	ResponseTypes   []string            `json:"service_response_types"`
+	About           string              `json:"service_about"`
+	IsAsync         bool                `json:"service_is_async"`
+	RequestSchema   json.RawMessage     `json:"service_request_schema,omitempty"`
+	Weight          int                 `json:"service_weight,omitempty"`
+	Cacheable       bool                `json:"service_cacheable,omitempty"`
+	LeaseTTL        int                 `json:"service_lease_ttl,omitempty"`
+	InstanceId      string              `json:"service_instance_id,omitempty"`
+	State           string              `json:"service_state,omitempty"`
+	Version         string              `json:"service_version,omitempty"`
+	Capabilities    ServiceCapabilities `json:"service_capabilities"`
+	Labels          map[string]string   `json:"service_labels,omitempty"`
 }
 
+/*
+ * What a service instance can handle. Empty lists and a zero size mean the
+ * service did not restrict them; services that still only send
+ * service_request_types and service_response_types get those as their media
+ * and response types. Features are free-form names such as the objects a
+ * detector knows.
+ */
+type ServiceCapabilities struct {
+	MediaTypes    []string `json:"media_types,omitempty"`
+	ResponseTypes []string `json:"response_types,omitempty"`
+	MaxUploadSize int64    `json:"max_upload_size,omitempty"`
+	Features      []string `json:"features,omitempty"`
+}
+
+/*
+ * A draining instance finishes the jobs it already has but gets no new ones.
+ * Instances without a state are active.
+ */
+const (
+	ServiceStateActive   = "active"
+	ServiceStateDraining = "draining"
+)
+
 type ServiceInfoList []ServiceInfo
 
+/*
+ * MediaTypeAccepted tells whether the media type is one of the supported
+ * ones; a supported type of "image/*" covers every image type. An empty
+ * list supports everything.
+ */
+func MediaTypeAccepted(supported []string, mediaType string) bool {
+	if len(supported) == 0 {
+		return true
+	}
+	for _, s := range supported {
+		if strings.EqualFold(s, mediaType) || (strings.HasSuffix(s, "/*") && strings.HasPrefix(strings.ToLower(mediaType), strings.ToLower(strings.TrimSuffix(s, "*")))) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * ParseVersion accepts dotted numeric versions such as "2", "1.4" or
+ * "v1.4.2"; anything after a "-" or "+" (pre-release, build) is ignored.
+ */
+func ParseVersion(version string) (bool, []int) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if cut := strings.IndexAny(version, "-+"); cut >= 0 {
+		version = version[:cut]
+	}
+	if version == "" {
+		return false, nil
+	}
+	parts := strings.Split(version, ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil || number < 0 {
+			return false, nil
+		}
+		numbers[i] = number
+	}
+	return true, numbers
+}
+
+/*
+ * CompareVersions returns -1, 0 or 1. Missing parts count as 0, so "1.4"
+ * equals "1.4.0"; a version that can't be parsed is older than any other.
+ */
+func CompareVersions(a string, b string) int {
+	okA, partsA := ParseVersion(a)
+	okB, partsB := ParseVersion(b)
+	if !okA || !okB {
+		switch {
+		case okA:
+			return 1
+		case okB:
+			return -1
+		}
+		return 0
+	}
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var x, y int
+		if i < len(partsA) {
+			x = partsA[i]
+		}
+		if i < len(partsB) {
+			y = partsB[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+type ServiceLease struct {
+	LeaseId    string    `json:"lease_id"`
+	InstanceId string    `json:"instance_id"`
+	TTL        int       `json:"ttl"`
+	Expires    time.Time `json:"expires"`
+}
+
+type IdempotencyRecord struct {
+	RequestHash  string
+	ResponseCode int
+	ResponseBody string
+	ResponseHash string
+	CreationDate time.Time
+}
+
+type PipelineStepInfo struct {
+	StepIndex  int    `json:"step_index"`
+	StepName   string `json:"step_name"`
+	JobId      int    `json:"job_id"`
+	JobStatus  int    `json:"job_status"`
+	HttpStatus int    `json:"http_status"`
+	Result     string `json:"-"`
+}
+
+type ScheduleInfo struct {
+	ScheduleId            int       `json:"schedule_id"`
+	ApplicationId         int       `json:"-"`
+	ApplicationInstanceId int       `json:"-"`
+	ServiceType           int       `json:"service_type"`
+	RequestData           string    `json:"-"`
+	NotBefore             time.Time `json:"not_before"`
+	Cron                  string    `json:"cron,omitempty"`
+	CatchUp               string    `json:"catch_up"`
+	NextRun               time.Time `json:"next_run"`
+	RunCount              int       `json:"run_count"`
+	State                 int       `json:"state"`
+	CreationDate          time.Time `json:"created"`
+}
+
+type ScheduleRunInfo struct {
+	RunTime    time.Time `json:"run_time"`
+	JobId      int       `json:"job_id"`
+	HttpStatus int       `json:"http_status"`
+	Result     string    `json:"-"`
+}
+
 var Logger *log.Logger
 
 func NewTempJobInfoRecord(applicationId int, applicationInstanceId int, jobType int, requestData []byte) (bool, TempJobInfo) {
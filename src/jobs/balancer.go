@@ -0,0 +1,173 @@
+package jobs
+
+import (
+	"data"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"outbound"
+	"sync"
+)
+
+const (
+	BalanceRoundRobin       = "round_robin"
+	BalanceLeastOutstanding = "least_outstanding"
+	BalanceWeighted         = "weighted"
+)
+
+var serviceInstances map[int]data.ServiceInfoList
+var roundRobinCounters map[int]int
+var outstandingRequests map[string]int
+var balancerMutex sync.Mutex
+
+func initBalancer() {
+	serviceInstances = make(map[int]data.ServiceInfoList)
+	roundRobinCounters = make(map[int]int)
+	outstandingRequests = make(map[string]int)
+}
+
+/*
+ * Called whenever the list of available services changes. Every registered
+ * instance is kept, grouped by its service type; draining instances are left
+ * out so they get no new jobs. Jobs they already run keep going to them as
+ * every job records its instance.
+ */
+func updateServiceInstances(services data.ServiceInfoList) {
+	instances := make(map[int]data.ServiceInfoList)
+	for _, s := range services {
+		if s.State == data.ServiceStateDraining {
+			continue
+		}
+		instances[s.ServiceType] = append(instances[s.ServiceType], s)
+	}
+	balancerMutex.Lock()
+	serviceInstances = instances
+	balancerMutex.Unlock()
+}
+
+/*
+ * The root URL of an instance's job API. It has the same layout as the
+ * configured job server; the instance's ActionURL is passed on with every
+ * job so the instance knows which endpoint to run it on.
+ */
+func instanceRootURL(server string, port int) string {
+	return fmt.Sprintf("http://%s:%d/1.0", server, port)
+}
+
+/*
+ * Jobs created before instances were recorded, or for which no instance was
+ * registered, go to the configured job server.
+ */
+func jobServerURL(jobData data.TempJobInfo) string {
+	if jobData.ServiceServer == "" {
+		return jobServerRootURL
+	}
+	return instanceRootURL(jobData.ServiceServer, jobData.ServicePort)
+}
+
+/*
+ * The description of the instance a job was sent to, or, if it is gone or
+ * the job has none, that of its service type.
+ */
+func jobInstance(jobData data.TempJobInfo) (data.ServiceInfo, bool) {
+	for _, instance := range catalog().services {
+		if instance.ServiceType == jobData.RequestType && instance.Server == jobData.ServiceServer && instance.Port == jobData.ServicePort {
+			return instance, true
+		}
+	}
+	return acceptedServiceType(jobData.RequestType)
+}
+
+func instanceHost(rootURL string) string {
+	parsed, err := url.Parse(rootURL)
+	if err != nil {
+		return rootURL
+	}
+	return parsed.Host
+}
+
+/*
+ * Tracks the requests FE currently has open to an instance; used by the
+ * least-outstanding strategy. The returned function has to be called once
+ * the request is done.
+ */
+func trackOutstanding(rootURL string) func() {
+	host := instanceHost(rootURL)
+	balancerMutex.Lock()
+	outstandingRequests[host]++
+	balancerMutex.Unlock()
+	return func() {
+		balancerMutex.Lock()
+		outstandingRequests[host]--
+		balancerMutex.Unlock()
+	}
+}
+
+func instanceKey(instance data.ServiceInfo) string {
+	return instanceHost(instanceRootURL(instance.Server, instance.Port))
+}
+
+func instanceWeight(instance data.ServiceInfo) int {
+	if instance.Weight > 0 {
+		return instance.Weight
+	}
+	return 1
+}
+
+/*
+ * chooseInstance picks the instance a new job of the given service type is
+ * sent to among those meeting the job's requirements. Instances whose
+ * circuit breaker is open are skipped. It answers 406 if no instance meets
+ * the requirements and 503 if none of those is reachable.
+ */
+func chooseInstance(serviceType int, requirements *ServiceRequirements) (int, data.ServiceInfo) {
+	balancerMutex.Lock()
+	defer balancerMutex.Unlock()
+
+	var healthy data.ServiceInfoList
+	matching := 0
+	for _, instance := range serviceInstances[serviceType] {
+		if !requirements.metBy(instance) {
+			continue
+		}
+		matching++
+		if outbound.IsAvailable(instanceKey(instance)) {
+			healthy = append(healthy, instance)
+		}
+	}
+	if matching == 0 && len(serviceInstances[serviceType]) > 0 {
+		return http.StatusNotAcceptable, data.ServiceInfo{}
+	}
+	if len(healthy) == 0 {
+		return http.StatusServiceUnavailable, data.ServiceInfo{}
+	}
+
+	switch configuration.LoadBalancing {
+	case BalanceLeastOutstanding:
+		best := 0
+		for i, instance := range healthy {
+			if outstandingRequests[instanceKey(instance)] < outstandingRequests[instanceKey(healthy[best])] {
+				best = i
+			}
+		}
+		return http.StatusOK, healthy[best]
+	case BalanceWeighted:
+		total := 0
+		for _, instance := range healthy {
+			total += instanceWeight(instance)
+		}
+		pick := rand.Intn(total)
+		for _, instance := range healthy {
+			pick -= instanceWeight(instance)
+			if pick < 0 {
+				return http.StatusOK, instance
+			}
+		}
+		return http.StatusOK, healthy[len(healthy)-1]
+	default:
+		counter := roundRobinCounters[serviceType]
+		roundRobinCounters[serviceType] = counter + 1
+		return http.StatusOK, healthy[counter%len(healthy)]
+	}
+}
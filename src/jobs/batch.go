@@ -0,0 +1,256 @@
+package jobs
+
+import (
+	"context"
+	"cydb"
+	"data"
+	"encoding/json"
+	"github.com/twinj/uuid"
+	"net/http"
+	"schema"
+	"sync"
+)
+
+const (
+	defaultBatchMaxJobs     = 1000
+	defaultBatchConcurrency = 8
+)
+
+type BatchRequest struct {
+	Jobs []json.RawMessage `json:"jobs"`
+}
+
+type BatchJobEntry struct {
+	Index      int                 `json:"index"`
+	JobId      int                 `json:"job_id"`
+	HttpStatus int                 `json:"http_status"`
+	JobStatus  int                 `json:"job_status"`
+	UploadInfo *data.UploadInfo    `json:"upload_info,omitempty"`
+	Payload    string              `json:"payload,omitempty"`
+	Errors     []schema.FieldError `json:"errors,omitempty"`
+}
+
+type BatchResponse struct {
+	BatchId string          `json:"batch_id"`
+	Jobs    []BatchJobEntry `json:"jobs"`
+}
+
+type BatchStatusResponse struct {
+	BatchId      string          `json:"batch_id"`
+	BatchStatus  int             `json:"batch_status"`
+	JobCount     int             `json:"job_count"`
+	DoneCount    int             `json:"done_count"`
+	RunningCount int             `json:"running_count"`
+	WaitingCount int             `json:"waiting_count"`
+	ErrorCount   int             `json:"error_count"`
+	Jobs         []BatchJobEntry `json:"jobs"`
+}
+
+type BatchJobResult struct {
+	JobId      int             `json:"job_id"`
+	HttpStatus int             `json:"http_status"`
+	Result     json.RawMessage `json:"result,omitempty"`
+}
+
+type BatchResultResponse struct {
+	BatchId string           `json:"batch_id"`
+	Results []BatchJobResult `json:"results"`
+}
+
+func batchConcurrency() int {
+	if configuration.BatchConcurrency > 0 {
+		return configuration.BatchConcurrency
+	}
+	return defaultBatchConcurrency
+}
+
+func batchMaxJobs() int {
+	if configuration.BatchMaxJobs > 0 {
+		return configuration.BatchMaxJobs
+	}
+	return defaultBatchMaxJobs
+}
+
+/*
+ * Calls fn for every index in [0, count) with at most 'limit' calls running
+ * at the same time and returns once all of them are done.
+ */
+func forEachConcurrently(count int, limit int, fn func(int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, limit)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+/*
+ * CreateNewBatch validates all job requests of a batch, inserts them with a
+ * single statement and then dispatches them concurrently. Jobs that fail
+ * validation are reported in the response but do not stop the others. If
+ * no job could be created at all, there is no batch: it answers 422 if none
+ * was valid and 500 if they could not be stored, with the errors per job.
+ * If the batch itself can't be stored, its jobs are marked failed and
+ * answered with their ids and 500, so none stays behind as pending.
+ */
+func CreateNewBatch(ctx context.Context, applicationId int, applicationInstanceId int, requestData []byte, useCache bool) (int, BatchResponse) {
+	var batchRequest BatchRequest
+
+	err := json.Unmarshal(requestData, &batchRequest)
+	if err != nil || len(batchRequest.Jobs) == 0 {
+		return http.StatusBadRequest, BatchResponse{}
+	}
+	if len(batchRequest.Jobs) > batchMaxJobs() {
+		return http.StatusRequestEntityTooLarge, BatchResponse{}
+	}
+
+	count := len(batchRequest.Jobs)
+	entries := make([]BatchJobEntry, count)
+	services := make([]data.ServiceInfo, count)
+	var toInsert []data.TempJobInfo
+	var toInsertIndex []int
+	for i, jobRequest := range batchRequest.Jobs {
+		httpResponse, serviceDescription, tempJobData := prepareJob(applicationId, applicationInstanceId, jobRequest, useCache)
+		entries[i] = BatchJobEntry{Index: i, JobId: -1, HttpStatus: httpResponse, JobStatus: JobStatusERROR}
+		if httpResponse == http.StatusUnprocessableEntity {
+			_, entries[i].Errors = ValidateJobRequest(jobRequest)
+		} else if httpResponse == http.StatusNotAcceptable {
+			entries[i].Errors = UnmatchedRequirements(jobRequest)
+		}
+		if httpResponse == http.StatusOK {
+			services[i] = serviceDescription
+			toInsert = append(toInsert, tempJobData)
+			toInsertIndex = append(toInsertIndex, i)
+		}
+	}
+
+	jobIds := cydb.AddNewJobInfos(toInsert)
+	var batchJobIds []int
+	var dispatchIndex []int
+	for n, jobId := range jobIds {
+		i := toInsertIndex[n]
+		if jobId > 0 {
+			toInsert[n].JobId = jobId
+			entries[i].JobId = jobId
+			batchJobIds = append(batchJobIds, jobId)
+			dispatchIndex = append(dispatchIndex, n)
+		} else {
+			entries[i].HttpStatus = http.StatusInternalServerError
+		}
+	}
+
+	if len(batchJobIds) == 0 {
+		httpResponse := http.StatusUnprocessableEntity
+		if len(toInsert) > 0 {
+			httpResponse = http.StatusInternalServerError
+		}
+		data.Logger.Printf("BATCH: none of %d jobs created", count)
+		return httpResponse, BatchResponse{Jobs: entries}
+	}
+	batchUID := uuid.NewV4().String()
+	if !cydb.AddNewBatch(batchUID, applicationId, applicationInstanceId, batchJobIds) {
+		for _, n := range dispatchIndex {
+			cydb.UpdateJobStatus(toInsert[n].JobId, JobStatusERROR)
+			entries[toInsertIndex[n]].HttpStatus = http.StatusInternalServerError
+		}
+		data.Logger.Printf("BATCH: %s not stored, its %d jobs marked as failed", batchUID, len(batchJobIds))
+		return http.StatusInternalServerError, BatchResponse{Jobs: entries}
+	}
+
+	forEachConcurrently(len(dispatchIndex), batchConcurrency(), func(d int) {
+		n := dispatchIndex[d]
+		i := toInsertIndex[n]
+		respCode, jobResult, uploadInfo := dispatchJob(ctx, services[i], toInsert[n])
+		entries[i].HttpStatus = respCode
+		entries[i].JobStatus = jobResult.JobStatus
+		if services[i].RequiresUpload {
+			entries[i].UploadInfo = &uploadInfo
+		} else if !services[i].IsAsync {
+			entries[i].Payload = jobResult.Payload
+		}
+	})
+	data.Logger.Printf("BATCH: %s created with %d of %d jobs", batchUID, len(batchJobIds), count)
+	return http.StatusAccepted, BatchResponse{BatchId: batchUID, Jobs: entries}
+}
+
+func jobIdsForBatch(applicationId int, applicationInstanceId int, batchId string) (int, []int) {
+	success, batchApplicationId, batchApplicationInstanceId, jobIds := cydb.JobIdsForBatch(batchId)
+	if !success {
+		return http.StatusNotFound, nil
+	}
+	if batchApplicationId != applicationId || batchApplicationInstanceId != applicationInstanceId {
+		return http.StatusUnauthorized, nil
+	}
+	return http.StatusOK, jobIds
+}
+
+/*
+ * BatchStatus asks for the status of every job in the batch and combines
+ * them. The batch is done once all of its jobs are done and in error as soon
+ * as one of them failed; a batch without jobs is never done.
+ */
+func BatchStatus(ctx context.Context, applicationId int, applicationInstanceId int, batchId string) (int, BatchStatusResponse) {
+	httpResponse, jobIds := jobIdsForBatch(applicationId, applicationInstanceId, batchId)
+	if httpResponse != http.StatusOK {
+		return httpResponse, BatchStatusResponse{}
+	}
+	entries := make([]BatchJobEntry, len(jobIds))
+	forEachConcurrently(len(jobIds), batchConcurrency(), func(i int) {
+		respCode, jobStatus := JobStatus(ctx, applicationId, applicationInstanceId, jobIds[i])
+		entries[i] = BatchJobEntry{Index: i, JobId: jobIds[i], HttpStatus: respCode, JobStatus: jobStatus.JobStatus}
+	})
+
+	status := BatchStatusResponse{BatchId: batchId, JobCount: len(jobIds), Jobs: entries}
+	for _, entry := range entries {
+		switch {
+		case entry.HttpStatus != http.StatusOK && entry.HttpStatus != http.StatusAccepted:
+			status.ErrorCount++
+		case entry.JobStatus == JobStatusDone:
+			status.DoneCount++
+		case entry.JobStatus == JobStatusWaitingForFile || entry.JobStatus == JobStatusCreated:
+			status.WaitingCount++
+		case entry.JobStatus >= JobStatusGONE:
+			status.ErrorCount++
+		default:
+			status.RunningCount++
+		}
+	}
+	switch {
+	case status.ErrorCount > 0, status.JobCount == 0:
+		status.BatchStatus = JobStatusERROR
+	case status.DoneCount == status.JobCount:
+		status.BatchStatus = JobStatusDone
+	case status.WaitingCount == status.JobCount:
+		status.BatchStatus = JobStatusWaitingForFile
+	default:
+		status.BatchStatus = JobStatusRunning
+	}
+	return http.StatusOK, status
+}
+
+/*
+ * BatchResult collects the results of all jobs in the batch. Jobs that are
+ * not finished yet are returned with the status code of the job server and
+ * without a result.
+ */
+func BatchResult(ctx context.Context, applicationId int, applicationInstanceId int, batchId string) (int, BatchResultResponse) {
+	httpResponse, jobIds := jobIdsForBatch(applicationId, applicationInstanceId, batchId)
+	if httpResponse != http.StatusOK {
+		return httpResponse, BatchResultResponse{}
+	}
+	results := make([]BatchJobResult, len(jobIds))
+	forEachConcurrently(len(jobIds), batchConcurrency(), func(i int) {
+		respCode, jobResult := JobResult(ctx, applicationId, applicationInstanceId, jobIds[i])
+		results[i] = BatchJobResult{JobId: jobIds[i], HttpStatus: respCode}
+		if jobResult != nil && json.Valid(jobResult) {
+			results[i].Result = json.RawMessage(jobResult)
+		}
+	})
+	return http.StatusOK, BatchResultResponse{BatchId: batchId, Results: results}
+}
@@ -0,0 +1,192 @@
+package jobs
+
+import (
+	"billing"
+	"bytes"
+	"container/list"
+	"cydb"
+	"data"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Services registering with service_cacheable promise to return the same
+ * result for the same request. Their results are cached under a key made of
+ * the service type and version, the canonicalized request and the content
+ * hash of the uploaded data, if any. The cache key of a job is kept in its
+ * jobResultDataPtr; once the job was answered from the cache it is prefixed
+ * with cacheHitPrefix and the result is read from the job's cache hit record.
+ */
+
+const (
+	defaultResultCacheTTL      = 60 * 60
+	defaultResultCacheMaxBytes = 64 * 1024 * 1024
+	cacheHitPrefix             = "cache-hit:"
+)
+
+type cacheEntry struct {
+	key     string
+	result  []byte
+	expires time.Time
+}
+
+var cacheMutex sync.Mutex
+var cacheEntries map[string]*list.Element
+var cacheOrder *list.List
+var cacheBytes int
+
+func resultCacheTTL() time.Duration {
+	if configuration.ResultCacheTTL > 0 {
+		return time.Duration(configuration.ResultCacheTTL) * time.Second
+	}
+	return defaultResultCacheTTL * time.Second
+}
+
+func resultCacheMaxBytes() int {
+	if configuration.ResultCacheMaxBytes > 0 {
+		return configuration.ResultCacheMaxBytes
+	}
+	return defaultResultCacheMaxBytes
+}
+
+func initResultCache() {
+	cacheEntries = make(map[string]*list.Element)
+	cacheOrder = list.New()
+	if configuration.ResultCachePersist {
+		go expireCachedResults()
+	}
+}
+
+func expireCachedResults() {
+	for {
+		time.Sleep(resultCacheTTL())
+		cydb.DeleteExpiredCachedResults(time.Now())
+	}
+}
+
+/*
+ * Requests that only differ in key order or white space get the same key.
+ */
+func canonicalPayload(requestData []byte) []byte {
+	var decoded interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(requestData))
+	decoder.UseNumber()
+	if decoder.Decode(&decoded) != nil {
+		return requestData
+	}
+	canonical, err := json.Marshal(decoded)
+	if err != nil {
+		return requestData
+	}
+	return canonical
+}
+
+/*
+ * resultCacheKey returns an empty key for services that did not opt in and
+ * for upload jobs whose data is not known yet.
+ */
+func resultCacheKey(serviceDescription data.ServiceInfo, requestData []byte, uploadHash string) string {
+	if !serviceDescription.Cacheable || (serviceDescription.RequiresUpload && uploadHash == "") {
+		return ""
+	}
+	return hashOf([]byte(strconv.Itoa(serviceDescription.ServiceType)), []byte(serviceDescription.Version), canonicalPayload(requestData), []byte(uploadHash))
+}
+
+/*
+ * cacheMutex must be held.
+ */
+func removeCacheElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	cacheOrder.Remove(element)
+	delete(cacheEntries, entry.key)
+	cacheBytes -= len(entry.result)
+}
+
+/*
+ * Keeps the most recently used results in memory until they expire or the
+ * size limit pushes them out.
+ */
+func rememberResult(key string, result []byte, expires time.Time) {
+	if len(result) > resultCacheMaxBytes() {
+		return
+	}
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+	if element, exists := cacheEntries[key]; exists {
+		removeCacheElement(element)
+	}
+	cacheEntries[key] = cacheOrder.PushFront(&cacheEntry{key: key, result: result, expires: expires})
+	cacheBytes += len(result)
+	for cacheBytes > resultCacheMaxBytes() {
+		removeCacheElement(cacheOrder.Back())
+	}
+}
+
+func cachedResult(key string) (bool, []byte) {
+	if key == "" || strings.HasPrefix(key, cacheHitPrefix) {
+		return false, nil
+	}
+	cacheMutex.Lock()
+	if element, exists := cacheEntries[key]; exists {
+		entry := element.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			cacheOrder.MoveToFront(element)
+			cacheMutex.Unlock()
+			return true, entry.result
+		}
+		removeCacheElement(element)
+	}
+	cacheMutex.Unlock()
+	if configuration.ResultCachePersist {
+		if found, result, expires := cydb.CachedResultForKey(key, time.Now()); found {
+			rememberResult(key, []byte(result), expires)
+			return true, []byte(result)
+		}
+	}
+	return false, nil
+}
+
+func storeCachedResult(key string, serviceType int, result []byte) {
+	if key == "" || strings.HasPrefix(key, cacheHitPrefix) {
+		return
+	}
+	expires := time.Now().Add(resultCacheTTL())
+	rememberResult(key, result, expires)
+	if configuration.ResultCachePersist {
+		cydb.StoreCachedResult(key, serviceType, string(result), expires)
+	}
+}
+
+/*
+ * Answers an asynchronous job from the cache: the job is done right away and
+ * its result is kept with the cache hit, which billing records separately
+ * from jobs that ran on a job server.
+ */
+func runJobFromCache(jobData data.TempJobInfo, result []byte) (int, data.JobResult) {
+	if !billing.RecordCacheHit(jobData, jobData.JobResultData, string(result)) {
+		return http.StatusInternalServerError, data.JobResult{}
+	}
+	cydb.UpdateJobResultDataPtr(jobData.JobId, cacheHitPrefix+jobData.JobResultData)
+	cydb.UpdateJobStatus(jobData.JobId, JobStatusDone)
+	data.Logger.Printf("CACHE: job %d answered from the result cache", jobData.JobId)
+	return http.StatusAccepted, data.JobResult{JobId: jobData.JobId, JobStatus: JobStatusDone, Payload: ""}
+}
+
+func isCacheHit(jobInfo data.TempJobInfo) bool {
+	return strings.HasPrefix(jobInfo.JobResultData, cacheHitPrefix)
+}
+
+func cacheHitResult(jobInfo data.TempJobInfo) (int, []byte) {
+	found, result := cydb.CacheHitResultForJob(jobInfo.JobId)
+	if !found {
+		return http.StatusNotFound, nil
+	}
+	cydb.UpdateJobResultRetrieved(jobInfo.JobId, 1)
+	return http.StatusOK, []byte(result)
+}
@@ -0,0 +1,230 @@
+package jobs
+
+import (
+	"data"
+	"encoding/json"
+	"fmt"
+	"schema"
+	"strings"
+)
+
+/*
+ * A job request may carry a "service_requirements" object. The job then only
+ * goes to an instance of its service type that has at least min_version,
+ * handles all of the given media and response types and uploads of
+ * upload_size bytes, offers all features and carries all labels. If no
+ * instance does, the job is refused with 406. The requirements are taken out
+ * of the request before it is validated, stored and sent to the service.
+ */
+
+const requirementsKey = "service_requirements"
+
+type ServiceRequirements struct {
+	MinVersion    string            `json:"min_version"`
+	MediaTypes    []string          `json:"media_types"`
+	ResponseTypes []string          `json:"response_types"`
+	UploadSize    int64             `json:"upload_size"`
+	Features      []string          `json:"features"`
+	Labels        map[string]string `json:"labels"`
+}
+
+/*
+ * The services FE offers to clients, one entry per service type, version and
+ * set of capabilities and labels.
+ */
+type ServiceOffer struct {
+	ServiceType     int                      `json:"service_type"`
+	Description     string                   `json:"service_description"`
+	Version         string                   `json:"service_version,omitempty"`
+	RequiresUpload  bool                     `json:"service_requires_upload"`
+	ReturnsDownload bool                     `json:"service_returns_download"`
+	IsAsync         bool                     `json:"service_is_async"`
+	Capabilities    data.ServiceCapabilities `json:"service_capabilities"`
+	Labels          map[string]string        `json:"service_labels,omitempty"`
+	About           json.RawMessage          `json:"service_about,omitempty"`
+}
+
+/*
+ * splitServiceRequirements returns the requirements of a job request, if
+ * any, and the request without them. Requests without requirements are
+ * returned unchanged.
+ */
+func splitServiceRequirements(requestData []byte) (bool, *ServiceRequirements, []byte) {
+	var fields map[string]json.RawMessage
+	var requirements ServiceRequirements
+
+	if json.Unmarshal(requestData, &fields) != nil {
+		return true, nil, requestData
+	}
+	rawRequirements, present := fields[requirementsKey]
+	if !present {
+		return true, nil, requestData
+	}
+	if json.Unmarshal(rawRequirements, &requirements) != nil {
+		return false, nil, requestData
+	}
+	delete(fields, requirementsKey)
+	jobRequest, err := json.Marshal(fields)
+	return err == nil, &requirements, jobRequest
+}
+
+/*
+ * Services that did not send structured capabilities are described by their
+ * request and response types.
+ */
+func effectiveCapabilities(instance data.ServiceInfo) data.ServiceCapabilities {
+	capabilities := instance.Capabilities
+	if len(capabilities.MediaTypes) == 0 {
+		capabilities.MediaTypes = instance.RequestTypes
+	}
+	if len(capabilities.ResponseTypes) == 0 {
+		capabilities.ResponseTypes = instance.ResponseTypes
+	}
+	return capabilities
+}
+
+func supportsAll(supported []string, wanted []string) bool {
+	for _, w := range wanted {
+		if !data.MediaTypeAccepted(supported, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func offersAll(features []string, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, f := range features {
+			if f == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * unmetBy returns the names of the requirements the instance does not meet.
+ */
+func (r *ServiceRequirements) unmetBy(instance data.ServiceInfo) []string {
+	var unmet []string
+	if r == nil {
+		return nil
+	}
+	capabilities := effectiveCapabilities(instance)
+	if r.MinVersion != "" && data.CompareVersions(instance.Version, r.MinVersion) < 0 {
+		unmet = append(unmet, "min_version")
+	}
+	if !supportsAll(capabilities.MediaTypes, r.MediaTypes) {
+		unmet = append(unmet, "media_types")
+	}
+	if !supportsAll(capabilities.ResponseTypes, r.ResponseTypes) {
+		unmet = append(unmet, "response_types")
+	}
+	if r.UploadSize > 0 && capabilities.MaxUploadSize > 0 && r.UploadSize > capabilities.MaxUploadSize {
+		unmet = append(unmet, "upload_size")
+	}
+	if !offersAll(capabilities.Features, r.Features) {
+		unmet = append(unmet, "features")
+	}
+	for label, value := range r.Labels {
+		if instance.Labels[label] != value {
+			unmet = append(unmet, "labels")
+			break
+		}
+	}
+	return unmet
+}
+
+func (r *ServiceRequirements) metBy(instance data.ServiceInfo) bool {
+	return len(r.unmetBy(instance)) == 0
+}
+
+/*
+ * UnmatchedRequirements explains why a job request was refused with 406: it
+ * names every requirement no instance of the service type meets, or, if each
+ * of them is met by some instance, says that none meets all of them.
+ */
+func UnmatchedRequirements(requestData []byte) []schema.FieldError {
+	var serviceId ServiceIdentification
+	var fieldErrors []schema.FieldError
+
+	ok, requirements, _ := splitServiceRequirements(requestData)
+	if !ok {
+		return []schema.FieldError{{Field: requirementsKey, Message: "invalid service requirements"}}
+	}
+	if requirements == nil || json.Unmarshal(requestData, &serviceId) != nil {
+		return nil
+	}
+	balancerMutex.Lock()
+	instances := serviceInstances[serviceId.ServiceType]
+	balancerMutex.Unlock()
+
+	metBySome := make(map[string]bool)
+	var versions []string
+	for _, instance := range instances {
+		unmet := make(map[string]bool)
+		for _, name := range requirements.unmetBy(instance) {
+			unmet[name] = true
+		}
+		for _, name := range []string{"min_version", "media_types", "response_types", "upload_size", "features", "labels"} {
+			if !unmet[name] {
+				metBySome[name] = true
+			}
+		}
+		if instance.Version != "" {
+			versions = append(versions, instance.Version)
+		}
+	}
+	if requirements.MinVersion != "" && !metBySome["min_version"] {
+		fieldErrors = append(fieldErrors, schema.FieldError{Field: requirementsKey + ".min_version", Message: fmt.Sprintf("no instance has version %s or newer (available: %s)", requirements.MinVersion, strings.Join(versions, ", "))})
+	}
+	for _, name := range []string{"media_types", "response_types", "upload_size", "features", "labels"} {
+		if !metBySome[name] {
+			fieldErrors = append(fieldErrors, schema.FieldError{Field: requirementsKey + "." + name, Message: "no instance of the service meets this requirement"})
+		}
+	}
+	if len(fieldErrors) == 0 {
+		fieldErrors = append(fieldErrors, schema.FieldError{Field: requirementsKey, Message: "no single instance of the service meets all requirements"})
+	}
+	return fieldErrors
+}
+
+/*
+ * ServiceOffers describes the available services for clients, including
+ * their versions, capabilities and labels. Draining instances are left out.
+ */
+func ServiceOffers() []ServiceOffer {
+	offers := make([]ServiceOffer, 0)
+	seen := make(map[string]bool)
+	for _, instance := range catalog().services {
+		if instance.State == data.ServiceStateDraining {
+			continue
+		}
+		offer := ServiceOffer{
+			ServiceType:     instance.ServiceType,
+			Description:     instance.Description,
+			Version:         instance.Version,
+			RequiresUpload:  instance.RequiresUpload,
+			ReturnsDownload: instance.ReturnsDownload,
+			IsAsync:         instance.IsAsync,
+			Capabilities:    effectiveCapabilities(instance),
+			Labels:          instance.Labels,
+		}
+		if json.Valid([]byte(instance.About)) {
+			offer.About = json.RawMessage(instance.About)
+		}
+		key, err := json.Marshal(offer)
+		if err != nil || seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		offers = append(offers, offer)
+	}
+	return offers
+}
@@ -0,0 +1,106 @@
+package jobs
+
+import (
+	"crypto/sha256"
+	"cydb"
+	"data"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultIdempotencyWindow             = 24 * 60 * 60
+	defaultIdempotencyReservationTimeout = 300
+)
+
+func idempotencyWindow() time.Duration {
+	if configuration.IdempotencyWindow > 0 {
+		return time.Duration(configuration.IdempotencyWindow) * time.Second
+	}
+	return defaultIdempotencyWindow * time.Second
+}
+
+/*
+ * A key stays reserved for a request in progress at most this long; after
+ * that the request is taken to have died with its FE, or its response to
+ * have been lost, and a retry may take the key over.
+ */
+func idempotencyReservationTimeout() time.Duration {
+	if configuration.IdempotencyReservationTimeout > 0 {
+		return time.Duration(configuration.IdempotencyReservationTimeout) * time.Second
+	}
+	return defaultIdempotencyReservationTimeout * time.Second
+}
+
+func hashOf(parts ...[]byte) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write(part)
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+/*
+ * BeginIdempotentRequest is called before a job creation request with an
+ * Idempotency-Key header is processed. If it returns true the request has to
+ * be processed and finished with FinishIdempotentRequest. Otherwise the
+ * returned status code and body must be sent as they are: either the stored
+ * response of the original request or 409 if the key was used for a
+ * different request or the original request is still being processed. A
+ * reservation older than the reservation timeout is taken over.
+ */
+func BeginIdempotentRequest(applicationId int, applicationInstanceId int, idempotencyKey string, requestPath string, requestData []byte) (bool, int, []byte) {
+	requestHash := hashOf([]byte(requestPath), requestData)
+	for attempt := 0; attempt < 2; attempt++ {
+		reserved, err := cydb.ReserveIdempotencyKey(applicationId, applicationInstanceId, idempotencyKey, requestHash)
+		if err != nil {
+			return false, http.StatusInternalServerError, nil
+		}
+		if reserved {
+			return true, 0, nil
+		}
+		found, record := cydb.IdempotencyRecordForKey(applicationId, applicationInstanceId, idempotencyKey)
+		if !found {
+			continue
+		}
+		if record.CreationDate.Add(idempotencyWindow()).Before(time.Now()) {
+			cydb.DeleteIdempotencyKey(applicationId, applicationInstanceId, idempotencyKey)
+			continue
+		}
+		if record.ResponseCode == 0 {
+			stale := time.Now().Add(-idempotencyReservationTimeout())
+			if record.CreationDate.Before(stale) && cydb.TakeOverIdempotencyKey(applicationId, applicationInstanceId, idempotencyKey, requestHash, stale) {
+				data.Logger.Printf("IDEMPOTENCY: took over the stale reservation of key %s", idempotencyKey)
+				return true, 0, nil
+			}
+			return false, http.StatusConflict, nil
+		}
+		if record.RequestHash != requestHash {
+			return false, http.StatusConflict, nil
+		}
+		if hashOf([]byte(record.ResponseBody)) != record.ResponseHash {
+			data.Logger.Printf("IDEMPOTENCY: stored response for key %s does not match its hash", idempotencyKey)
+			return false, http.StatusInternalServerError, nil
+		}
+		return false, record.ResponseCode, []byte(record.ResponseBody)
+	}
+	return false, http.StatusInternalServerError, nil
+}
+
+/*
+ * FinishIdempotentRequest stores a successful response for later retries.
+ * Failed requests release the key again so the client can simply retry.
+ */
+func FinishIdempotentRequest(applicationId int, applicationInstanceId int, idempotencyKey string, responseCode int, responseBody []byte) {
+	if responseCode >= 200 && responseCode < 300 {
+		// A response that could not be stored leaves the key reserved
+		// until the reservation times out.
+		if !cydb.StoreIdempotentResponse(applicationId, applicationInstanceId, idempotencyKey, responseCode, string(responseBody), hashOf(responseBody)) {
+			data.Logger.Printf("IDEMPOTENCY: response for key %s not stored", idempotencyKey)
+		}
+	} else {
+		cydb.DeleteIdempotencyKey(applicationId, applicationInstanceId, idempotencyKey)
+	}
+}
@@ -3,6 +3,7 @@ package jobs
 import (
 	"billing"
 	"bytes"
+	"context"
 	"cydb"
 	"data"
 	"encoding/json"
@@ -10,7 +11,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"outbound"
+	"schema"
+	"sdclient"
 	"storage"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,13 +41,42 @@ const (
 	JobTypeTextTopicIdentification = 105
 	JobTypeTextSentimentAnalysis   = 106
 	JobTypeTextSummarization       = 107
+	JobTypePipeline                = 200
 )
 
+/*
+ * Clients have this long after creating a job to upload its data; partial
+ * uploads are thrown away at the end of it.
+ */
+const uploadWindow = time.Hour
+
+func uploadUntil(jobData data.TempJobInfo) time.Time {
+	return jobData.RequestStartTime.Add(uploadWindow)
+}
+
 type JobsConfig struct {
-	ServerHost           string `json:"server_host"`
-	ServerPort           int    `json:"server_port"`
-	ServerName           string `json:"server_name"`
-	AvailableServicesURL string `json:"available_services_url"`
+	ServerHost                    string            `json:"server_host"`
+	ServerPort                    int               `json:"server_port"`
+	ServerName                    string            `json:"server_name"`
+	AvailableServicesURL          string            `json:"available_services_url"`
+	AvailableServicesWait         int               `json:"available_services_wait"`
+	BatchMaxJobs                  int               `json:"batch_max_jobs"`
+	BatchConcurrency              int               `json:"batch_concurrency"`
+	PipelinePollInterval          int               `json:"pipeline_poll_interval"`
+	PipelineStepTimeout           int               `json:"pipeline_step_timeout"`
+	PipelineLeaseTimeout          int               `json:"pipeline_lease_timeout"`
+	IdempotencyWindow             int               `json:"idempotency_window"`
+	IdempotencyReservationTimeout int               `json:"idempotency_reservation_timeout"`
+	LoadBalancing                 string            `json:"load_balancing"`
+	DispatchConcurrency           int               `json:"dispatch_concurrency"`
+	QueueTimeout                  int               `json:"queue_timeout"`
+	PlanPriorityClasses           map[string]string `json:"plan_priority_classes"`
+	SchedulerInterval             int               `json:"scheduler_interval"`
+	SchedulerCatchUp              string            `json:"scheduler_catch_up"`
+	SchedulerMaxCatchUp           int               `json:"scheduler_max_catch_up"`
+	ResultCacheTTL                int               `json:"result_cache_ttl"`
+	ResultCacheMaxBytes           int               `json:"result_cache_max_bytes"`
+	ResultCachePersist            bool              `json:"result_cache_persist"`
 }
 
 type JobData struct {
@@ -52,6 +86,10 @@ type JobData struct {
 	JobStatusDetsilsText string `json:"job_status_details_text"`
 }
 
+/*
+ * DataURL is a signed link from which the service downloads the job's data
+ * straight from storage; it is only set if FE signs links.
+ */
 type ServerRequest struct {
 	ApplicationId         int    `json:"application_id"`
 	ApplicationInstanceId int    `json:"application_instance_id"`
@@ -59,81 +97,118 @@ type ServerRequest struct {
 	TargetService         int    `json:"job_type"`
 	UploadId              string `json:"upload_identifier"`
 	Payload               string `json:"payload"`
+	ActionURL             string `json:"service_action_url,omitempty"`
+	DataURL               string `json:"data_url,omitempty"`
 }
 
 type ServiceIdentification struct {
 	ServiceType int `json:"service_type"`
 }
 
-var availableServices data.ServiceInfoList
-var acceptedServiceTypes map[int]data.ServiceInfo
+/*
+ * The services known from SD. A new catalog is built on every update and
+ * swapped in as a whole, so handlers always see a complete and consistent
+ * one without locking.
+ */
+type serviceCatalog struct {
+	services     data.ServiceInfoList
+	serviceTypes map[int]data.ServiceInfo
+	schemas      map[int]*schema.Schema
+}
+
+var currentCatalog atomic.Value
 
 var configuration JobsConfig
 var jobServerRootURL string
 
+func catalog() *serviceCatalog {
+	return currentCatalog.Load().(*serviceCatalog)
+}
+
+func acceptedServiceType(serviceType int) (data.ServiceInfo, bool) {
+	serviceDescription, stE := catalog().serviceTypes[serviceType]
+	return serviceDescription, stE
+}
+
 /*
- * This function is called as a go-routine and checks every 30 seconds
- * which services are still / again available...
+ * We keep only ONE description per service type as they must be identical in
+ * their description of information that is important to user. An active
+ * instance's description is preferred over a draining one's.
  */
-func updateAvailableServices() {
-	var avS data.ServiceInfoList
-	var ast map[int]data.ServiceInfo
-	for {
-		/* First retrieve the available services from our Service Discovery Server */
-		req, err := http.NewRequest("GET", configuration.AvailableServicesURL, nil)
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err == nil {
-			defer resp.Body.Close()
-			if resp.StatusCode == http.StatusOK {
-				json.NewDecoder(resp.Body).Decode(&avS)
-			}
-		} else {
-			data.Logger.Printf("SD not reachable, can't work without any available services..")
-			os.Exit(1)
+func newServiceCatalog(services data.ServiceInfoList) *serviceCatalog {
+	c := &serviceCatalog{services: services, serviceTypes: make(map[int]data.ServiceInfo), schemas: make(map[int]*schema.Schema)}
+	for _, s := range services {
+		if known, stE := c.serviceTypes[s.ServiceType]; stE && (known.State != data.ServiceStateDraining || s.State == data.ServiceStateDraining) {
+			continue
 		}
-		availableServices = avS
-		/*
-		   Now create a list of possible services and their descriptions for later use.
-		   We save only ONE description per service type as they must be identical in their
-		   description of information that is important to user.
-		*/
-		ast = make(map[int]data.ServiceInfo)
-		for _, s := range availableServices {
-			_, stE := ast[s.ServiceType]
-			if !stE {
-				ast[s.ServiceType] = s
+		c.serviceTypes[s.ServiceType] = s
+		if len(s.RequestSchema) > 0 {
+			if ok, requestSchema := schema.Parse(s.RequestSchema); ok {
+				c.schemas[s.ServiceType] = requestSchema
+			} else {
+				data.Logger.Printf("JOBS: service type %d registered an invalid request schema", s.ServiceType)
 			}
 		}
-		acceptedServiceTypes = ast
-		data.Logger.Printf("JOBS: %d serviceTypes availables\n", len(acceptedServiceTypes))
-		time.Sleep(15 * time.Second)
 	}
+	return c
 }
 
-func AvailableServices() data.ServiceInfoList {
-	return availableServices
+func updateAvailableServices(services data.ServiceInfoList, index uint64) {
+	currentCatalog.Store(newServiceCatalog(services))
+	updateServiceInstances(services)
+	data.Logger.Printf("JOBS: %d serviceTypes availables (index %d)\n", len(catalog().serviceTypes), index)
+}
+
+/*
+ * The first list of services has to be there before FE can work; after that
+ * every change SD makes is picked up as soon as it happens.
+ */
+func watchAvailableServices() {
+	sd := sdclient.New(configuration.AvailableServicesURL, time.Duration(configuration.AvailableServicesWait)*time.Second)
+	ok, services, index := sd.Fetch(0)
+	if !ok {
+		data.Logger.Printf("SD not reachable, can't work without any available services..")
+		os.Exit(1)
+	}
+	updateAvailableServices(services, index)
+	go sd.Watch(index, updateAvailableServices)
 }
 
 func InitJobs(c JobsConfig) {
 	configuration = c
-	acceptedServiceTypes = make(map[int]data.ServiceInfo)
-	go updateAvailableServices()
+	currentCatalog.Store(newServiceCatalog(nil))
+	initBalancer()
+	initQueue()
+	initResultCache()
+	watchAvailableServices()
+	go runScheduler()
+	go resumePipelines()
 	jobServerRootURL = fmt.Sprintf("http://%s:%d/1.0", configuration.ServerHost, configuration.ServerPort)
 }
 
-func runSyncJob(jobData data.TempJobInfo) (int, []byte) {
+func newServerRequest(jobData data.TempJobInfo) ServerRequest {
+	request := ServerRequest{ApplicationId: jobData.ApplicationId, ApplicationInstanceId: jobData.ApplicationInstanceId, JobId: jobData.JobId, TargetService: jobData.RequestType, UploadId: jobData.UploadIdentifier, Payload: jobData.RequestData, ActionURL: jobData.ServiceActionURL}
+	if jobData.UploadIdentifier != "" {
+		if signed, link := storage.SignedDownloadURL(jobData.ApplicationId, jobData.ApplicationInstanceId, jobData.UploadIdentifier, 0, false); signed {
+			request.DataURL = link.URL
+		}
+	}
+	return request
+}
+
+func runSyncJob(ctx context.Context, jobData data.TempJobInfo) (int, []byte) {
 	var byteBuffer []byte = nil
-	var jobServerData ServerRequest = ServerRequest{ApplicationId: jobData.ApplicationId, ApplicationInstanceId: jobData.ApplicationInstanceId, JobId: jobData.JobId, TargetService: jobData.RequestType, UploadId: jobData.UploadIdentifier, Payload: jobData.RequestData}
+	var jobServerData ServerRequest = newServerRequest(jobData)
 
 	jobServerJSON, err := json.Marshal(jobServerData)
 	data.Logger.Printf("Will run job")
 	if err == nil {
-		req, err := http.NewRequest("POST", jobServerRootURL+"/new-job", bytes.NewBuffer(jobServerJSON))
+		rootURL := jobServerURL(jobData)
+		req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), "POST", rootURL+"/new-job", bytes.NewBuffer(jobServerJSON))
+		defer trackOutstanding(rootURL)()
 		req.Header.Set("Content-Type", "application/json")
-		client := &http.Client{}
 		data.Logger.Printf("Starting 'Client.Do'")
-		resp, err := client.Do(req)
+		resp, err := outbound.Do("jobs", req, false)
 		data.Logger.Printf("DONE 'Client.Do'")
 		if err == nil {
 			defer resp.Body.Close()
@@ -147,7 +222,7 @@ func runSyncJob(jobData data.TempJobInfo) (int, []byte) {
 			}
 		} else {
 			data.Logger.Printf("RUNJOB: Could not connect to JobServer")
-			return http.StatusInternalServerError, byteBuffer
+			return outbound.StatusForError(err), byteBuffer
 		}
 	} else {
 		data.Logger.Printf("RUNJOB: User sent a very bad request :-)")
@@ -155,78 +230,188 @@ func runSyncJob(jobData data.TempJobInfo) (int, []byte) {
 	}
 }
 
-func CreateNewJob(applicationId int, applicationInstanceId int, requestData []byte) (int, data.JobResult, data.UploadInfo) {
+/*
+ * The service requirements are not part of the request the service sees, so
+ * they are not validated against its schema.
+ */
+func validateJobRequest(serviceType int, requestData []byte) []schema.FieldError {
+	ok, _, jobRequest := splitServiceRequirements(requestData)
+	if !ok {
+		return []schema.FieldError{{Field: requirementsKey, Message: "invalid service requirements"}}
+	}
+	requestSchema, hasSchema := catalog().schemas[serviceType]
+	if !hasSchema {
+		return nil
+	}
+	return requestSchema.Validate(jobRequest)
+}
+
+/*
+ * ValidateJobRequest checks a job request against the request schema the
+ * service registered with SD. The complete request, including service_type,
+ * is validated. Services without a schema accept every request. Pipelines
+ * are checked step by step.
+ */
+func ValidateJobRequest(requestData []byte) (int, []schema.FieldError) {
+	var serviceId ServiceIdentification
+
+	err := json.Unmarshal(requestData, &serviceId)
+	if err != nil {
+		return http.StatusBadRequest, []schema.FieldError{{Field: "$", Message: "request is not valid JSON"}}
+	}
+	fieldErrors := validateJobRequest(serviceId.ServiceType, requestData)
+	if serviceId.ServiceType == JobTypePipeline {
+		if success, pipelineRequest := decodePipelineRequest(string(requestData)); success {
+			fieldErrors = validatePipelineSteps(pipelineRequest)
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return http.StatusUnprocessableEntity, fieldErrors
+	}
+	return http.StatusOK, nil
+}
+
+/*
+ * newTempJob checks the requested service type and creates the temporary job
+ * record for it. The record is not yet stored in the database.
+ */
+func newTempJob(applicationId int, applicationInstanceId int, requestData []byte) (int, data.ServiceInfo, data.TempJobInfo) {
 	var serviceDescription data.ServiceInfo
 	var serviceId ServiceIdentification
 
 	err := json.Unmarshal(requestData, &serviceId)
-	if err == nil {
-		if _, stE := acceptedServiceTypes[serviceId.ServiceType]; !stE {
-			return http.StatusMethodNotAllowed, data.JobResult{}, data.UploadInfo{}
+	if err != nil {
+		return http.StatusBadRequest, serviceDescription, data.TempJobInfo{}
+	}
+	if serviceId.ServiceType == JobTypePipeline {
+		httpResponse, pipelineDescription := pipelineServiceDescription(requestData)
+		if httpResponse != http.StatusOK {
+			return httpResponse, serviceDescription, data.TempJobInfo{}
+		}
+		serviceDescription = pipelineDescription
+	} else if _, stE := acceptedServiceType(serviceId.ServiceType); !stE {
+		return http.StatusMethodNotAllowed, serviceDescription, data.TempJobInfo{}
+	} else {
+		if len(validateJobRequest(serviceId.ServiceType, requestData)) > 0 {
+			return http.StatusUnprocessableEntity, serviceDescription, data.TempJobInfo{}
 		}
+		_, requirements, jobRequest := splitServiceRequirements(requestData)
+		httpResponse, instance := chooseInstance(serviceId.ServiceType, requirements)
+		if httpResponse != http.StatusOK {
+			return httpResponse, serviceDescription, data.TempJobInfo{}
+		}
+		serviceDescription = instance
+		requestData = jobRequest
+	}
 
-		serviceDescription = acceptedServiceTypes[serviceId.ServiceType]
-		data.Logger.Printf("CREATE:: JOB/SERVICE REQUEST of Type %d ", serviceId.ServiceType)
-		jobCreated, tempJobData := data.NewTempJobInfoRecord(applicationId, applicationInstanceId, serviceId.ServiceType, requestData)
-		if jobCreated {
-			if serviceDescription.RequiresUpload {
-				newUploadId := storage.CreateNewUploadId()
-				data.Logger.Printf("NewUpload ID = %s", newUploadId)
-				tempJobData.UploadId = newUploadId
-				tempJobData.JobStatus = JobStatusWaitingForFile
-				jobId := cydb.AddNewJobInfo(tempJobData)
-				if jobId > 0 {
-					jobResult := data.JobResult{JobId: jobId, JobStatus: JobStatusWaitingForFile, Payload: ""}
-					uploadInfo := data.UploadInfo{UploadId: newUploadId, UploadUntilDate: time.Now().Add(time.Hour)}
-					return http.StatusAccepted, jobResult, uploadInfo
-				}
-				return http.StatusInternalServerError, data.JobResult{}, data.UploadInfo{}
-			} else if serviceDescription.IsAsync {
-				tempJobData.UploadId = ""
-				tempJobData.JobStatus = JobStatusCreated
-				jobId := cydb.AddNewJobInfo(tempJobData)
-				if jobId > 0 {
-					tempJobData.JobId = jobId
-					uploadInfo := data.UploadInfo{}
-					respCode, jobResult := RunJob(tempJobData)
-					return respCode, jobResult, uploadInfo
-				}
-				return http.StatusInternalServerError, data.JobResult{}, data.UploadInfo{}
-			} else {
-				tempJobData.UploadId = ""
-				tempJobData.JobStatus = JobStatusCreated
-				jobId := cydb.AddNewJobInfo(tempJobData)
-				if jobId > 0 {
-					tempJobData.JobId = jobId
-					respCode, jobDataBuffer := runSyncJob(tempJobData)
-					cydb.UpdateJobStatus(jobId, JobStatusDone)
-					cydb.UpdateJobResultRetrieved(jobId, 1)
-					billing.RecordJobDone(tempJobData)
-					uploadInfo := data.UploadInfo{}
-					jobResult := data.JobResult{JobId: 0, JobStatus: JobStatusDone, Payload: string(jobDataBuffer)}
-					return respCode, jobResult, uploadInfo
-				}
-				return http.StatusInternalServerError, data.JobResult{}, data.UploadInfo{}
-			}
-		} else {
-			return http.StatusInternalServerError, data.JobResult{}, data.UploadInfo{}
+	data.Logger.Printf("CREATE:: JOB/SERVICE REQUEST of Type %d ", serviceId.ServiceType)
+	jobCreated, tempJobData := data.NewTempJobInfoRecord(applicationId, applicationInstanceId, serviceId.ServiceType, requestData)
+	if !jobCreated {
+		return http.StatusInternalServerError, serviceDescription, tempJobData
+	}
+	tempJobData.UploadId = ""
+	tempJobData.JobStatus = JobStatusCreated
+	if serviceId.ServiceType != JobTypePipeline {
+		tempJobData.ServiceServer = serviceDescription.Server
+		tempJobData.ServicePort = serviceDescription.Port
+		tempJobData.ServiceActionURL = serviceDescription.ActionURL
+		tempJobData.JobResultData = resultCacheKey(serviceDescription, requestData, "")
+	}
+	return http.StatusOK, serviceDescription, tempJobData
+}
+
+/*
+ * prepareJob creates the temporary job record and, for services that need
+ * binary data, a new upload id the client has to upload its data to. Jobs
+ * created with useCache false neither use nor fill the result cache.
+ */
+func prepareJob(applicationId int, applicationInstanceId int, requestData []byte, useCache bool) (int, data.ServiceInfo, data.TempJobInfo) {
+	httpResponse, serviceDescription, tempJobData := newTempJob(applicationId, applicationInstanceId, requestData)
+	if !useCache {
+		tempJobData.JobResultData = ""
+	}
+	if httpResponse == http.StatusOK && serviceDescription.RequiresUpload {
+		newUploadId := storage.CreateNewUploadId(data.UploadIdRequest{
+			ApplicationId:         applicationId,
+			ApplicationInstanceId: applicationInstanceId,
+			Expires:               uploadUntil(tempJobData),
+			MimeTypes:             effectiveCapabilities(serviceDescription).MediaTypes,
+			MaxSize:               serviceDescription.Capabilities.MaxUploadSize,
+		})
+		data.Logger.Printf("NewUpload ID = %s", newUploadId)
+		tempJobData.UploadId = newUploadId
+		tempJobData.JobStatus = JobStatusWaitingForFile
+	}
+	return httpResponse, serviceDescription, tempJobData
+}
+
+/*
+ * dispatchJob hands a job that has already been stored in the database
+ * over to the job server, or tells the client where to upload its data.
+ * The job is handed over even if ctx is cancelled, i.e. the client went
+ * away; ctx only carries the retry hint of outbound.
+ */
+func dispatchJob(ctx context.Context, serviceDescription data.ServiceInfo, tempJobData data.TempJobInfo) (int, data.JobResult, data.UploadInfo) {
+	if serviceDescription.RequiresUpload {
+		jobResult := data.JobResult{JobId: tempJobData.JobId, JobStatus: JobStatusWaitingForFile, Payload: ""}
+		uploadInfo := data.UploadInfo{UploadId: tempJobData.UploadId, UploadUntilDate: uploadUntil(tempJobData)}
+		return http.StatusAccepted, jobResult, uploadInfo
+	} else if serviceDescription.IsAsync {
+		respCode, jobResult := RunJob(ctx, tempJobData)
+		return respCode, jobResult, data.UploadInfo{}
+	} else {
+		var jobDataBuffer []byte
+		if found, result := cachedResult(tempJobData.JobResultData); found {
+			cydb.UpdateJobStatus(tempJobData.JobId, JobStatusDone)
+			cydb.UpdateJobResultRetrieved(tempJobData.JobId, 1)
+			billing.RecordCacheHit(tempJobData, tempJobData.JobResultData, "")
+			return http.StatusOK, data.JobResult{JobId: 0, JobStatus: JobStatusDone, Payload: string(result)}, data.UploadInfo{}
+		}
+		granted, respCode := runQueued(ctx, tempJobData, func() int {
+			var respCode int
+			respCode, jobDataBuffer = runSyncJob(ctx, tempJobData)
+			return respCode
+		})
+		if !granted {
+			return respCode, data.JobResult{JobId: tempJobData.JobId, JobStatus: JobStatusERROR}, data.UploadInfo{}
+		}
+		cydb.UpdateJobStatus(tempJobData.JobId, JobStatusDone)
+		cydb.UpdateJobResultRetrieved(tempJobData.JobId, 1)
+		billing.RecordJobDone(tempJobData)
+		if respCode == http.StatusOK {
+			storeCachedResult(tempJobData.JobResultData, serviceDescription.ServiceType, jobDataBuffer)
 		}
+		jobResult := data.JobResult{JobId: 0, JobStatus: JobStatusDone, Payload: string(jobDataBuffer)}
+		return respCode, jobResult, data.UploadInfo{}
 	}
-	return http.StatusBadRequest, data.JobResult{}, data.UploadInfo{}
 }
 
-func runJob(jobData data.TempJobInfo) (int, data.JobResult) {
+func CreateNewJob(ctx context.Context, applicationId int, applicationInstanceId int, requestData []byte, useCache bool) (int, data.JobResult, data.UploadInfo) {
+	httpResponse, serviceDescription, tempJobData := prepareJob(applicationId, applicationInstanceId, requestData, useCache)
+	if httpResponse != http.StatusOK {
+		return httpResponse, data.JobResult{}, data.UploadInfo{}
+	}
+	jobId := cydb.AddNewJobInfo(tempJobData)
+	if jobId > 0 {
+		tempJobData.JobId = jobId
+		return dispatchJob(ctx, serviceDescription, tempJobData)
+	}
+	return http.StatusInternalServerError, data.JobResult{}, data.UploadInfo{}
+}
+
+func runJob(ctx context.Context, jobData data.TempJobInfo) (int, data.JobResult) {
 	var jobStatus data.JobResult
-	var jobServerData ServerRequest = ServerRequest{ApplicationId: jobData.ApplicationId, ApplicationInstanceId: jobData.ApplicationInstanceId, JobId: jobData.JobId, TargetService: jobData.RequestType, UploadId: jobData.UploadIdentifier, Payload: jobData.RequestData}
+	var jobServerData ServerRequest = newServerRequest(jobData)
 
 	jobServerJSON, err := json.Marshal(jobServerData)
 	data.Logger.Printf("Will run job")
 	if err == nil {
-		req, err := http.NewRequest("POST", jobServerRootURL+"/new-job", bytes.NewBuffer(jobServerJSON))
+		rootURL := jobServerURL(jobData)
+		req, err := http.NewRequestWithContext(context.WithoutCancel(ctx), "POST", rootURL+"/new-job", bytes.NewBuffer(jobServerJSON))
+		defer trackOutstanding(rootURL)()
 		req.Header.Set("Content-Type", "application/json")
-		client := &http.Client{}
 		data.Logger.Printf("Starting 'Client.Do'")
-		resp, err := client.Do(req)
+		resp, err := outbound.Do("jobs", req, false)
 		data.Logger.Printf("DONE 'Client.Do'")
 		if err == nil {
 			defer resp.Body.Close()
@@ -245,7 +430,7 @@ func runJob(jobData data.TempJobInfo) (int, data.JobResult) {
 			}
 		} else {
 			data.Logger.Printf("RUNJOB: Could not connect to JobServer")
-			return http.StatusInternalServerError, jobStatus
+			return outbound.StatusForError(err), jobStatus
 		}
 	} else {
 		data.Logger.Printf("RUNJOB: User sent a very bad request :-)")
@@ -253,30 +438,61 @@ func runJob(jobData data.TempJobInfo) (int, data.JobResult) {
 	}
 }
 
-func JobDataUploaded(uploadId string, uploadIdentifier string) (int, data.TempJobInfo) {
+/*
+ * JobDataUploaded is called once the data of an upload job is stored. The
+ * content hash of the data completes the job's result cache key; an empty
+ * hash keeps the job out of the cache.
+ */
+func JobDataUploaded(uploadId string, uploadIdentifier string, uploadHash string) (int, data.TempJobInfo) {
 	success, jobData := cydb.JobFullDataForUploadId(uploadId)
 	jobData.UploadIdentifier = uploadIdentifier
 	if success {
+		if serviceDescription, stE := jobInstance(jobData); stE && uploadHash != "" {
+			jobData.JobResultData = resultCacheKey(serviceDescription, []byte(jobData.RequestData), uploadHash)
+			cydb.UpdateJobResultDataPtr(jobData.JobId, jobData.JobResultData)
+		}
 		return http.StatusAccepted, jobData
 	} else {
 		return http.StatusNotFound, jobData
 	}
 }
 
-func RunJob(jobData data.TempJobInfo) (int, data.JobResult) {
-	return runJob(jobData)
+func RunJob(ctx context.Context, jobData data.TempJobInfo) (int, data.JobResult) {
+	var jobResult data.JobResult
+	if jobData.RequestType == JobTypePipeline {
+		return startPipeline(jobData)
+	}
+	if found, result := cachedResult(jobData.JobResultData); found {
+		return runJobFromCache(jobData, result)
+	}
+	granted, httpResponse := runQueued(ctx, jobData, func() int {
+		var respCode int
+		respCode, jobResult = runJob(ctx, jobData)
+		return respCode
+	})
+	if !granted {
+		jobResult = data.JobResult{JobId: jobData.JobId, JobStatus: JobStatusERROR}
+	}
+	return httpResponse, jobResult
 }
 
-func JobStatus(applicationId int, applicationInstanceId int, jobId int) (int, data.JobResult) {
+func JobStatus(ctx context.Context, applicationId int, applicationInstanceId int, jobId int) (int, data.JobResult) {
 	success, jobInfo := cydb.JobSummaryForJobId(jobId)
 	if success {
 		if jobInfo.ApplicationId == applicationId && jobInfo.ApplicationInstanceId == applicationInstanceId && jobInfo.JobId == jobId {
+			if jobInfo.RequestType == JobTypePipeline {
+				return pipelineStatus(jobInfo)
+			}
+			if isCacheHit(jobInfo) {
+				return http.StatusOK, data.JobResult{JobId: jobId, JobStatus: JobStatusDone, Payload: ""}
+			}
 			var jobStatus data.JobResult
 			var jobStatusRequest string = fmt.Sprintf("{\"job_id\": %d}", jobId)
-			req, err := http.NewRequest("POST", jobServerRootURL+"/status", bytes.NewBuffer([]byte(jobStatusRequest)))
+			rootURL := jobServerURL(jobInfo)
+			req, err := http.NewRequestWithContext(ctx, "POST", rootURL+"/status", bytes.NewBuffer([]byte(jobStatusRequest)))
+			defer trackOutstanding(rootURL)()
 			req.Header.Set("Content-Type", "application/json")
-			client := &http.Client{}
-			resp, err := client.Do(req)
+			resp, err := outbound.Do("jobs", req, true)
 			if err == nil {
 				defer resp.Body.Close()
 				if resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusOK {
@@ -294,7 +510,7 @@ func JobStatus(applicationId int, applicationInstanceId int, jobId int) (int, da
 				}
 			} else {
 				data.Logger.Printf("JOBSTATUS: Could not connect to JobServer")
-				return http.StatusInternalServerError, jobStatus
+				return outbound.StatusForError(err), jobStatus
 			}
 		} else { // Don't try accessing other user's data
 			return http.StatusUnauthorized, data.JobResult{}
@@ -304,15 +520,22 @@ func JobStatus(applicationId int, applicationInstanceId int, jobId int) (int, da
 	}
 }
 
-func JobResult(applicationId int, applicationInstanceId int, jobId int) (int, []byte) {
+func JobResult(ctx context.Context, applicationId int, applicationInstanceId int, jobId int) (int, []byte) {
 	success, jobInfo := cydb.JobSummaryForJobId(jobId)
 	if success {
 		if jobInfo.ApplicationId == applicationId && jobInfo.ApplicationInstanceId == applicationInstanceId && jobInfo.JobId == jobId {
+			if jobInfo.RequestType == JobTypePipeline {
+				return pipelineResult(jobInfo)
+			}
+			if isCacheHit(jobInfo) {
+				return cacheHitResult(jobInfo)
+			}
 			var jobStatusRequest string = fmt.Sprintf("{\"job_id\": %d}", jobId)
-			req, err := http.NewRequest("POST", jobServerRootURL+"/result", bytes.NewBuffer([]byte(jobStatusRequest)))
+			rootURL := jobServerURL(jobInfo)
+			req, err := http.NewRequestWithContext(ctx, "POST", rootURL+"/result", bytes.NewBuffer([]byte(jobStatusRequest)))
+			defer trackOutstanding(rootURL)()
 			req.Header.Set("Content-Type", "application/json")
-			client := &http.Client{}
-			resp, err := client.Do(req)
+			resp, err := outbound.Do("jobs", req, true)
 			if err == nil {
 				defer resp.Body.Close()
 				if resp.StatusCode == http.StatusOK {
@@ -322,6 +545,7 @@ func JobResult(applicationId int, applicationInstanceId int, jobId int) (int, []
 						cydb.UpdateJobStatus(jobId, JobStatusDone)
 						cydb.UpdateJobResultRetrieved(jobId, 1)
 						billing.RecordJobDone(jobInfo)
+						storeCachedResult(jobInfo.JobResultData, jobInfo.RequestType, byteBuffer)
 						return resp.StatusCode, byteBuffer
 					} else {
 						data.Logger.Printf("JOBRESULT: JobServer returned a bad JSON")
@@ -333,7 +557,7 @@ func JobResult(applicationId int, applicationInstanceId int, jobId int) (int, []
 				}
 			} else {
 				data.Logger.Printf("JOBRESULT: Could not connect to JobServer")
-				return http.StatusInternalServerError, nil
+				return outbound.StatusForError(err), nil
 			}
 		} else { // Don't try accessing other user's data
 			return http.StatusUnauthorized, nil
@@ -351,11 +575,20 @@ func ExpireJobs() int {
 	return http.StatusOK
 }
 
-func CanUploadBinaryData(applicationId int, applicationInstanceId int, uploadId string) bool {
+/*
+ * Data can be uploaded while the job waits for it and the upload window is
+ * open. CanUploadBinaryData also returns the largest upload the job's
+ * service takes, 0 if it did not say, and the end of the upload window.
+ */
+func CanUploadBinaryData(applicationId int, applicationInstanceId int, uploadId string) (bool, int64, time.Time) {
 	success, jobInfo := cydb.JobSummaryForUploadId(uploadId)
 	if success && jobInfo.ApplicationId == applicationId && jobInfo.ApplicationInstanceId == applicationInstanceId && jobInfo.UploadId == uploadId {
-		return true
+		if jobInfo.JobStatus != JobStatusWaitingForFile || uploadUntil(jobInfo).Before(time.Now()) {
+			return false, 0, time.Time{}
+		}
+		instance, _ := jobInstance(jobInfo)
+		return true, instance.Capabilities.MaxUploadSize, uploadUntil(jobInfo)
 	} else {
-		return false
+		return false, 0, time.Time{}
 	}
 }
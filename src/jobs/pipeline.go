@@ -0,0 +1,557 @@
+package jobs
+
+import (
+	"context"
+	"cydb"
+	"data"
+	"encoding/json"
+	"fmt"
+	"github.com/twinj/uuid"
+	"net/http"
+	"schema"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPipelinePollInterval = 2
+	defaultPipelineStepTimeout  = 600
+	defaultPipelineLeaseTimeout = 60
+)
+
+/*
+ * A pipeline runs in the FE that started it, which holds a lease on it in
+ * the database and renews it while the pipeline runs. Every step records
+ * its job as soon as it has one. If the lease is not renewed for
+ * pipeline_lease_timeout seconds, because that FE stopped, another FE, or
+ * the same one after a restart, takes the pipeline over: it keeps the
+ * results of the steps that are done, waits for the asynchronous jobs that
+ * were running and starts the other steps again.
+ */
+var pipelineOwner = uuid.NewV4().String()
+
+/*
+ * A mapping copies the value found at FromPath in the result of FromStep to
+ * ToPath in the request of the step it belongs to. Paths are dot separated,
+ * numeric elements index into arrays; an empty FromPath copies the whole
+ * result.
+ */
+type PipelineMapping struct {
+	FromStep string `json:"from_step"`
+	FromPath string `json:"from_path"`
+	ToPath   string `json:"to_path"`
+}
+
+type PipelineStep struct {
+	Name        string                 `json:"name"`
+	ServiceType int                    `json:"service_type"`
+	Request     map[string]interface{} `json:"request"`
+	DependsOn   []string               `json:"depends_on"`
+	Mappings    []PipelineMapping      `json:"mappings"`
+}
+
+type PipelineRequest struct {
+	ServiceType int            `json:"service_type"`
+	Steps       []PipelineStep `json:"steps"`
+}
+
+type PipelineStepResult struct {
+	data.PipelineStepInfo
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+type PipelineResponse struct {
+	JobId          int                  `json:"job_id"`
+	PipelineStatus int                  `json:"pipeline_status"`
+	Steps          []PipelineStepResult `json:"steps"`
+}
+
+type pipelineStepOutcome struct {
+	index      int
+	jobId      int
+	jobStatus  int
+	httpStatus int
+	result     []byte
+}
+
+func pipelinePollInterval() time.Duration {
+	if configuration.PipelinePollInterval > 0 {
+		return time.Duration(configuration.PipelinePollInterval) * time.Second
+	}
+	return defaultPipelinePollInterval * time.Second
+}
+
+func pipelineLeaseTimeout() time.Duration {
+	if configuration.PipelineLeaseTimeout > 0 {
+		return time.Duration(configuration.PipelineLeaseTimeout) * time.Second
+	}
+	return defaultPipelineLeaseTimeout * time.Second
+}
+
+func pipelineStepTimeout() time.Duration {
+	if configuration.PipelineStepTimeout > 0 {
+		return time.Duration(configuration.PipelineStepTimeout) * time.Second
+	}
+	return defaultPipelineStepTimeout * time.Second
+}
+
+/*
+ * Steps may only depend on steps listed before them, which keeps every
+ * pipeline free of cycles.
+ */
+func (step PipelineStep) dependencies() []string {
+	deps := append([]string{}, step.DependsOn...)
+	for _, mapping := range step.Mappings {
+		deps = append(deps, mapping.FromStep)
+	}
+	return deps
+}
+
+func decodePipelineRequest(requestData string) (bool, PipelineRequest) {
+	var pipelineRequest PipelineRequest
+	err := json.Unmarshal([]byte(requestData), &pipelineRequest)
+	return err == nil, pipelineRequest
+}
+
+/*
+ * mappedField tells whether a mapping of the step sets the field, a field
+ * within it or a field that contains it.
+ */
+func mappedField(step PipelineStep, field string) bool {
+	for _, mapping := range step.Mappings {
+		if field == mapping.ToPath || strings.HasPrefix(field, mapping.ToPath+".") || strings.HasPrefix(mapping.ToPath, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * validatePipelineSteps checks the request of every step against the schema
+ * of its service before the pipeline is created. Fields that mappings fill
+ * in are only known once the steps before have run; they are checked when
+ * the step starts. Errors are named by their place in the pipeline request.
+ */
+func validatePipelineSteps(pipelineRequest PipelineRequest) []schema.FieldError {
+	var fieldErrors []schema.FieldError
+
+	for i, step := range pipelineRequest.Steps {
+		request := make(map[string]interface{})
+		for key, value := range step.Request {
+			request[key] = value
+		}
+		request["service_type"] = step.ServiceType
+		requestData, err := json.Marshal(request)
+		if err != nil {
+			fieldErrors = append(fieldErrors, schema.FieldError{Field: fmt.Sprintf("steps.%d.request", i), Message: "is not valid JSON"})
+			continue
+		}
+		for _, fieldError := range validateJobRequest(step.ServiceType, requestData) {
+			if mappedField(step, fieldError.Field) {
+				continue
+			}
+			if fieldError.Field == "$" {
+				fieldError.Field = fmt.Sprintf("steps.%d.request", i)
+			} else {
+				fieldError.Field = fmt.Sprintf("steps.%d.request.%s", i, fieldError.Field)
+			}
+			fieldErrors = append(fieldErrors, fieldError)
+		}
+	}
+	return fieldErrors
+}
+
+/*
+ * pipelineServiceDescription checks a pipeline definition and returns the
+ * service description FE uses to dispatch it. A pipeline needs an upload if
+ * any of its steps does; all those steps get the same uploaded data. It
+ * answers 422 if the request of a step does not fit its service.
+ */
+func pipelineServiceDescription(requestData []byte) (int, data.ServiceInfo) {
+	var serviceDescription data.ServiceInfo = data.ServiceInfo{ServiceType: JobTypePipeline, Description: "Pipeline", IsAsync: true}
+
+	success, pipelineRequest := decodePipelineRequest(string(requestData))
+	if !success || len(pipelineRequest.Steps) == 0 {
+		return http.StatusBadRequest, serviceDescription
+	}
+	known := make(map[string]bool)
+	for _, step := range pipelineRequest.Steps {
+		if step.Name == "" || known[step.Name] {
+			return http.StatusBadRequest, serviceDescription
+		}
+		stepService, stE := acceptedServiceType(step.ServiceType)
+		if !stE {
+			return http.StatusMethodNotAllowed, serviceDescription
+		}
+		for _, dep := range step.dependencies() {
+			if !known[dep] {
+				return http.StatusBadRequest, serviceDescription
+			}
+		}
+		if stepService.RequiresUpload {
+			serviceDescription.RequiresUpload = true
+		}
+		known[step.Name] = true
+	}
+	if len(validatePipelineSteps(pipelineRequest)) > 0 {
+		return http.StatusUnprocessableEntity, serviceDescription
+	}
+	return http.StatusOK, serviceDescription
+}
+
+func valueAtPath(value interface{}, path string) (bool, interface{}) {
+	if path == "" {
+		return true, value
+	}
+	for _, element := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, found := v[element]
+			if !found {
+				return false, nil
+			}
+			value = next
+		case []interface{}:
+			index, err := strconv.Atoi(element)
+			if err != nil || index < 0 || index >= len(v) {
+				return false, nil
+			}
+			value = v[index]
+		default:
+			return false, nil
+		}
+	}
+	return true, value
+}
+
+func setValueAtPath(target map[string]interface{}, path string, value interface{}) {
+	elements := strings.Split(path, ".")
+	for _, element := range elements[:len(elements)-1] {
+		next, isMap := target[element].(map[string]interface{})
+		if !isMap {
+			next = make(map[string]interface{})
+			target[element] = next
+		}
+		target = next
+	}
+	target[elements[len(elements)-1]] = value
+}
+
+func buildStepRequest(step PipelineStep, results map[string]interface{}) (bool, []byte) {
+	var request map[string]interface{} = make(map[string]interface{})
+
+	for key, value := range step.Request {
+		request[key] = value
+	}
+	for _, mapping := range step.Mappings {
+		found, value := valueAtPath(results[mapping.FromStep], mapping.FromPath)
+		if !found || mapping.ToPath == "" {
+			data.Logger.Printf("PIPELINE: step %s cannot map %s.%s", step.Name, mapping.FromStep, mapping.FromPath)
+			return false, nil
+		}
+		setValueAtPath(request, mapping.ToPath, value)
+	}
+	request["service_type"] = step.ServiceType
+	requestData, err := json.Marshal(request)
+	return err == nil, requestData
+}
+
+/*
+ * Waits for an asynchronous step to finish on the job server and fetches its
+ * result once it is done.
+ */
+func waitForStepResult(applicationId int, applicationInstanceId int, jobId int) (int, int, []byte) {
+	deadline := time.Now().Add(pipelineStepTimeout())
+	for time.Now().Before(deadline) {
+		time.Sleep(pipelinePollInterval())
+		httpResponse, jobStatus := JobStatus(context.Background(), applicationId, applicationInstanceId, jobId)
+		if httpResponse != http.StatusOK && httpResponse != http.StatusAccepted {
+			return httpResponse, JobStatusERROR, nil
+		}
+		if jobStatus.JobStatus == JobStatusDone {
+			httpResponse, result := JobResult(context.Background(), applicationId, applicationInstanceId, jobId)
+			if httpResponse == http.StatusOK {
+				return httpResponse, JobStatusDone, result
+			}
+			return httpResponse, JobStatusERROR, nil
+		}
+		if jobStatus.JobStatus >= JobStatusGONE {
+			return httpResponse, jobStatus.JobStatus, nil
+		}
+	}
+	return http.StatusGatewayTimeout, JobStatusHanging, nil
+}
+
+func runPipelineStep(pipelineJob data.TempJobInfo, index int, requestData []byte) pipelineStepOutcome {
+	outcome := pipelineStepOutcome{index: index, jobId: -1, jobStatus: JobStatusERROR}
+
+	httpResponse, serviceDescription, tempJobData := newTempJob(pipelineJob.ApplicationId, pipelineJob.ApplicationInstanceId, requestData)
+	if httpResponse != http.StatusOK {
+		outcome.httpStatus = httpResponse
+		return outcome
+	}
+	if serviceDescription.RequiresUpload {
+		tempJobData.UploadIdentifier = pipelineJob.UploadIdentifier
+	}
+	jobId := cydb.AddNewJobInfo(tempJobData)
+	if jobId <= 0 {
+		outcome.httpStatus = http.StatusInternalServerError
+		return outcome
+	}
+	tempJobData.JobId = jobId
+	outcome.jobId = jobId
+	cydb.UpdatePipelineStep(pipelineJob.JobId, index, jobId, JobStatusRunning, 0, "")
+
+	if serviceDescription.RequiresUpload || serviceDescription.IsAsync {
+		httpResponse, _ = RunJob(context.Background(), tempJobData)
+		if httpResponse != http.StatusOK && httpResponse != http.StatusAccepted {
+			outcome.httpStatus = httpResponse
+			return outcome
+		}
+		outcome.httpStatus, outcome.jobStatus, outcome.result = waitForStepResult(pipelineJob.ApplicationId, pipelineJob.ApplicationInstanceId, jobId)
+	} else {
+		httpResponse, jobResult, _ := dispatchJob(context.Background(), serviceDescription, tempJobData)
+		outcome.httpStatus = httpResponse
+		if httpResponse == http.StatusOK {
+			outcome.jobStatus = JobStatusDone
+			outcome.result = []byte(jobResult.Payload)
+		}
+	}
+	return outcome
+}
+
+/*
+ * A step that was running when its pipeline was taken over is waited for if
+ * its job runs asynchronously on a job server. The result of a synchronous
+ * job went with the FE that waited for it, so such a step starts again.
+ */
+func stepResumable(step PipelineStep, recorded data.PipelineStepInfo) bool {
+	if recorded.JobStatus != JobStatusRunning || recorded.JobId <= 0 {
+		return false
+	}
+	serviceDescription, stE := acceptedServiceType(step.ServiceType)
+	return stE && (serviceDescription.RequiresUpload || serviceDescription.IsAsync)
+}
+
+func resumePipelineStep(pipelineJob data.TempJobInfo, index int, jobId int) pipelineStepOutcome {
+	outcome := pipelineStepOutcome{index: index, jobId: jobId}
+	outcome.httpStatus, outcome.jobStatus, outcome.result = waitForStepResult(pipelineJob.ApplicationId, pipelineJob.ApplicationInstanceId, jobId)
+	return outcome
+}
+
+/*
+ * runPipeline starts every step as soon as all steps it depends on are done,
+ * so independent steps run in parallel. After the first failure no further
+ * steps are started; steps that never ran keep JobStatusNONE. A pipeline
+ * that is taken over continues from the recorded steps. It stops without a
+ * word if it loses its lease.
+ */
+func runPipeline(pipelineJob data.TempJobInfo, pipelineRequest PipelineRequest, recorded []data.PipelineStepInfo) {
+	var running int = 0
+	var failed bool = false
+	var results map[string]interface{} = make(map[string]interface{})
+	var started []bool = make([]bool, len(pipelineRequest.Steps))
+	var finished chan pipelineStepOutcome = make(chan pipelineStepOutcome, len(pipelineRequest.Steps))
+
+	for _, step := range recorded {
+		i := step.StepIndex
+		if i < 0 || i >= len(pipelineRequest.Steps) {
+			continue
+		}
+		var decodedResult interface{}
+		switch {
+		case step.JobStatus == JobStatusDone && json.Unmarshal([]byte(step.Result), &decodedResult) == nil:
+			started[i] = true
+			results[pipelineRequest.Steps[i].Name] = decodedResult
+		case stepResumable(pipelineRequest.Steps[i], step):
+			started[i] = true
+			running++
+			go func(i int, jobId int) {
+				finished <- resumePipelineStep(pipelineJob, i, jobId)
+			}(i, step.JobId)
+		case step.JobStatus >= JobStatusGONE && step.JobStatus != JobStatusNONE:
+			started[i] = true
+			failed = true
+		}
+	}
+	lease := time.NewTicker(pipelineLeaseTimeout() / 3)
+	defer lease.Stop()
+
+	cydb.UpdateJobStatus(pipelineJob.JobId, JobStatusRunning)
+	for {
+		for i, step := range pipelineRequest.Steps {
+			if failed || started[i] {
+				continue
+			}
+			ready := true
+			for _, dep := range step.dependencies() {
+				if _, done := results[dep]; !done {
+					ready = false
+				}
+			}
+			if !ready {
+				continue
+			}
+			started[i] = true
+			success, requestData := buildStepRequest(step, results)
+			if !success {
+				cydb.UpdatePipelineStep(pipelineJob.JobId, i, -1, JobStatusERROR, http.StatusUnprocessableEntity, "")
+				failed = true
+				continue
+			}
+			cydb.UpdatePipelineStep(pipelineJob.JobId, i, -1, JobStatusRunning, 0, "")
+			running++
+			go func(i int, requestData []byte) {
+				finished <- runPipelineStep(pipelineJob, i, requestData)
+			}(i, requestData)
+		}
+		if running == 0 {
+			break
+		}
+		var outcome pipelineStepOutcome
+		select {
+		case outcome = <-finished:
+		case <-lease.C:
+			if !cydb.RenewPipelineLease(pipelineJob.JobId, pipelineOwner, time.Now()) {
+				data.Logger.Printf("PIPELINE: job %d lost its lease", pipelineJob.JobId)
+				return
+			}
+			continue
+		}
+		running--
+		cydb.UpdatePipelineStep(pipelineJob.JobId, outcome.index, outcome.jobId, outcome.jobStatus, outcome.httpStatus, string(outcome.result))
+		var decodedResult interface{}
+		if outcome.jobStatus == JobStatusDone && json.Unmarshal(outcome.result, &decodedResult) == nil {
+			results[pipelineRequest.Steps[outcome.index].Name] = decodedResult
+		} else {
+			data.Logger.Printf("PIPELINE: job %d, step %s failed with %d", pipelineJob.JobId, pipelineRequest.Steps[outcome.index].Name, outcome.httpStatus)
+			failed = true
+		}
+	}
+	if failed {
+		cydb.UpdateJobStatus(pipelineJob.JobId, JobStatusERROR)
+	} else {
+		cydb.UpdateJobStatus(pipelineJob.JobId, JobStatusDone)
+	}
+	cydb.FinishPipeline(pipelineJob.JobId)
+}
+
+func startPipeline(jobData data.TempJobInfo) (int, data.JobResult) {
+	success, pipelineRequest := decodePipelineRequest(jobData.RequestData)
+	if !success {
+		return http.StatusBadRequest, data.JobResult{}
+	}
+	stepNames := make([]string, len(pipelineRequest.Steps))
+	for i, step := range pipelineRequest.Steps {
+		stepNames[i] = step.Name
+	}
+	if !cydb.AddPipelineSteps(jobData.JobId, stepNames, JobStatusNONE, pipelineOwner, time.Now()) {
+		return http.StatusInternalServerError, data.JobResult{}
+	}
+	go runPipeline(jobData, pipelineRequest, nil)
+	return http.StatusAccepted, data.JobResult{JobId: jobData.JobId, JobStatus: JobStatusRunning, Payload: ""}
+}
+
+/*
+ * takeOverPipeline continues a pipeline whose FE stopped renewing its
+ * lease.
+ */
+func takeOverPipeline(pipelineJobId int, before time.Time) {
+	if !cydb.ClaimPipeline(pipelineJobId, pipelineOwner, before, time.Now()) {
+		return
+	}
+	found, jobData := cydb.JobFullDataForJobId(pipelineJobId)
+	success, pipelineRequest := decodePipelineRequest(jobData.RequestData)
+	_, recorded := cydb.PipelineStepsForJob(pipelineJobId)
+	if !found || !success || len(recorded) != len(pipelineRequest.Steps) {
+		data.Logger.Printf("PIPELINE: job %d can not be taken over", pipelineJobId)
+		cydb.FinishPipeline(pipelineJobId)
+		return
+	}
+	data.Logger.Printf("PIPELINE: job %d taken over", pipelineJobId)
+	go runPipeline(jobData, pipelineRequest, recorded)
+}
+
+/*
+ * This function is called as a go-routine and takes over the pipelines
+ * whose lease ran out. Its first pass comes one lease timeout after FE
+ * started, when the available services are known and the pipelines this FE
+ * ran before a restart are stale.
+ */
+func resumePipelines() {
+	for {
+		time.Sleep(pipelineLeaseTimeout())
+		before := time.Now().Add(-pipelineLeaseTimeout())
+		for _, pipelineJobId := range cydb.StalePipelines(before) {
+			takeOverPipeline(pipelineJobId, before)
+		}
+	}
+}
+
+/*
+ * The combined status of a pipeline is an error as soon as one step failed,
+ * done once all steps are done and running otherwise.
+ */
+func combinedPipelineStatus(jobInfo data.TempJobInfo, steps []data.PipelineStepInfo) int {
+	if jobInfo.JobStatus == JobStatusWaitingForFile || jobInfo.JobStatus == JobStatusERROR {
+		return jobInfo.JobStatus
+	}
+	done := 0
+	for _, step := range steps {
+		if step.JobStatus == JobStatusDone {
+			done++
+		} else if step.JobStatus >= JobStatusGONE && step.JobStatus != JobStatusNONE {
+			return JobStatusERROR
+		}
+	}
+	if len(steps) > 0 && done == len(steps) {
+		return JobStatusDone
+	}
+	return JobStatusRunning
+}
+
+func pipelineResponse(jobInfo data.TempJobInfo, withResults bool) (bool, PipelineResponse) {
+	success, steps := cydb.PipelineStepsForJob(jobInfo.JobId)
+	if !success {
+		return false, PipelineResponse{}
+	}
+	response := PipelineResponse{JobId: jobInfo.JobId, PipelineStatus: combinedPipelineStatus(jobInfo, steps)}
+	for _, step := range steps {
+		stepResult := PipelineStepResult{PipelineStepInfo: step}
+		if withResults && step.Result != "" && json.Valid([]byte(step.Result)) {
+			stepResult.Result = json.RawMessage(step.Result)
+		}
+		response.Steps = append(response.Steps, stepResult)
+	}
+	return true, response
+}
+
+func pipelineStatus(jobInfo data.TempJobInfo) (int, data.JobResult) {
+	success, response := pipelineResponse(jobInfo, false)
+	if !success {
+		return http.StatusInternalServerError, data.JobResult{}
+	}
+	payload, _ := json.Marshal(response)
+	return http.StatusOK, data.JobResult{JobId: jobInfo.JobId, JobStatus: response.PipelineStatus, Payload: string(payload)}
+}
+
+/*
+ * pipelineResult returns every intermediate result recorded so far. As long
+ * as the pipeline is still running the response is 202 instead of 200.
+ */
+func pipelineResult(jobInfo data.TempJobInfo) (int, []byte) {
+	success, response := pipelineResponse(jobInfo, true)
+	if !success {
+		return http.StatusInternalServerError, nil
+	}
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return http.StatusInternalServerError, nil
+	}
+	if response.PipelineStatus == JobStatusDone {
+		cydb.UpdateJobResultRetrieved(jobInfo.JobId, 1)
+		return http.StatusOK, payload
+	}
+	return http.StatusAccepted, payload
+}
@@ -0,0 +1,318 @@
+package jobs
+
+import (
+	"context"
+	"cydb"
+	"data"
+	"net/http"
+	"outbound"
+	"sync"
+	"time"
+)
+
+/*
+ * Every job has to get a dispatch slot before it is sent to a job server.
+ * While all slots are taken jobs wait in one queue per priority class. The
+ * classes are served strictly in order; within a class the applications
+ * share the slots by weighted fair queuing, so a single application sending
+ * thousands of jobs only delays its own jobs. The queue of an application
+ * that had no jobs waiting or running for queueIdleTTL is dropped, along
+ * with its counters.
+ */
+
+const (
+	PriorityRealtime = 0
+	PriorityStandard = 1
+	PriorityBulk     = 2
+)
+
+const (
+	defaultDispatchConcurrency = 32
+	defaultQueueTimeout        = 10
+	queueSettingsTTL           = 5 * time.Minute
+	queueIdleTTL               = 15 * time.Minute
+)
+
+var priorityClassNames = []string{"realtime", "standard", "bulk"}
+
+type QueueStats struct {
+	ApplicationId   int    `json:"application_id"`
+	PriorityClass   string `json:"priority_class"`
+	Weight          int    `json:"weight"`
+	QueueDepth      int    `json:"queue_depth"`
+	OldestWaitMs    int64  `json:"oldest_wait_ms"`
+	Dispatched      int64  `json:"dispatched"`
+	TimedOut        int64  `json:"timed_out"`
+	AverageWaitMs   int64  `json:"average_wait_ms"`
+	MaxWaitMs       int64  `json:"max_wait_ms"`
+	FreeSlots       int    `json:"free_slots"`
+	DispatchSlots   int    `json:"dispatch_slots"`
+	ClassQueueDepth int    `json:"class_queue_depth"`
+}
+
+type queuedJob struct {
+	applicationId int
+	enqueued      time.Time
+	finish        float64
+	granted       chan struct{}
+	wasGranted    bool
+}
+
+type applicationQueue struct {
+	priorityClass int
+	weight        int
+	lastFinish    float64
+	waiting       []*queuedJob
+	running       int
+	lastActive    time.Time
+	dispatched    int64
+	timedOut      int64
+	totalWait     time.Duration
+	maxWait       time.Duration
+}
+
+type queueSettings struct {
+	priorityClass int
+	weight        int
+	loaded        time.Time
+}
+
+var queueMutex sync.Mutex
+var freeSlots int
+var virtualTimes [3]float64
+var applicationQueues map[int]*applicationQueue
+var applicationSettings map[int]queueSettings
+var lastQueueSweep time.Time
+
+func dispatchConcurrency() int {
+	if configuration.DispatchConcurrency > 0 {
+		return configuration.DispatchConcurrency
+	}
+	return defaultDispatchConcurrency
+}
+
+func queueTimeout() time.Duration {
+	if configuration.QueueTimeout > 0 {
+		return time.Duration(configuration.QueueTimeout) * time.Second
+	}
+	return defaultQueueTimeout * time.Second
+}
+
+func initQueue() {
+	freeSlots = dispatchConcurrency()
+	applicationQueues = make(map[int]*applicationQueue)
+	applicationSettings = make(map[int]queueSettings)
+}
+
+func priorityClassForPlan(plan string) int {
+	className, mapped := configuration.PlanPriorityClasses[plan]
+	if !mapped {
+		className = plan
+	}
+	for priorityClass, name := range priorityClassNames {
+		if name == className {
+			return priorityClass
+		}
+	}
+	return PriorityStandard
+}
+
+/*
+ * The plan and weight of an application are read from the database and kept
+ * for a few minutes, so plan changes take effect without a restart.
+ */
+func applicationQueueSettings(applicationId int) queueSettings {
+	queueMutex.Lock()
+	settings, cached := applicationSettings[applicationId]
+	queueMutex.Unlock()
+	if cached && time.Since(settings.loaded) < queueSettingsTTL {
+		return settings
+	}
+	settings = queueSettings{priorityClass: PriorityStandard, weight: 1, loaded: time.Now()}
+	if found, plan, weight := cydb.ApplicationQueueSettings(applicationId); found {
+		settings.priorityClass = priorityClassForPlan(plan)
+		if weight > 0 {
+			settings.weight = weight
+		}
+	}
+	queueMutex.Lock()
+	applicationSettings[applicationId] = settings
+	queueMutex.Unlock()
+	return settings
+}
+
+func queueFor(applicationId int, settings queueSettings) *applicationQueue {
+	queue, exists := applicationQueues[applicationId]
+	if !exists {
+		queue = &applicationQueue{}
+		applicationQueues[applicationId] = queue
+	}
+	queue.priorityClass = settings.priorityClass
+	queue.weight = settings.weight
+	queue.lastActive = time.Now()
+	return queue
+}
+
+/*
+ * Drops the queues idle for queueIdleTTL and expired settings, at most once
+ * a minute. queueMutex must be held.
+ */
+func dropIdleQueues() {
+	if time.Since(lastQueueSweep) < time.Minute {
+		return
+	}
+	lastQueueSweep = time.Now()
+	for applicationId, queue := range applicationQueues {
+		if len(queue.waiting) == 0 && queue.running == 0 && time.Since(queue.lastActive) > queueIdleTTL {
+			delete(applicationQueues, applicationId)
+		}
+	}
+	for applicationId, settings := range applicationSettings {
+		if time.Since(settings.loaded) > queueSettingsTTL {
+			delete(applicationSettings, applicationId)
+		}
+	}
+}
+
+func recordWait(queue *applicationQueue, wait time.Duration) {
+	queue.dispatched++
+	queue.totalWait += wait
+	if wait > queue.maxWait {
+		queue.maxWait = wait
+	}
+}
+
+/*
+ * Hands free slots to waiting jobs: the highest priority class first, and
+ * within it the job with the smallest virtual finish time.
+ * queueMutex must be held.
+ */
+func grantWaitingJobs() {
+	for freeSlots > 0 {
+		var next *applicationQueue
+		for priorityClass := range priorityClassNames {
+			for _, queue := range applicationQueues {
+				if queue.priorityClass != priorityClass || len(queue.waiting) == 0 {
+					continue
+				}
+				if next == nil || queue.waiting[0].finish < next.waiting[0].finish {
+					next = queue
+				}
+			}
+			if next != nil {
+				break
+			}
+		}
+		if next == nil {
+			return
+		}
+		job := next.waiting[0]
+		next.waiting = next.waiting[1:]
+		virtualTimes[next.priorityClass] = job.finish
+		freeSlots--
+		next.running++
+		job.wasGranted = true
+		recordWait(next, time.Since(job.enqueued))
+		close(job.granted)
+	}
+}
+
+func releaseDispatchSlot(queue *applicationQueue) {
+	queueMutex.Lock()
+	freeSlots++
+	queue.running--
+	queue.lastActive = time.Now()
+	grantWaitingJobs()
+	queueMutex.Unlock()
+}
+
+/*
+ * acquireDispatchSlot blocks until the job may be dispatched. It returns
+ * false if no slot became free within the queue timeout; otherwise the
+ * returned function must be called once the job server answered.
+ */
+func acquireDispatchSlot(applicationId int) (bool, func()) {
+	settings := applicationQueueSettings(applicationId)
+
+	queueMutex.Lock()
+	dropIdleQueues()
+	queue := queueFor(applicationId, settings)
+	start := virtualTimes[settings.priorityClass]
+	if queue.lastFinish > start {
+		start = queue.lastFinish
+	}
+	job := &queuedJob{applicationId: applicationId, enqueued: time.Now(), finish: start + 1/float64(settings.weight), granted: make(chan struct{})}
+	queue.lastFinish = job.finish
+	queue.waiting = append(queue.waiting, job)
+	grantWaitingJobs()
+	queueMutex.Unlock()
+
+	timer := time.NewTimer(queueTimeout())
+	defer timer.Stop()
+	release := func() { releaseDispatchSlot(queue) }
+	select {
+	case <-job.granted:
+		return true, release
+	case <-timer.C:
+	}
+
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	if job.wasGranted {
+		return true, release
+	}
+	for i, waiting := range queue.waiting {
+		if waiting == job {
+			queue.waiting = append(queue.waiting[:i], queue.waiting[i+1:]...)
+			break
+		}
+	}
+	queue.timedOut++
+	data.Logger.Printf("QUEUE: job of application %d timed out after %s", applicationId, queueTimeout())
+	return false, nil
+}
+
+/*
+ * runQueued waits for a dispatch slot before running fn and returns whether
+ * it got one in time together with the status code fn returned. A job that
+ * got none is failed with 503, and the client told to retry after the
+ * queue timeout.
+ */
+func runQueued(ctx context.Context, jobData data.TempJobInfo, fn func() int) (bool, int) {
+	granted, release := acquireDispatchSlot(jobData.ApplicationId)
+	if !granted {
+		cydb.UpdateJobStatus(jobData.JobId, JobStatusERROR)
+		outbound.NoteRetryAfter(ctx, queueTimeout())
+		return false, http.StatusServiceUnavailable
+	}
+	defer release()
+	return true, fn()
+}
+
+func ApplicationQueueStats(applicationId int) QueueStats {
+	settings := applicationQueueSettings(applicationId)
+
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	stats := QueueStats{ApplicationId: applicationId, PriorityClass: priorityClassNames[settings.priorityClass], Weight: settings.weight, FreeSlots: freeSlots, DispatchSlots: dispatchConcurrency()}
+	for _, queue := range applicationQueues {
+		if queue.priorityClass == settings.priorityClass {
+			stats.ClassQueueDepth += len(queue.waiting)
+		}
+	}
+	queue, exists := applicationQueues[applicationId]
+	if !exists {
+		return stats
+	}
+	stats.QueueDepth = len(queue.waiting)
+	if len(queue.waiting) > 0 {
+		stats.OldestWaitMs = int64(time.Since(queue.waiting[0].enqueued) / time.Millisecond)
+	}
+	stats.Dispatched = queue.dispatched
+	stats.TimedOut = queue.timedOut
+	stats.MaxWaitMs = int64(queue.maxWait / time.Millisecond)
+	if queue.dispatched > 0 {
+		stats.AverageWaitMs = int64(queue.totalWait/time.Duration(queue.dispatched)) / int64(time.Millisecond)
+	}
+	return stats
+}
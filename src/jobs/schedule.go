@@ -0,0 +1,342 @@
+package jobs
+
+import (
+	"context"
+	"cron"
+	"cydb"
+	"data"
+	"encoding/json"
+	"net/http"
+	"schema"
+	"time"
+)
+
+/*
+ * A job request carrying a "schedule" object is not run right away but stored
+ * as a schedule. It runs once at not_before, or, with a cron expression, at
+ * every occurrence from not_before on. All times are UTC.
+ */
+
+const (
+	ScheduleStateActive    = 0
+	ScheduleStateFinished  = 1
+	ScheduleStateCancelled = 2
+)
+
+/*
+ * What happens to the runs of a recurring schedule that were missed while no
+ * FE was running: "skip" drops them, "once" runs the latest of them and "all"
+ * runs every one of them, up to scheduler_max_catch_up.
+ */
+const (
+	CatchUpSkip = "skip"
+	CatchUpOnce = "once"
+	CatchUpAll  = "all"
+)
+
+const (
+	defaultSchedulerInterval   = 10
+	defaultSchedulerMaxCatchUp = 100
+)
+
+type ScheduleRequest struct {
+	NotBefore time.Time `json:"not_before"`
+	Cron      string    `json:"cron"`
+	CatchUp   string    `json:"catch_up"`
+}
+
+type scheduledJobRequest struct {
+	Schedule *ScheduleRequest `json:"schedule"`
+}
+
+type ScheduleRunResult struct {
+	data.ScheduleRunInfo
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+type ScheduleRunsResponse struct {
+	Schedule data.ScheduleInfo   `json:"schedule"`
+	Runs     []ScheduleRunResult `json:"runs"`
+}
+
+func schedulerInterval() time.Duration {
+	if configuration.SchedulerInterval > 0 {
+		return time.Duration(configuration.SchedulerInterval) * time.Second
+	}
+	return defaultSchedulerInterval * time.Second
+}
+
+func schedulerMaxCatchUp() int {
+	if configuration.SchedulerMaxCatchUp > 0 {
+		return configuration.SchedulerMaxCatchUp
+	}
+	return defaultSchedulerMaxCatchUp
+}
+
+func defaultCatchUpPolicy() string {
+	if configuration.SchedulerCatchUp != "" {
+		return configuration.SchedulerCatchUp
+	}
+	return CatchUpOnce
+}
+
+func IsScheduledRequest(requestData []byte) bool {
+	var request scheduledJobRequest
+	return json.Unmarshal(requestData, &request) == nil && request.Schedule != nil
+}
+
+/*
+ * Separates the schedule from the job request; the job request is stored
+ * without it, as it would be sent for an immediate job.
+ */
+func splitScheduledRequest(requestData []byte) (bool, ScheduleRequest, []byte) {
+	var fields map[string]json.RawMessage
+	var request ScheduleRequest
+
+	if json.Unmarshal(requestData, &fields) != nil || json.Unmarshal(fields["schedule"], &request) != nil {
+		return false, request, nil
+	}
+	delete(fields, "schedule")
+	jobRequest, err := json.Marshal(fields)
+	return err == nil, request, jobRequest
+}
+
+func scheduleError(message string) []schema.FieldError {
+	return []schema.FieldError{{Field: "schedule", Message: message}}
+}
+
+/*
+ * The first run of a recurring schedule is its first occurrence at or after
+ * start.
+ */
+func firstRun(spec *cron.Schedule, start time.Time) time.Time {
+	if spec == nil {
+		return start
+	}
+	return spec.Next(start.Add(-time.Second))
+}
+
+/*
+ * CreateSchedule checks a scheduled job request like an immediate one and
+ * stores it. Services that need an upload can't be scheduled as nobody would
+ * be there to upload the data.
+ */
+func CreateSchedule(applicationId int, applicationInstanceId int, requestData []byte) (int, data.ScheduleInfo, []schema.FieldError) {
+	var schedule data.ScheduleInfo
+	var serviceId ServiceIdentification
+	var spec *cron.Schedule
+
+	ok, request, jobRequest := splitScheduledRequest(requestData)
+	if !ok || json.Unmarshal(jobRequest, &serviceId) != nil {
+		return http.StatusBadRequest, schedule, scheduleError("request is not valid JSON")
+	}
+	if request.Cron == "" && request.NotBefore.IsZero() {
+		return http.StatusUnprocessableEntity, schedule, scheduleError("either not_before or cron is required")
+	}
+	if request.CatchUp == "" {
+		request.CatchUp = defaultCatchUpPolicy()
+	}
+	if request.CatchUp != CatchUpSkip && request.CatchUp != CatchUpOnce && request.CatchUp != CatchUpAll {
+		return http.StatusUnprocessableEntity, schedule, scheduleError("catch_up must be one of skip, once or all")
+	}
+	if request.Cron != "" {
+		if ok, spec = cron.Parse(request.Cron); !ok {
+			return http.StatusUnprocessableEntity, schedule, scheduleError("invalid cron expression")
+		}
+	}
+
+	if serviceId.ServiceType == JobTypePipeline {
+		if httpResponse, serviceDescription := pipelineServiceDescription(jobRequest); httpResponse != http.StatusOK {
+			return httpResponse, schedule, nil
+		} else if serviceDescription.RequiresUpload {
+			return http.StatusUnprocessableEntity, schedule, scheduleError("pipelines with a step that needs an upload can't be scheduled")
+		}
+	} else if serviceDescription, stE := acceptedServiceType(serviceId.ServiceType); !stE {
+		return http.StatusMethodNotAllowed, schedule, nil
+	} else if serviceDescription.RequiresUpload {
+		return http.StatusUnprocessableEntity, schedule, scheduleError("jobs that need an upload can't be scheduled")
+	} else if fieldErrors := validateJobRequest(serviceId.ServiceType, jobRequest); len(fieldErrors) > 0 {
+		return http.StatusUnprocessableEntity, schedule, fieldErrors
+	}
+
+	now := time.Now().UTC()
+	start := request.NotBefore.UTC().Truncate(time.Second)
+	if start.IsZero() {
+		start = now.Truncate(time.Second)
+	}
+	schedule = data.ScheduleInfo{
+		ApplicationId:         applicationId,
+		ApplicationInstanceId: applicationInstanceId,
+		ServiceType:           serviceId.ServiceType,
+		RequestData:           string(jobRequest),
+		NotBefore:             start,
+		Cron:                  request.Cron,
+		CatchUp:               request.CatchUp,
+		NextRun:               firstRun(spec, start),
+		State:                 ScheduleStateActive,
+		CreationDate:          now,
+	}
+	if schedule.NextRun.IsZero() {
+		return http.StatusUnprocessableEntity, data.ScheduleInfo{}, scheduleError("cron expression never matches")
+	}
+	schedule.ScheduleId = cydb.AddSchedule(schedule)
+	if schedule.ScheduleId <= 0 {
+		return http.StatusInternalServerError, data.ScheduleInfo{}, nil
+	}
+	data.Logger.Printf("SCHEDULE: created schedule %d for service type %d, first run at %s", schedule.ScheduleId, schedule.ServiceType, schedule.NextRun)
+	return http.StatusCreated, schedule, nil
+}
+
+func ListSchedules(applicationId int, applicationInstanceId int) (int, []data.ScheduleInfo) {
+	schedules := cydb.SchedulesForApplication(applicationId, applicationInstanceId)
+	if schedules == nil {
+		schedules = make([]data.ScheduleInfo, 0)
+	}
+	return http.StatusOK, schedules
+}
+
+func scheduleForApplication(applicationId int, applicationInstanceId int, scheduleId int) (int, data.ScheduleInfo) {
+	found, schedule := cydb.ScheduleForId(scheduleId)
+	if !found {
+		return http.StatusNotFound, data.ScheduleInfo{}
+	}
+	if schedule.ApplicationId != applicationId || schedule.ApplicationInstanceId != applicationInstanceId { // Don't try accessing other user's data
+		return http.StatusUnauthorized, data.ScheduleInfo{}
+	}
+	return http.StatusOK, schedule
+}
+
+/*
+ * CancelSchedule stops all future runs. Jobs that were already dispatched
+ * keep running.
+ */
+func CancelSchedule(applicationId int, applicationInstanceId int, scheduleId int) (int, data.ScheduleInfo) {
+	httpResponse, schedule := scheduleForApplication(applicationId, applicationInstanceId, scheduleId)
+	if httpResponse != http.StatusOK {
+		return httpResponse, schedule
+	}
+	if !cydb.UpdateScheduleState(scheduleId, ScheduleStateActive, ScheduleStateCancelled) {
+		return http.StatusConflict, schedule
+	}
+	schedule.State = ScheduleStateCancelled
+	data.Logger.Printf("SCHEDULE: schedule %d cancelled", scheduleId)
+	return http.StatusOK, schedule
+}
+
+/*
+ * ScheduleRuns lists the runs of a schedule. Results of synchronous services
+ * are kept with the run; for asynchronous ones the job id can be used to
+ * query the job as usual.
+ */
+func ScheduleRuns(applicationId int, applicationInstanceId int, scheduleId int) (int, ScheduleRunsResponse) {
+	var response ScheduleRunsResponse
+
+	httpResponse, schedule := scheduleForApplication(applicationId, applicationInstanceId, scheduleId)
+	if httpResponse != http.StatusOK {
+		return httpResponse, response
+	}
+	response.Schedule = schedule
+	response.Runs = make([]ScheduleRunResult, 0)
+	for _, run := range cydb.RunsForSchedule(scheduleId) {
+		runResult := ScheduleRunResult{ScheduleRunInfo: run}
+		if run.Result != "" && json.Valid([]byte(run.Result)) {
+			runResult.Result = json.RawMessage(run.Result)
+		}
+		response.Runs = append(response.Runs, runResult)
+	}
+	return http.StatusOK, response
+}
+
+/*
+ * plannedRuns returns the runs that are due now according to the catch-up
+ * policy, together with the next run and the state the schedule moves to.
+ * One-off schedules always run, however late they are.
+ */
+func plannedRuns(schedule data.ScheduleInfo, now time.Time) ([]time.Time, time.Time, int) {
+	var missed []time.Time
+
+	if schedule.Cron == "" {
+		return []time.Time{schedule.NextRun}, schedule.NextRun, ScheduleStateFinished
+	}
+	ok, spec := cron.Parse(schedule.Cron)
+	if !ok {
+		return nil, schedule.NextRun, ScheduleStateFinished
+	}
+	next := schedule.NextRun
+	for !next.IsZero() && !next.After(now) {
+		missed = append(missed, next)
+		next = spec.Next(next)
+	}
+	state := ScheduleStateActive
+	if next.IsZero() {
+		next = schedule.NextRun
+		state = ScheduleStateFinished
+	}
+	latest := missed[len(missed)-1]
+	switch schedule.CatchUp {
+	case CatchUpAll:
+		if len(missed) > schedulerMaxCatchUp() {
+			missed = missed[len(missed)-schedulerMaxCatchUp():]
+		}
+		return missed, next, state
+	case CatchUpSkip:
+		if now.Sub(latest) > 2*schedulerInterval() {
+			return nil, next, state
+		}
+	}
+	return []time.Time{latest}, next, state
+}
+
+func runScheduledJob(schedule data.ScheduleInfo, runTime time.Time) {
+	var jobResult data.JobResult
+	var result string
+
+	httpResponse, serviceDescription, tempJobData := newTempJob(schedule.ApplicationId, schedule.ApplicationInstanceId, []byte(schedule.RequestData))
+	if httpResponse == http.StatusOK && serviceDescription.RequiresUpload {
+		httpResponse = http.StatusUnprocessableEntity
+	}
+	if httpResponse == http.StatusOK {
+		tempJobData.JobId = cydb.AddNewJobInfo(tempJobData)
+		if tempJobData.JobId > 0 {
+			httpResponse, jobResult, _ = dispatchJob(context.Background(), serviceDescription, tempJobData)
+			if !serviceDescription.IsAsync {
+				result = jobResult.Payload
+			}
+		} else {
+			httpResponse = http.StatusInternalServerError
+		}
+	}
+	cydb.AddScheduleRun(schedule.ScheduleId, runTime, tempJobData.JobId, httpResponse, result)
+	data.Logger.Printf("SCHEDULE: schedule %d run for %s dispatched as job %d, code = %d", schedule.ScheduleId, runTime, tempJobData.JobId, httpResponse)
+}
+
+func runDueSchedule(schedule data.ScheduleInfo, now time.Time) {
+	runTimes, nextRun, state := plannedRuns(schedule, now)
+	if !cydb.ClaimScheduleRuns(schedule.ScheduleId, ScheduleStateActive, schedule.NextRun, nextRun, len(runTimes), state) {
+		return
+	}
+	if len(runTimes) == 0 {
+		data.Logger.Printf("SCHEDULE: skipped missed runs of schedule %d", schedule.ScheduleId)
+		return
+	}
+	go func() {
+		for _, runTime := range runTimes {
+			runScheduledJob(schedule, runTime)
+		}
+	}()
+}
+
+/*
+ * This function is called as a go-routine and dispatches the schedules that
+ * are due. It waits one interval before the first pass so the available
+ * services are known; after a downtime that pass sees all missed runs.
+ */
+func runScheduler() {
+	for {
+		time.Sleep(schedulerInterval())
+		now := time.Now().UTC()
+		for _, schedule := range cydb.DueSchedules(now, ScheduleStateActive) {
+			runDueSchedule(schedule, now)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+/*
+Outbound : The shared HTTP layer for all calls FE and SD make to other servers.
+
+All targets share one transport so connections are reused. Every target
+(e.g. "jobs", "storage", "sd") gets its own timeout and retry count, and every
+upstream host its own circuit breaker. While a breaker is open calls to that
+host fail immediately with a CircuitOpenError.
+*/
+package outbound
+
+import (
+	"context"
+	"data"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout             = 10000
+	defaultMaxRetries          = 2
+	defaultRetryBaseDelay      = 100
+	defaultMaxIdleConnsPerHost = 32
+	defaultBreakerFailures     = 5
+	defaultBreakerOpenTime     = 30
+)
+
+/*
+ * MaxRetries is a pointer so that 0, i.e. no retries, can be told apart
+ * from not set.
+ */
+type TargetConfig struct {
+	Timeout    int  `json:"timeout"`
+	MaxRetries *int `json:"max_retries"`
+}
+
+/*
+ * Timeouts and delays are given in milliseconds, the breaker open time in
+ * seconds. Zero values, and a missing max_retries, fall back to the
+ * defaults above.
+ */
+type OutboundConfig struct {
+	Timeout             int                     `json:"timeout"`
+	MaxRetries          *int                    `json:"max_retries"`
+	RetryBaseDelay      int                     `json:"retry_base_delay"`
+	MaxIdleConnsPerHost int                     `json:"max_idle_conns_per_host"`
+	BreakerFailures     int                     `json:"breaker_failures"`
+	BreakerOpenTime     int                     `json:"breaker_open_time"`
+	Targets             map[string]TargetConfig `json:"targets"`
+}
+
+type CircuitOpenError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open, retry after %s", e.Host, e.RetryAfter)
+}
+
+/*
+ * Remembers whether reading a streamed request body failed, e.g. because the
+ * client whose upload is passed on went away or sent too much. Such failures
+ * say nothing about the upstream host.
+ */
+type bodyReader struct {
+	io.ReadCloser
+	failed bool
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		r.failed = true
+	}
+	return n, err
+}
+
+type breaker struct {
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+type targetSettings struct {
+	timeout    int
+	maxRetries int
+}
+
+var configuration OutboundConfig
+var maxRetries int
+var transport *http.Transport
+var clients map[string]*http.Client
+var breakers map[string]*breaker
+var mutex sync.Mutex
+var initOnce sync.Once
+
+func withDefault(value int, defaultValue int) int {
+	if value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+func retriesWithDefault(value *int, defaultValue int) int {
+	if value != nil && *value >= 0 {
+		return *value
+	}
+	return defaultValue
+}
+
+func Init(c OutboundConfig) {
+	initOnce.Do(func() {
+		configuration = c
+		configuration.Timeout = withDefault(c.Timeout, defaultTimeout)
+		maxRetries = retriesWithDefault(c.MaxRetries, defaultMaxRetries)
+		configuration.RetryBaseDelay = withDefault(c.RetryBaseDelay, defaultRetryBaseDelay)
+		configuration.MaxIdleConnsPerHost = withDefault(c.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost)
+		configuration.BreakerFailures = withDefault(c.BreakerFailures, defaultBreakerFailures)
+		configuration.BreakerOpenTime = withDefault(c.BreakerOpenTime, defaultBreakerOpenTime)
+		transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        configuration.MaxIdleConnsPerHost * 4,
+			MaxIdleConnsPerHost: configuration.MaxIdleConnsPerHost,
+			IdleConnTimeout:     90 * time.Second,
+		}
+		clients = make(map[string]*http.Client)
+		breakers = make(map[string]*breaker)
+	})
+}
+
+func targetConfig(target string) targetSettings {
+	t := configuration.Targets[target]
+	return targetSettings{
+		timeout:    withDefault(t.Timeout, configuration.Timeout),
+		maxRetries: retriesWithDefault(t.MaxRetries, maxRetries),
+	}
+}
+
+func clientFor(target string) *http.Client {
+	mutex.Lock()
+	defer mutex.Unlock()
+	client, exists := clients[target]
+	if !exists {
+		client = &http.Client{Transport: transport, Timeout: time.Duration(targetConfig(target).timeout) * time.Millisecond}
+		clients[target] = client
+	}
+	return client
+}
+
+/*
+ * A server that answers its client with 503 because a call it made hit an
+ * open breaker can tell the client how long to wait: it makes its requests
+ * with a context from WithRetryHint, and Do notes there how long the
+ * breakers those requests hit stay open. Whatever else turns a request away
+ * for a while notes that with NoteRetryAfter.
+ */
+type retryHint struct {
+	mutex      sync.Mutex
+	retryAfter time.Duration
+}
+
+type retryHintKey struct{}
+
+func WithRetryHint(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryHintKey{}, &retryHint{})
+}
+
+func NoteRetryAfter(ctx context.Context, retryAfter time.Duration) {
+	hint, found := ctx.Value(retryHintKey{}).(*retryHint)
+	if !found {
+		return
+	}
+	hint.mutex.Lock()
+	defer hint.mutex.Unlock()
+	if retryAfter > hint.retryAfter {
+		hint.retryAfter = retryAfter
+	}
+}
+
+/*
+ * RetryHint returns the longest time an open breaker hit by a request made
+ * with ctx stays open, zero if none of them hit one.
+ */
+func RetryHint(ctx context.Context) time.Duration {
+	hint, found := ctx.Value(retryHintKey{}).(*retryHint)
+	if !found {
+		return 0
+	}
+	hint.mutex.Lock()
+	defer hint.mutex.Unlock()
+	return hint.retryAfter
+}
+
+func breakerFor(host string) *breaker {
+	mutex.Lock()
+	defer mutex.Unlock()
+	b, exists := breakers[host]
+	if !exists {
+		b = &breaker{}
+		breakers[host] = b
+	}
+	return b
+}
+
+/*
+ * A closed breaker lets everything through. Once its open time is over, a
+ * single probe is let through; its outcome closes or re-opens the breaker.
+ */
+func (b *breaker) allow() (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.openUntil.IsZero() {
+		return true, 0
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false, b.openUntil.Sub(now)
+	}
+	if b.probing {
+		return false, time.Second
+	}
+	b.probing = true
+	return true, 0
+}
+
+func (b *breaker) record(success bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+	if success {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failures++
+	if b.failures >= configuration.BreakerFailures || !b.openUntil.IsZero() {
+		b.openUntil = time.Now().Add(time.Duration(configuration.BreakerOpenTime) * time.Second)
+	}
+}
+
+/*
+ * release ends a probe without counting it either way.
+ */
+func (b *breaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) remaining() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.openUntil.IsZero() {
+		return 0
+	}
+	return b.openUntil.Sub(time.Now())
+}
+
+func isUpstreamFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func backoff(attempt int) time.Duration {
+	maxDelay := int64(configuration.RetryBaseDelay) << uint(attempt)
+	return time.Duration(maxDelay/2+rand.Int63n(maxDelay/2+1)) * time.Millisecond
+}
+
+/*
+ * Do sends a request to one of the configured targets. Idempotent requests
+ * are retried with jittered exponential backoff on connection errors and on
+ * 502, 503 and 504 responses; their body has to be re-readable, which is the
+ * case for requests created from a bytes.Buffer or bytes.Reader. Other
+ * bodies are streamed; if reading them fails the breaker is left alone.
+ */
+func Do(target string, req *http.Request, idempotent bool) (*http.Response, error) {
+	Init(OutboundConfig{})
+	settings := targetConfig(target)
+	client := clientFor(target)
+	b := breakerFor(req.URL.Host)
+	canRewind := req.Body == nil || req.GetBody != nil
+	var streamed *bodyReader
+	if !canRewind {
+		streamed = &bodyReader{ReadCloser: req.Body}
+		req.Body = streamed
+	}
+	for attempt := 0; ; attempt++ {
+		allowed, retryAfter := b.allow()
+		if !allowed {
+			NoteRetryAfter(req.Context(), retryAfter)
+			return nil, &CircuitOpenError{Host: req.URL.Host, RetryAfter: retryAfter}
+		}
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				b.release()
+				return nil, err
+			}
+			req.Body = body
+		}
+		resp, err := client.Do(req)
+		if streamed != nil && streamed.failed {
+			b.release()
+			return resp, err
+		}
+		failed := isUpstreamFailure(resp, err)
+		b.record(!failed)
+		if !failed || !idempotent || !canRewind || attempt >= settings.maxRetries {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		data.Logger.Printf("OUTBOUND: %s %s failed, retrying (%d/%d)", req.Method, req.URL.Host, attempt+1, settings.maxRetries)
+		time.Sleep(backoff(attempt))
+	}
+}
+
+/*
+ * Timeout returns the timeout requests to the target are sent with.
+ */
+func Timeout(target string) time.Duration {
+	Init(OutboundConfig{})
+	return time.Duration(targetConfig(target).timeout) * time.Millisecond
+}
+
+func IsCircuitOpen(err error) bool {
+	_, isOpen := err.(*CircuitOpenError)
+	return isOpen
+}
+
+/*
+ * StatusForError maps an error returned by Do to the status code callers
+ * should answer with: 503 while a breaker is open, 500 otherwise.
+ */
+func StatusForError(err error) int {
+	if IsCircuitOpen(err) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+/*
+ * IsAvailable reports whether calls to the given host (host:port) would be
+ * let through right now. Hosts nothing was sent to yet are available.
+ */
+func IsAvailable(host string) bool {
+	Init(OutboundConfig{})
+	mutex.Lock()
+	b, exists := breakers[host]
+	mutex.Unlock()
+	return !exists || b.remaining() <= 0
+}
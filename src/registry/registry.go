@@ -0,0 +1,456 @@
+/*
+Registry : The list of service instances registered with SD.
+
+The list is copy-on-write: every change builds a new list and bumps the
+version, so snapshots can be handed out and encoded without holding a lock.
+Callers must not modify the services of a snapshot. Every registration gets a
+new instance id and a lease; entries whose lease expired are removed by
+Expire. Watchers are sent every new snapshot.
+
+Besides the version of the service list the registry counts a revision,
+which also grows when a lease is renewed. Export and Import move the whole
+state, leases included, between the registries of an SD cluster.
+*/
+package registry
+
+import (
+	"data"
+	"fmt"
+	"github.com/twinj/uuid"
+	"sync"
+	"time"
+)
+
+const minLeaseTTL = 5 * time.Second
+
+type Snapshot struct {
+	Version  uint64
+	Services data.ServiceInfoList
+}
+
+/*
+ * State is everything a registry knows, as sent from one SD to another.
+ */
+type State struct {
+	Revision uint64               `json:"revision"`
+	Version  uint64               `json:"version"`
+	Services data.ServiceInfoList `json:"services"`
+	Leases   []LeaseState         `json:"leases"`
+}
+
+type LeaseState struct {
+	LeaseId    string        `json:"lease_id"`
+	InstanceId string        `json:"instance_id"`
+	TTL        time.Duration `json:"ttl"`
+	Expires    time.Time     `json:"expires"`
+	DrainUntil time.Time     `json:"drain_until"`
+}
+
+type lease struct {
+	id         string
+	instanceId string
+	ttl        time.Duration
+	expires    time.Time
+	drainUntil time.Time
+}
+
+type Registry struct {
+	mutex       sync.Mutex
+	snapshot    Snapshot
+	revision    uint64
+	leases      map[string]*lease
+	instances   map[string]*lease
+	defaultTTL  time.Duration
+	maxTTL      time.Duration
+	watchers    map[int]chan Snapshot
+	nextWatcher int
+}
+
+/*
+ * New returns an empty registry. Lease TTLs are given in seconds. Versions
+ * start at the current time, so they keep growing across restarts and a
+ * client's old index never matches by accident.
+ */
+func New(defaultTTL int, maxTTL int) *Registry {
+	return &Registry{
+		snapshot:   Snapshot{Version: uint64(time.Now().UnixNano()), Services: make(data.ServiceInfoList, 0)},
+		leases:     make(map[string]*lease),
+		instances:  make(map[string]*lease),
+		defaultTTL: time.Duration(defaultTTL) * time.Second,
+		maxTTL:     time.Duration(maxTTL) * time.Second,
+		watchers:   make(map[int]chan Snapshot),
+	}
+}
+
+func Address(service data.ServiceInfo) string {
+	return fmt.Sprintf("%s:%d", service.Server, service.Port)
+}
+
+/*
+ * A draining instance's lease is never renewed past the end of its drain
+ * period.
+ */
+func (l *lease) renew() {
+	l.expires = time.Now().Add(l.ttl)
+	if !l.drainUntil.IsZero() && l.expires.After(l.drainUntil) {
+		l.expires = l.drainUntil
+	}
+}
+
+func (l *lease) info() data.ServiceLease {
+	return data.ServiceLease{LeaseId: l.id, InstanceId: l.instanceId, TTL: int(l.ttl / time.Second), Expires: l.expires}
+}
+
+func (r *Registry) Snapshot() Snapshot {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.snapshot
+}
+
+/*
+ * Installs a new list of services and tells the watchers. A watcher that
+ * did not pick up the previous snapshot yet only gets the newest one.
+ * The mutex must be held.
+ */
+func (r *Registry) publish(services data.ServiceInfoList) {
+	r.install(Snapshot{Version: r.snapshot.Version + 1, Services: services})
+}
+
+/*
+ * The mutex must be held.
+ */
+func (r *Registry) install(snapshot Snapshot) {
+	r.snapshot = snapshot
+	r.revision++
+	for _, watcher := range r.watchers {
+		select {
+		case <-watcher:
+		default:
+		}
+		watcher <- r.snapshot
+	}
+}
+
+/*
+ * The mutex must be held.
+ */
+func (r *Registry) grantLease(instanceId string, ttl time.Duration) data.ServiceLease {
+	if ttl <= 0 {
+		ttl = r.defaultTTL
+	}
+	if ttl < minLeaseTTL {
+		ttl = minLeaseTTL
+	}
+	if ttl > r.maxTTL {
+		ttl = r.maxTTL
+	}
+	l := &lease{id: uuid.NewV4().String(), instanceId: instanceId, ttl: ttl, expires: time.Now().Add(ttl)}
+	r.leases[l.id] = l
+	r.instances[instanceId] = l
+	return l.info()
+}
+
+/*
+ * The mutex must be held.
+ */
+func (r *Registry) releaseLease(instanceId string) {
+	if l, exists := r.instances[instanceId]; exists {
+		delete(r.leases, l.id)
+		delete(r.instances, instanceId)
+	}
+}
+
+/*
+ * Removes the given instances. The mutex must be held.
+ */
+func (r *Registry) remove(instanceIds map[string]bool) bool {
+	var newS data.ServiceInfoList = make(data.ServiceInfoList, 0, len(r.snapshot.Services))
+
+	for _, service := range r.snapshot.Services {
+		if instanceIds[service.InstanceId] {
+			r.releaseLease(service.InstanceId)
+		} else {
+			newS = append(newS, service)
+		}
+	}
+	if len(newS) == len(r.snapshot.Services) {
+		return false
+	}
+	r.publish(newS)
+	return true
+}
+
+/*
+ * Load replaces the registry's content with services stored before a
+ * restart. Their leases are unknown to the services, so they have to
+ * register again within the maximum lease TTL or disappear.
+ */
+func (r *Registry) Load(services data.ServiceInfoList) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	loaded := make(data.ServiceInfoList, 0, len(services))
+	for _, service := range services {
+		if service.InstanceId == "" {
+			service.InstanceId = uuid.NewV4().String()
+		}
+		r.grantLease(service.InstanceId, r.maxTTL)
+		loaded = append(loaded, service)
+	}
+	r.publish(loaded)
+}
+
+/*
+ * Register adds a new instance and returns it with its instance id, together
+ * with its lease. An instance registered before at the same address is
+ * replaced.
+ */
+func (r *Registry) Register(service data.ServiceInfo) (data.ServiceInfo, data.ServiceLease) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	address := Address(service)
+	newS := make(data.ServiceInfoList, 0, len(r.snapshot.Services)+1)
+	for _, existing := range r.snapshot.Services {
+		if existing.Port > 0 && Address(existing) != address {
+			newS = append(newS, existing)
+		} else {
+			r.releaseLease(existing.InstanceId)
+		}
+	}
+	service.InstanceId = uuid.NewV4().String()
+	serviceLease := r.grantLease(service.InstanceId, time.Duration(service.LeaseTTL)*time.Second)
+	r.publish(append(newS, service))
+	return service, serviceLease
+}
+
+/*
+ * The mutex must be held.
+ */
+func (r *Registry) service(instanceId string) (bool, data.ServiceInfo) {
+	for _, service := range r.snapshot.Services {
+		if service.InstanceId == instanceId {
+			return true, service
+		}
+	}
+	return false, data.ServiceInfo{}
+}
+
+func (r *Registry) Instance(instanceId string) (bool, data.ServiceInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.service(instanceId)
+}
+
+/*
+ * InstanceForLease returns the instance holding the lease.
+ */
+func (r *Registry) InstanceForLease(leaseId string) (bool, data.ServiceInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	l, exists := r.leases[leaseId]
+	if !exists {
+		return false, data.ServiceInfo{}
+	}
+	return r.service(l.instanceId)
+}
+
+func (r *Registry) Renew(leaseId string) (bool, data.ServiceLease) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	l, exists := r.leases[leaseId]
+	if !exists {
+		return false, data.ServiceLease{}
+	}
+	l.renew()
+	r.revision++
+	return true, l.info()
+}
+
+/*
+ * Extend renews the lease of an instance on its behalf, e.g. after it
+ * answered a heartbeat probe.
+ */
+func (r *Registry) Extend(instanceId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if l, exists := r.instances[instanceId]; exists {
+		l.renew()
+		r.revision++
+	}
+}
+
+/*
+ * Deregister removes the instance holding the lease and returns it.
+ */
+func (r *Registry) Deregister(leaseId string) (bool, data.ServiceInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	l, exists := r.leases[leaseId]
+	if !exists {
+		return false, data.ServiceInfo{}
+	}
+	if found, service := r.service(l.instanceId); found {
+		r.remove(map[string]bool{l.instanceId: true})
+		return true, service
+	}
+	r.releaseLease(l.instanceId)
+	return false, data.ServiceInfo{}
+}
+
+/*
+ * Drain marks an instance as draining. It stays registered until it
+ * deregisters or the drain timeout (in seconds) is over, whichever comes
+ * first.
+ */
+func (r *Registry) Drain(instanceId string, timeout int) (bool, data.ServiceInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var drained data.ServiceInfo
+	found := false
+	newS := make(data.ServiceInfoList, 0, len(r.snapshot.Services))
+	for _, service := range r.snapshot.Services {
+		if service.InstanceId == instanceId {
+			service.State = data.ServiceStateDraining
+			drained = service
+			found = true
+		}
+		newS = append(newS, service)
+	}
+	if !found {
+		return false, drained
+	}
+	if l, exists := r.instances[instanceId]; exists {
+		l.drainUntil = time.Now().Add(time.Duration(timeout) * time.Second)
+		if l.expires.After(l.drainUntil) {
+			l.expires = l.drainUntil
+		}
+	}
+	r.publish(newS)
+	return true, drained
+}
+
+func (r *Registry) Remove(instanceIds ...string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	toRemove := make(map[string]bool)
+	for _, instanceId := range instanceIds {
+		toRemove[instanceId] = true
+	}
+	return r.remove(toRemove)
+}
+
+/*
+ * Expire removes every instance whose lease ran out before now and returns
+ * the removed instances.
+ */
+func (r *Registry) Expire(now time.Time) data.ServiceInfoList {
+	var removed data.ServiceInfoList
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	expired := make(map[string]bool)
+	for _, l := range r.leases {
+		if now.After(l.expires) {
+			expired[l.instanceId] = true
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	for _, service := range r.snapshot.Services {
+		if expired[service.InstanceId] {
+			removed = append(removed, service)
+		}
+	}
+	r.remove(expired)
+	for instanceId := range expired {
+		r.releaseLease(instanceId)
+	}
+	return removed
+}
+
+/*
+ * Watch subscribes to changes. The returned channel first receives the
+ * current snapshot, then every new one; the returned function ends the
+ * subscription.
+ */
+func (r *Registry) Watch() (<-chan Snapshot, func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	id := r.nextWatcher
+	r.nextWatcher++
+	watcher := make(chan Snapshot, 1)
+	watcher <- r.snapshot
+	r.watchers[id] = watcher
+	return watcher, func() {
+		r.mutex.Lock()
+		delete(r.watchers, id)
+		r.mutex.Unlock()
+	}
+}
+
+/*
+ * Wait returns as soon as the registry's version differs from index, when
+ * the timeout is over or when done is closed, whichever comes first. It
+ * always returns the current snapshot.
+ */
+func (r *Registry) Wait(index uint64, timeout time.Duration, done <-chan struct{}) Snapshot {
+	changes, stop := r.Watch()
+	defer stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case snapshot := <-changes:
+			if snapshot.Version != index {
+				return snapshot
+			}
+		case <-timer.C:
+			return r.Snapshot()
+		case <-done:
+			return r.Snapshot()
+		}
+	}
+}
+
+/*
+ * Revision grows with every change, including lease renewals that leave the
+ * service list as it is.
+ */
+func (r *Registry) Revision() uint64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.revision
+}
+
+func (r *Registry) Export() State {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	leases := make([]LeaseState, 0, len(r.leases))
+	for _, l := range r.leases {
+		leases = append(leases, LeaseState{LeaseId: l.id, InstanceId: l.instanceId, TTL: l.ttl, Expires: l.expires, DrainUntil: l.drainUntil})
+	}
+	return State{Revision: r.revision, Version: r.snapshot.Version, Services: r.snapshot.Services, Leases: leases}
+}
+
+/*
+ * Import replaces the registry's content with a state exported by another
+ * registry. Watchers only hear about it if the service list changed.
+ */
+func (r *Registry) Import(state State) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.leases = make(map[string]*lease)
+	r.instances = make(map[string]*lease)
+	for _, ls := range state.Leases {
+		l := &lease{id: ls.LeaseId, instanceId: ls.InstanceId, ttl: ls.TTL, expires: ls.Expires, drainUntil: ls.DrainUntil}
+		r.leases[l.id] = l
+		r.instances[l.instanceId] = l
+	}
+	if state.Services == nil {
+		state.Services = make(data.ServiceInfoList, 0)
+	}
+	if state.Version != r.snapshot.Version {
+		r.install(Snapshot{Version: state.Version, Services: state.Services})
+	}
+	r.revision = state.Revision
+}
@@ -0,0 +1,232 @@
+package registry
+
+import (
+	"data"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testService(port int) data.ServiceInfo {
+	return data.ServiceInfo{ServiceType: 1, Server: "127.0.0.1", Port: port, LeaseTTL: 10}
+}
+
+func TestRegisterRenewExpire(t *testing.T) {
+	r := New(10, 60)
+	service, lease := r.Register(testService(8000))
+	if service.InstanceId == "" || lease.LeaseId == "" || lease.InstanceId != service.InstanceId {
+		t.Fatalf("register returned %+v with lease %+v", service, lease)
+	}
+	if services := r.Snapshot().Services; len(services) != 1 || services[0].InstanceId != service.InstanceId {
+		t.Fatalf("snapshot holds %+v", services)
+	}
+	renewed, renewedLease := r.Renew(lease.LeaseId)
+	if !renewed || renewedLease.Expires.Before(lease.Expires) {
+		t.Fatalf("renew returned %v, %+v", renewed, renewedLease)
+	}
+	if removed := r.Expire(time.Now()); len(removed) != 0 {
+		t.Fatalf("expired a live lease: %+v", removed)
+	}
+	removed := r.Expire(renewedLease.Expires.Add(time.Second))
+	if len(removed) != 1 || removed[0].InstanceId != service.InstanceId {
+		t.Fatalf("expire removed %+v", removed)
+	}
+	if services := r.Snapshot().Services; len(services) != 0 {
+		t.Fatalf("snapshot still holds %+v", services)
+	}
+	if renewed, _ := r.Renew(lease.LeaseId); renewed {
+		t.Fatal("an expired lease was renewed")
+	}
+}
+
+func TestRegisterReplacesSameAddress(t *testing.T) {
+	r := New(10, 60)
+	first, firstLease := r.Register(testService(8000))
+	second, _ := r.Register(testService(8000))
+	r.Register(testService(8001))
+	if first.InstanceId == second.InstanceId {
+		t.Fatal("instance id was reused")
+	}
+	if found, _ := r.Instance(first.InstanceId); found {
+		t.Fatal("replaced instance is still registered")
+	}
+	if renewed, _ := r.Renew(firstLease.LeaseId); renewed {
+		t.Fatal("lease of the replaced instance was renewed")
+	}
+	if services := r.Snapshot().Services; len(services) != 2 {
+		t.Fatalf("snapshot holds %d services, want 2", len(services))
+	}
+}
+
+func TestRenewKeepsVersion(t *testing.T) {
+	r := New(10, 60)
+	_, lease := r.Register(testService(8000))
+	version := r.Snapshot().Version
+	revision := r.Revision()
+	r.Renew(lease.LeaseId)
+	if r.Snapshot().Version != version {
+		t.Fatal("renewing a lease changed the version")
+	}
+	if r.Revision() <= revision {
+		t.Fatal("renewing a lease did not change the revision")
+	}
+}
+
+func TestDrainLimitsLease(t *testing.T) {
+	r := New(60, 60)
+	service, lease := r.Register(data.ServiceInfo{Server: "127.0.0.1", Port: 8000, LeaseTTL: 60})
+	drained, drainedService := r.Drain(service.InstanceId, 1)
+	if !drained || drainedService.State != data.ServiceStateDraining {
+		t.Fatalf("drain returned %v, %+v", drained, drainedService)
+	}
+	_, renewedLease := r.Renew(lease.LeaseId)
+	if renewedLease.Expires.After(time.Now().Add(2 * time.Second)) {
+		t.Fatalf("lease of a draining instance renewed until %s", renewedLease.Expires)
+	}
+	if removed := r.Expire(time.Now().Add(2 * time.Second)); len(removed) != 1 {
+		t.Fatalf("expire removed %+v after the drain timeout", removed)
+	}
+}
+
+func TestWatchSkipsToNewest(t *testing.T) {
+	r := New(10, 60)
+	changes, stop := r.Watch()
+	initial := <-changes
+	for port := 8000; port < 8005; port++ {
+		r.Register(testService(port))
+	}
+	newest := <-changes
+	if newest.Version != initial.Version+5 || len(newest.Services) != 5 {
+		t.Fatalf("watcher got version %d with %d services, want %d with 5", newest.Version, len(newest.Services), initial.Version+5)
+	}
+	stop()
+	r.Register(testService(8005))
+	select {
+	case snapshot := <-changes:
+		t.Fatalf("stopped watcher got version %d", snapshot.Version)
+	default:
+	}
+}
+
+func TestWait(t *testing.T) {
+	r := New(10, 60)
+	version := r.Snapshot().Version
+	if snapshot := r.Wait(version, 10*time.Millisecond, nil); snapshot.Version != version {
+		t.Fatalf("wait without a change returned version %d", snapshot.Version)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.Register(testService(8000))
+	}()
+	if snapshot := r.Wait(version, 5*time.Second, nil); snapshot.Version == version {
+		t.Fatal("wait did not return the change")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	r := New(10, 60)
+	_, lease := r.Register(testService(8000))
+	r.Register(testService(8001))
+	other := New(10, 60)
+	other.Import(r.Export())
+	if other.Snapshot().Version != r.Snapshot().Version || len(other.Snapshot().Services) != 2 {
+		t.Fatal("import did not take the service list")
+	}
+	if renewed, _ := other.Renew(lease.LeaseId); !renewed {
+		t.Fatal("import did not take the leases")
+	}
+}
+
+/*
+ * Registers, renews, deregisters and expires from many goroutines while
+ * others watch and encode snapshots; meant to be run with -race.
+ */
+func TestConcurrentUse(t *testing.T) {
+	const workers = 8
+	const rounds = 50
+
+	r := New(10, 60)
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			changes, stop := r.Watch()
+			defer stop()
+			var last uint64
+			for {
+				select {
+				case snapshot := <-changes:
+					if snapshot.Version <= last {
+						t.Errorf("watcher got version %d after %d", snapshot.Version, last)
+					}
+					last = snapshot.Version
+					if _, err := json.Marshal(snapshot.Services); err != nil {
+						t.Errorf("snapshot not encoded: %s", err)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				snapshot := r.Snapshot()
+				for _, service := range snapshot.Services {
+					_ = Address(service)
+				}
+				r.Expire(time.Now())
+				r.Export()
+			}
+		}
+	}()
+
+	var writers sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < rounds; i++ {
+				service, lease := r.Register(testService(9000 + w))
+				if renewed, _ := r.Renew(lease.LeaseId); !renewed {
+					t.Errorf("lease %s of worker %d not renewed", lease.LeaseId, w)
+				}
+				r.Extend(service.InstanceId)
+				if i%2 == 0 {
+					if found, _ := r.Deregister(lease.LeaseId); !found {
+						t.Errorf("instance %s of worker %d not deregistered", service.InstanceId, w)
+					}
+				}
+			}
+		}(w)
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	snapshot := r.Snapshot()
+	if len(snapshot.Services) != workers {
+		t.Fatalf("%d services left, want %d", len(snapshot.Services), workers)
+	}
+	leases := make(map[string]bool)
+	for _, l := range r.Export().Leases {
+		leases[l.InstanceId] = true
+	}
+	for _, service := range snapshot.Services {
+		if !leases[service.InstanceId] {
+			t.Errorf("instance %s has no lease", service.InstanceId)
+		}
+	}
+	if removed := r.Expire(time.Now().Add(time.Minute)); len(removed) != workers {
+		t.Fatalf("expire removed %d services, want %d", len(removed), workers)
+	}
+}
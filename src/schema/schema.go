@@ -0,0 +1,225 @@
+/*
+Schema : A small JSON Schema validator for job requests.
+
+Only the keywords services actually use are supported: type, properties,
+required, additionalProperties, items, enum, minimum, maximum, minLength,
+maxLength, pattern, minItems and maxItems. Unknown keywords are ignored.
+*/
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type Schema struct {
+	Type                 json.RawMessage    `json:"type"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Pattern              string             `json:"pattern"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+
+	types      []string
+	additional *Schema
+	noExtra    bool
+	pattern    *regexp.Regexp
+}
+
+/*
+ * Parse decodes a schema and prepares it for validation. It fails if the
+ * schema is not a JSON object or uses a keyword with an invalid value.
+ */
+func Parse(raw []byte) (bool, *Schema) {
+	var s Schema
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return false, nil
+	}
+	if !s.compile() {
+		return false, nil
+	}
+	return true, &s
+}
+
+func (s *Schema) compile() bool {
+	if len(s.Type) > 0 {
+		var single string
+		if json.Unmarshal(s.Type, &single) == nil {
+			s.types = []string{single}
+		} else if json.Unmarshal(s.Type, &s.types) != nil {
+			return false
+		}
+	}
+	if len(s.AdditionalProperties) > 0 {
+		var allowed bool
+		if json.Unmarshal(s.AdditionalProperties, &allowed) == nil {
+			s.noExtra = !allowed
+		} else {
+			s.additional = &Schema{}
+			if json.Unmarshal(s.AdditionalProperties, s.additional) != nil || !s.additional.compile() {
+				return false
+			}
+		}
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return false
+		}
+		s.pattern = re
+	}
+	for _, property := range s.Properties {
+		if property == nil || !property.compile() {
+			return false
+		}
+	}
+	if s.Items != nil && !s.Items.compile() {
+		return false
+	}
+	return true
+}
+
+/*
+ * Validate checks a JSON document against the schema and returns one error
+ * per offending field. Fields are named by their dot separated path, the
+ * document itself is "$".
+ */
+func (s *Schema) Validate(document []byte) []FieldError {
+	var value interface{}
+	if err := json.Unmarshal(document, &value); err != nil {
+		return []FieldError{{Field: "$", Message: "request is not valid JSON"}}
+	}
+	return s.validate("$", value, nil)
+}
+
+func childPath(path string, element string) string {
+	if path == "$" {
+		return element
+	}
+	return path + "." + element
+}
+
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+func (s *Schema) hasType(actual string) bool {
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, t := range s.types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schema) validate(path string, value interface{}, errors []FieldError) []FieldError {
+	actual := typeOf(value)
+	if !s.hasType(actual) {
+		return append(errors, FieldError{Field: path, Message: fmt.Sprintf("must be of type %s, not %s", string(s.Type), actual)})
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		encoded, _ := json.Marshal(value)
+		for _, allowed := range s.Enum {
+			allowedEncoded, _ := json.Marshal(allowed)
+			if string(encoded) == string(allowedEncoded) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errors = append(errors, FieldError{Field: path, Message: "is not one of the allowed values"})
+		}
+	}
+
+	switch v := value.(type) {
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			errors = append(errors, FieldError{Field: path, Message: fmt.Sprintf("must be at least %v", *s.Minimum)})
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			errors = append(errors, FieldError{Field: path, Message: fmt.Sprintf("must be at most %v", *s.Maximum)})
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			errors = append(errors, FieldError{Field: path, Message: fmt.Sprintf("must be at least %d characters long", *s.MinLength)})
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			errors = append(errors, FieldError{Field: path, Message: fmt.Sprintf("must be at most %d characters long", *s.MaxLength)})
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			errors = append(errors, FieldError{Field: path, Message: fmt.Sprintf("must match pattern %s", s.Pattern)})
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			errors = append(errors, FieldError{Field: path, Message: fmt.Sprintf("must contain at least %d items", *s.MinItems)})
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			errors = append(errors, FieldError{Field: path, Message: fmt.Sprintf("must contain at most %d items", *s.MaxItems)})
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				errors = s.Items.validate(childPath(path, strconv.Itoa(i)), item, errors)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, present := v[name]; !present {
+				errors = append(errors, FieldError{Field: childPath(path, name), Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property := v[name]
+			if propertySchema, known := s.Properties[name]; known {
+				errors = propertySchema.validate(childPath(path, name), property, errors)
+			} else if s.additional != nil {
+				errors = s.additional.validate(childPath(path, name), property, errors)
+			} else if s.noExtra {
+				errors = append(errors, FieldError{Field: childPath(path, name), Message: "is not allowed"})
+			}
+		}
+	}
+	return errors
+}
@@ -0,0 +1,295 @@
+/*
+Sdauth : Who may register services with SD, and the audit log of who did.
+
+Every credential has a name, a shared token and/or the names of the client
+certificates it accepts, and the hosts and service types it may register.
+Tokens are sent as "Authorization: Bearer <token>"; client certificates are
+only seen on SD's TLS listener, which verifies them against the configured
+CA. A certificate's name is its common name or any of its DNS names.
+
+Host patterns use path.Match syntax ("10.0.2.*", "*.vision.internal"); a
+pattern containing a port is matched against host:port. Every credential
+needs at least one, "*" allows any host. Without service types a credential
+may register all of them. The host of the
+service and that of its heartbeat URL must both be allowed, as SD calls the
+latter itself.
+*/
+package sdauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"data"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Set by a cluster member that authenticated a request before passing it on
+ * to the leader. It is only believed on requests from cluster members.
+ */
+const ForwardedCredentialHeader = "X-SD-Credential"
+
+type Credential struct {
+	Name         string   `json:"name"`
+	Token        string   `json:"token"`
+	TokenSHA256  string   `json:"token_sha256"`
+	CertNames    []string `json:"cert_names"`
+	Hosts        []string `json:"hosts"`
+	ServiceTypes []int    `json:"service_types"`
+	tokenHash    []byte
+}
+
+type TLSConfig struct {
+	ListenPort   int    `json:"listen_port"`
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+/*
+ * Without require_auth anybody may register, as before; the audit log is
+ * written anyway. An empty audit_log writes it to SD's log.
+ */
+type RegistrationConfig struct {
+	RequireAuth bool         `json:"require_auth"`
+	Credentials []Credential `json:"credentials"`
+	TLS         TLSConfig    `json:"tls"`
+	AuditLog    string       `json:"audit_log"`
+}
+
+type AuditEntry struct {
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"`
+	Outcome      string    `json:"outcome"`
+	Credential   string    `json:"credential,omitempty"`
+	Remote       string    `json:"remote,omitempty"`
+	ForwardedFor string    `json:"forwarded_for,omitempty"`
+	ServiceType  int       `json:"service_type,omitempty"`
+	Address      string    `json:"address,omitempty"`
+	InstanceId   string    `json:"instance_id,omitempty"`
+}
+
+var configuration RegistrationConfig
+var credentials map[string]*Credential
+var auditMutex sync.Mutex
+var auditFile *os.File
+
+/*
+ * Init checks the credentials and opens the audit log. It fails on
+ * credentials without a name, without a way to authenticate or without
+ * valid host patterns.
+ */
+func Init(c RegistrationConfig) bool {
+	configuration = c
+	credentials = make(map[string]*Credential)
+	for i := range configuration.Credentials {
+		credential := &configuration.Credentials[i]
+		if credential.Name == "" || credentials[credential.Name] != nil {
+			data.Logger.Printf("SDAUTH: every credential needs a unique name")
+			return false
+		}
+		if credential.TokenSHA256 != "" {
+			hash, err := hex.DecodeString(credential.TokenSHA256)
+			if err != nil || len(hash) != sha256.Size {
+				data.Logger.Printf("SDAUTH: credential %s has an invalid token_sha256", credential.Name)
+				return false
+			}
+			credential.tokenHash = hash
+		} else if credential.Token != "" {
+			hash := sha256.Sum256([]byte(credential.Token))
+			credential.tokenHash = hash[:]
+		} else if len(credential.CertNames) == 0 {
+			data.Logger.Printf("SDAUTH: credential %s has neither a token nor certificate names", credential.Name)
+			return false
+		}
+		if len(credential.Hosts) == 0 {
+			data.Logger.Printf("SDAUTH: credential %s has no host patterns", credential.Name)
+			return false
+		}
+		for _, pattern := range credential.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				data.Logger.Printf("SDAUTH: credential %s has an invalid host pattern %q", credential.Name, pattern)
+				return false
+			}
+		}
+		credentials[credential.Name] = credential
+	}
+	if configuration.AuditLog != "" {
+		file, err := os.OpenFile(configuration.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			data.Logger.Printf("SDAUTH: can't open audit log %s: %s", configuration.AuditLog, err)
+			return false
+		}
+		auditFile = file
+	}
+	return true
+}
+
+/*
+ * ServerTLSConfig returns the configuration of the TLS listener. Client
+ * certificates are optional there, so token holders can use it as well.
+ */
+func ServerTLSConfig() (bool, *tls.Config) {
+	if configuration.TLS.ClientCAFile == "" {
+		return true, &tls.Config{}
+	}
+	caCerts, err := ioutil.ReadFile(configuration.TLS.ClientCAFile)
+	if err != nil {
+		return false, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCerts) {
+		return false, nil
+	}
+	return true, &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+}
+
+func TLSSettings() TLSConfig {
+	return configuration.TLS
+}
+
+func bearerToken(req *http.Request) string {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+func credentialForToken(token string) *Credential {
+	var found *Credential
+	hash := sha256.Sum256([]byte(token))
+	for _, credential := range credentials {
+		if credential.tokenHash != nil && subtle.ConstantTimeCompare(hash[:], credential.tokenHash) == 1 {
+			found = credential
+		}
+	}
+	return found
+}
+
+func credentialForCertificate(cert *x509.Certificate) *Credential {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, credential := range credentials {
+		for _, accepted := range credential.CertNames {
+			for _, name := range names {
+				if name != "" && name == accepted {
+					return credential
+				}
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * Authenticate returns the credential a request was made with. If
+ * registration needs no authentication, requests without credentials pass
+ * with a nil credential; requests with unknown credentials never pass.
+ * fromClusterMember tells whether the request comes from another member of
+ * SD's cluster, whose forwarded credential name is taken as is.
+ */
+func Authenticate(req *http.Request, fromClusterMember bool) (bool, *Credential) {
+	if name := req.Header.Get(ForwardedCredentialHeader); name != "" && fromClusterMember {
+		credential, known := credentials[name]
+		return known, credential
+	}
+	if token := bearerToken(req); token != "" {
+		credential := credentialForToken(token)
+		return credential != nil, credential
+	}
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		credential := credentialForCertificate(req.TLS.VerifiedChains[0][0])
+		return credential != nil, credential
+	}
+	return !configuration.RequireAuth, nil
+}
+
+func (c *Credential) hostAllowed(host string, port string) bool {
+	hostPort := net.JoinHostPort(host, port)
+	for _, pattern := range c.Hosts {
+		candidate := host
+		if strings.Contains(pattern, ":") {
+			candidate = hostPort
+		}
+		if matched, _ := path.Match(pattern, candidate); matched {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Permits tells whether the credential may register, renew or remove the
+ * service. A nil credential is only given out if no authentication is
+ * required and may do everything.
+ */
+func (c *Credential) Permits(service data.ServiceInfo) (bool, string) {
+	if c == nil {
+		return true, ""
+	}
+	if len(c.ServiceTypes) > 0 {
+		allowed := false
+		for _, serviceType := range c.ServiceTypes {
+			allowed = allowed || serviceType == service.ServiceType
+		}
+		if !allowed {
+			return false, fmt.Sprintf("service type %d not allowed", service.ServiceType)
+		}
+	}
+	if !c.hostAllowed(service.Server, fmt.Sprint(service.Port)) {
+		return false, fmt.Sprintf("address %s not allowed", net.JoinHostPort(service.Server, fmt.Sprint(service.Port)))
+	}
+	if service.HeartbeatURL != "" {
+		heartbeat, err := url.Parse(service.HeartbeatURL)
+		if err != nil || !c.hostAllowed(heartbeat.Hostname(), heartbeat.Port()) {
+			return false, "heartbeat host not allowed"
+		}
+	}
+	return true, ""
+}
+
+func (c *Credential) CredentialName() string {
+	if c == nil {
+		return ""
+	}
+	return c.Name
+}
+
+/*
+ * Audit records a registration, a removal or a refused attempt. Requests
+ * are nil for removals SD makes on its own, e.g. when a lease expired.
+ */
+func Audit(req *http.Request, event string, outcome string, credential *Credential, service data.ServiceInfo) {
+	entry := AuditEntry{Time: time.Now().UTC(), Event: event, Outcome: outcome, Credential: credential.CredentialName(), ServiceType: service.ServiceType, InstanceId: service.InstanceId}
+	if service.Server != "" {
+		entry.Address = net.JoinHostPort(service.Server, fmt.Sprint(service.Port))
+	}
+	if req != nil {
+		entry.Remote = req.RemoteAddr
+		entry.ForwardedFor = req.Header.Get("X-Forwarded-For")
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if auditFile != nil {
+		auditFile.Write(append(line, '\n'))
+	} else {
+		data.Logger.Printf("AUDIT: %s", line)
+	}
+}
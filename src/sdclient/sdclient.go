@@ -0,0 +1,128 @@
+/*
+Sdclient : Client for the available-services endpoint of SD.
+
+Fetch asks for the current list of services. Watch keeps a blocking query
+open and hands over every new list as soon as SD has it, so consumers no
+longer have to poll. Requests go through the outbound target "sd-watch";
+the wait time is kept below that target's timeout.
+*/
+package sdclient
+
+import (
+	"data"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"outbound"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * The header SD sends the registry version (the index) in.
+ */
+const IndexHeader = "X-SD-Index"
+
+const (
+	watchTarget          = "sd-watch"
+	defaultWait          = 300 * time.Second
+	timeoutMargin        = 5 * time.Second
+	minRetryDelay        = time.Second
+	maxRetryDelay        = 30 * time.Second
+	fallbackPollInterval = 15 * time.Second
+)
+
+type Client struct {
+	availableServicesURL string
+	wait                 time.Duration
+}
+
+/*
+ * A wait of 0 means the default of five minutes.
+ */
+func New(availableServicesURL string, wait time.Duration) *Client {
+	return &Client{availableServicesURL: availableServicesURL, wait: wait}
+}
+
+func (c *Client) waitTime() time.Duration {
+	wait := c.wait
+	if wait <= 0 {
+		wait = defaultWait
+	}
+	if limit := outbound.Timeout(watchTarget) - timeoutMargin; wait > limit {
+		wait = limit
+	}
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+/*
+ * Fetch returns the available services together with their index. With an
+ * index other than 0 it blocks until the list differs from the one with that
+ * index or the wait time is over. An SD that does not know about indexes
+ * answers right away with index 0.
+ */
+func (c *Client) Fetch(index uint64) (bool, data.ServiceInfoList, uint64) {
+	var services data.ServiceInfoList
+
+	requestURL := c.availableServicesURL
+	if index > 0 {
+		query := url.Values{}
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(c.waitTime()/time.Second)))
+		separator := "?"
+		if strings.Contains(requestURL, "?") {
+			separator = "&"
+		}
+		requestURL += separator + query.Encode()
+	}
+	req, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return false, nil, index
+	}
+	resp, err := outbound.Do(watchTarget, req, true)
+	if err != nil {
+		return false, nil, index
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&services) != nil {
+		return false, nil, index
+	}
+	newIndex, err := strconv.ParseUint(resp.Header.Get(IndexHeader), 10, 64)
+	if err != nil {
+		newIndex = 0
+	}
+	return true, services, newIndex
+}
+
+/*
+ * Watch calls changed with every list of services newer than index. It
+ * never returns and is meant to run as a go-routine. Failed requests are
+ * retried with a growing delay; an SD without index support is polled.
+ */
+func (c *Client) Watch(index uint64, changed func(data.ServiceInfoList, uint64)) {
+	delay := minRetryDelay
+	for {
+		ok, services, newIndex := c.Fetch(index)
+		if !ok {
+			data.Logger.Printf("SDCLIENT: available services not reachable, retrying in %s", delay)
+			time.Sleep(delay)
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+			continue
+		}
+		delay = minRetryDelay
+		if newIndex == 0 {
+			changed(services, 0)
+			time.Sleep(fallbackPollInterval)
+		} else if newIndex != index {
+			changed(services, newIndex)
+		}
+		index = newIndex
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Signedurl : Download links to ss that carry their own permission.
+
+FE signs a link for one stored file with a key it shares with ss; ss then
+hands the file to whoever has the link, without asking FE, until the link
+expires. The signature is an HMAC-SHA256 over the application, its
+instance, the identifier of the file, the expiry and, for a link that may
+only be used once, a random nonce:
+
+	/1.0/signed/<applicationId>/<applicationInstanceId>/<identifier>?expires=<unix time>&once=<nonce>&signature=<hex>
+*/
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	ExpiresParam   = "expires"
+	OnceParam      = "once"
+	SignatureParam = "signature"
+)
+
+const nonceLength = 16
+
+func signature(key []byte, applicationId int, applicationInstanceId int, identifier string, expires int64, nonce string) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d\n%d\n%s\n%d\n%s", applicationId, applicationInstanceId, identifier, expires, nonce)
+	return mac.Sum(nil)
+}
+
+/*
+ * Path is where ss serves signed links, below its root URL.
+ */
+func Path(applicationId int, applicationInstanceId int, identifier string) string {
+	return fmt.Sprintf("/signed/%d/%d/%s", applicationId, applicationInstanceId, url.PathEscape(identifier))
+}
+
+/*
+ * Query returns the parameters of a link that is valid until expires. A
+ * one-time link gets a nonce of its own, which ss remembers once it was
+ * used.
+ */
+func Query(key []byte, applicationId int, applicationInstanceId int, identifier string, expires time.Time, oneTime bool) (bool, url.Values) {
+	query := url.Values{}
+	nonce := ""
+	if oneTime {
+		random := make([]byte, nonceLength)
+		if _, err := rand.Read(random); err != nil {
+			return false, query
+		}
+		nonce = hex.EncodeToString(random)
+		query.Set(OnceParam, nonce)
+	}
+	query.Set(ExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	query.Set(SignatureParam, hex.EncodeToString(signature(key, applicationId, applicationInstanceId, identifier, expires.Unix(), nonce)))
+	return true, query
+}
+
+/*
+ * ValidNonce tells whether a nonce is one Query could have made, which
+ * makes it safe to use as a file name.
+ */
+func ValidNonce(nonce string) bool {
+	decoded, err := hex.DecodeString(nonce)
+	return err == nil && len(decoded) == nonceLength
+}
+
+/*
+ * Verify checks the parameters of a link and returns its nonce, "" if it
+ * may be used more than once, and its expiry. It answers 403 if the link
+ * was not signed with key or was changed, and 410 if it expired. Without
+ * a key no link is valid.
+ */
+func Verify(key []byte, applicationId int, applicationInstanceId int, identifier string, query url.Values, now time.Time) (int, string, time.Time) {
+	expires, err := strconv.ParseInt(query.Get(ExpiresParam), 10, 64)
+	if len(key) == 0 || err != nil {
+		return http.StatusForbidden, "", time.Time{}
+	}
+	nonce := query.Get(OnceParam)
+	if nonce != "" && !ValidNonce(nonce) {
+		return http.StatusForbidden, "", time.Time{}
+	}
+	given, err := hex.DecodeString(query.Get(SignatureParam))
+	if err != nil || !hmac.Equal(given, signature(key, applicationId, applicationInstanceId, identifier, expires, nonce)) {
+		return http.StatusForbidden, "", time.Time{}
+	}
+	if now.Unix() > expires {
+		return http.StatusGone, nonce, time.Unix(expires, 0)
+	}
+	return http.StatusOK, nonce, time.Unix(expires, 0)
+}
@@ -0,0 +1,105 @@
+package signedurl
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("signing key")
+
+func testQuery(t *testing.T, oneTime bool, expires time.Time) url.Values {
+	t.Helper()
+	ok, query := Query(testKey, 1, 2, "blob id", expires, oneTime)
+	if !ok {
+		t.Fatal("query not signed")
+	}
+	return query
+}
+
+func TestVerifyValidLink(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	for _, oneTime := range []bool{false, true} {
+		query := testQuery(t, oneTime, expires)
+		responseCode, nonce, verifiedExpiry := Verify(testKey, 1, 2, "blob id", query, time.Now())
+		if responseCode != http.StatusOK || verifiedExpiry.Unix() != expires.Unix() {
+			t.Fatalf("one-time %v: got %d, expiring %s", oneTime, responseCode, verifiedExpiry)
+		}
+		if oneTime != (nonce != "") || (oneTime && !ValidNonce(nonce)) {
+			t.Fatalf("one-time %v: nonce %q", oneTime, nonce)
+		}
+	}
+	first := testQuery(t, true, expires).Get(OnceParam)
+	if second := testQuery(t, true, expires).Get(OnceParam); first == second {
+		t.Fatal("two one-time links share a nonce")
+	}
+}
+
+func TestVerifyRefusesChangedLinks(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	query := testQuery(t, true, expires)
+	changed := func(name string, value string) url.Values {
+		changed := url.Values{}
+		for parameter := range query {
+			changed.Set(parameter, query.Get(parameter))
+		}
+		if value == "" {
+			changed.Del(name)
+		} else {
+			changed.Set(name, value)
+		}
+		return changed
+	}
+	otherNonce := testQuery(t, true, expires).Get(OnceParam)
+
+	for name, values := range map[string]url.Values{
+		"later expiry":       changed(ExpiresParam, strconv.FormatInt(expires.Unix()+3600, 10)),
+		"expiry not a time":  changed(ExpiresParam, "tomorrow"),
+		"other nonce":        changed(OnceParam, otherNonce),
+		"nonce dropped":      changed(OnceParam, ""),
+		"nonce not in hex":   changed(OnceParam, "../../etc/passwd"),
+		"signature dropped":  changed(SignatureParam, ""),
+		"signature not hex":  changed(SignatureParam, "xyz"),
+		"signature of other": changed(SignatureParam, testQuery(t, false, expires).Get(SignatureParam)),
+	} {
+		if responseCode, _, _ := Verify(testKey, 1, 2, "blob id", values, time.Now()); responseCode != http.StatusForbidden {
+			t.Errorf("%s: got %d, want 403", name, responseCode)
+		}
+	}
+
+	for name, verify := range map[string]func() int{
+		"other identifier": func() int { code, _, _ := Verify(testKey, 1, 2, "other id", query, time.Now()); return code },
+		"other instance":   func() int { code, _, _ := Verify(testKey, 1, 3, "blob id", query, time.Now()); return code },
+		"other app":        func() int { code, _, _ := Verify(testKey, 4, 2, "blob id", query, time.Now()); return code },
+		"other key":        func() int { code, _, _ := Verify([]byte("other key"), 1, 2, "blob id", query, time.Now()); return code },
+		"no key":           func() int { code, _, _ := Verify(nil, 1, 2, "blob id", query, time.Now()); return code },
+	} {
+		if responseCode := verify(); responseCode != http.StatusForbidden {
+			t.Errorf("%s: got %d, want 403", name, responseCode)
+		}
+	}
+}
+
+func TestVerifyExpiredLink(t *testing.T) {
+	expires := time.Now().Add(time.Minute)
+	query := testQuery(t, false, expires)
+	if responseCode, _, _ := Verify(testKey, 1, 2, "blob id", query, expires); responseCode != http.StatusOK {
+		t.Fatalf("link refused in its last second: %d", responseCode)
+	}
+	if responseCode, _, _ := Verify(testKey, 1, 2, "blob id", query, expires.Add(time.Second)); responseCode != http.StatusGone {
+		t.Fatalf("expired link got %d, want 410", responseCode)
+	}
+	// A changed link is refused even once it expired.
+	query.Set(OnceParam, testQuery(t, true, expires).Get(OnceParam))
+	if responseCode, _, _ := Verify(testKey, 1, 2, "blob id", query, expires.Add(time.Second)); responseCode != http.StatusForbidden {
+		t.Fatalf("changed expired link got %d, want 403", responseCode)
+	}
+}
+
+func TestPathEscapesIdentifier(t *testing.T) {
+	if path := Path(1, 2, "a/b c"); path != "/signed/1/2/a%2Fb%20c" {
+		t.Fatalf("path is %s", path)
+	}
+}
@@ -2,19 +2,83 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"data"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/rakyll/magicmime"
-	"io/ioutil"
+	"io"
 	"net/http"
+	"outbound"
+	"signedurl"
+	"strconv"
+	"strings"
 	"time"
 )
 
+/*
+ * Uploads and downloads are streamed between the client and the storage
+ * server, never held in memory as a whole. They go through the outbound
+ * target "storage-transfer", whose timeout has to allow for the largest
+ * uploads; all other calls use "storage".
+ */
+const (
+	defaultMaxUploadSize = 100 * 1024 * 1024
+	transferTarget       = "storage-transfer"
+	minTransferTimeout   = 15 * time.Second
+)
+
+/*
+ * Signed download links point to public_url, where clients reach the
+ * public listener of the storage server. They are valid for
+ * download_url_ttl seconds unless the client asks for another time of at
+ * most max_download_url_ttl seconds. The storage server needs the same
+ * url_signing_key; without one or a public_url FE signs no links.
+ */
+const (
+	defaultDownloadURLTTL    = 900
+	defaultMaxDownloadURLTTL = 86400
+)
+
+/*
+ * MIME types are sniffed from this many bytes at the start of the data.
+ */
+const SniffLength = 4096
+
 type StorageConfig struct {
-	ServerHost string `json:"server_host"`
-	ServerPort int    `json:"server_port"`
-	ServerName string `json:"server_name"`
+	ServerHost        string `json:"server_host"`
+	ServerPort        int    `json:"server_port"`
+	ServerName        string `json:"server_name"`
+	MaxUploadSize     int64  `json:"max_upload_size"`
+	PublicURL         string `json:"public_url"`
+	URLSigningKey     string `json:"url_signing_key"`
+	DownloadURLTTL    int    `json:"download_url_ttl"`
+	MaxDownloadURLTTL int    `json:"max_download_url_ttl"`
+}
+
+var ErrTooLarge = errors.New("upload exceeds the size limit")
+
+/*
+ * LimitedReader fails with ErrTooLarge as soon as more than Limit bytes were
+ * read, so an oversized upload is stopped while it arrives.
+ */
+type LimitedReader struct {
+	Reader io.Reader
+	Limit  int64
+	read   int64
+}
+
+func (l *LimitedReader) Read(p []byte) (int, error) {
+	n, err := l.Reader.Read(p)
+	l.read += int64(n)
+	if l.read > l.Limit {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+func (l *LimitedReader) Exceeded() bool {
+	return l.read > l.Limit
 }
 
 var storageServerConfig StorageConfig
@@ -25,10 +89,72 @@ func InitStorage(st StorageConfig) {
 	storageServerRootURL = fmt.Sprintf("http://%s:%d/1.0", st.ServerHost, st.ServerPort)
 }
 
-func CreateNewUploadId() string {
-	req, err := http.NewRequest("POST", storageServerRootURL+"/new-upload-id", nil)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func MaxUploadSize() int64 {
+	if storageServerConfig.MaxUploadSize > 0 {
+		return storageServerConfig.MaxUploadSize
+	}
+	return defaultMaxUploadSize
+}
+
+func downloadURLTTL(requested time.Duration) time.Duration {
+	ttl := time.Duration(defaultDownloadURLTTL) * time.Second
+	if storageServerConfig.DownloadURLTTL > 0 {
+		ttl = time.Duration(storageServerConfig.DownloadURLTTL) * time.Second
+	}
+	if requested > 0 {
+		ttl = requested
+	}
+	maxTTL := time.Duration(defaultMaxDownloadURLTTL) * time.Second
+	if storageServerConfig.MaxDownloadURLTTL > 0 {
+		maxTTL = time.Duration(storageServerConfig.MaxDownloadURLTTL) * time.Second
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
+}
+
+/*
+ * SignedDownloadURL returns a link that downloads the data straight from
+ * the storage server for ttl, the configured time if 0, and only once if
+ * oneTime is set. It fails if FE has no signing key or public URL.
+ */
+func SignedDownloadURL(applicationId int, applicationInstanceId int, identifier string, ttl time.Duration, oneTime bool) (bool, data.SignedURL) {
+	if storageServerConfig.URLSigningKey == "" || storageServerConfig.PublicURL == "" {
+		return false, data.SignedURL{}
+	}
+	expires := time.Now().Add(downloadURLTTL(ttl)).Truncate(time.Second)
+	signed, query := signedurl.Query([]byte(storageServerConfig.URLSigningKey), applicationId, applicationInstanceId, identifier, expires, oneTime)
+	if !signed {
+		return false, data.SignedURL{}
+	}
+	rootURL := strings.TrimSuffix(storageServerConfig.PublicURL, "/") + "/1.0"
+	link := rootURL + signedurl.Path(applicationId, applicationInstanceId, identifier) + "?" + query.Encode()
+	return true, data.SignedURL{URL: link, Expires: expires, OneTime: oneTime}
+}
+
+/*
+ * TransferTimeout is how long a single upload or download may take.
+ */
+func TransferTimeout() time.Duration {
+	if timeout := outbound.Timeout(transferTarget); timeout > minTransferTimeout {
+		return timeout
+	}
+	return minTransferTimeout
+}
+
+/*
+ * CreateNewUploadId has the storage server issue an upload id that only
+ * takes the data described in the request.
+ */
+func CreateNewUploadId(uploadRequest data.UploadIdRequest) string {
+	jsonV, err := json.Marshal(uploadRequest)
+	if err != nil {
+		return ""
+	}
+	req, err := http.NewRequest("POST", storageServerRootURL+"/new-upload-id", bytes.NewBuffer(jsonV))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := outbound.Do("storage", req, false)
 	if err == nil {
 		defer resp.Body.Close()
 		if resp.StatusCode == http.StatusOK {
@@ -43,84 +169,326 @@ func CreateNewUploadId() string {
 	return ""
 }
 
-func CanUploadBinaryData(applicationId int, applicationInstanceId int, uploadId string, binaryDataLen int, mimeType string) bool {
-	values := data.UploadCheckInfo{UploadId: uploadId, UploadLen: binaryDataLen, MimeType: mimeType}
+/*
+ * CanUploadBinaryData asks the storage server whether it takes the upload;
+ * binaryDataLen is -1 if the size is not known yet. A refusal comes with
+ * the storage server's status and reason.
+ */
+func CanUploadBinaryData(ctx context.Context, applicationId int, applicationInstanceId int, uploadId string, binaryDataLen int64, mimeType string) (int, string) {
+	var rejection data.UploadRejection
+
+	values := data.UploadCheckInfo{ApplicationId: applicationId, ApplicationInstanceId: applicationInstanceId, UploadId: uploadId, UploadLen: binaryDataLen, MimeType: mimeType}
 	jsonV, err := json.Marshal(values)
-	req, err := http.NewRequest("POST", storageServerRootURL+"/can-upload-data", bytes.NewBuffer(jsonV))
+	req, err := http.NewRequestWithContext(ctx, "POST", storageServerRootURL+"/can-upload-data", bytes.NewBuffer(jsonV))
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := outbound.Do("storage", req, true)
 	if err == nil {
 		defer resp.Body.Close()
 		data.Logger.Printf("Body is ok..., resp code = %d", resp.StatusCode)
-		if resp.StatusCode == http.StatusOK {
-			return true
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return http.StatusOK, ""
+		case http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusGone, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusInsufficientStorage:
+			json.NewDecoder(resp.Body).Decode(&rejection)
+			data.Logger.Printf("Upload %s refused: %s", uploadId, rejection.Reason)
+			return resp.StatusCode, rejection.Reason
 		}
+	} else if outbound.IsCircuitOpen(err) {
+		return http.StatusServiceUnavailable, ""
 	}
 	data.Logger.Printf("Cannot upload binary data...")
-	return false
+	return http.StatusNotFound, ""
+}
+
+/*
+ * rejectionReason reads why the storage server refused a request, if it
+ * said so.
+ */
+func rejectionReason(res *http.Response) string {
+	var rejection data.UploadRejection
+	json.NewDecoder(res.Body).Decode(&rejection)
+	return rejection.Reason
 }
 
-func UploadBinaryData(applicationId int, applicationInstanceId int, uploadId string, binaryData []byte) (bool, string, time.Time) {
+/*
+ * UploadBinaryData streams the body to the storage server, which stores it
+ * while hashing it. The size is -1 if it is not known in advance. A body
+ * that is a LimitedReader stopping the upload yields 413. A refusal comes
+ * with the storage server's reason, e.g. the quota that was exceeded.
+ */
+func UploadBinaryData(ctx context.Context, applicationId int, applicationInstanceId int, uploadId string, body io.Reader, size int64, contentType string) (int, string, data.StorageServerUploadResponse) {
+	var storageResponse data.StorageServerUploadResponse
+
 	putURL := fmt.Sprintf("%s/upload/%d/%d/%s", storageServerRootURL, applicationId, applicationInstanceId, uploadId)
-	contentType, err := magicmime.TypeByBuffer(binaryData)
-	if err != nil {
-		contentType = "application/octet-stream"
-	}
-	req, err := http.NewRequest("PUT", putURL, bytes.NewBuffer(binaryData))
+	req, err := http.NewRequestWithContext(ctx, "PUT", putURL, body)
 	data.Logger.Printf("Prepared PUT Statement %s", putURL)
 	if err != nil {
-		return false, "", time.Now()
+		return http.StatusInsufficientStorage, "", storageResponse
 	}
+	req.ContentLength = size
 	req.Header.Set("Content-Type", contentType)
-	data.Logger.Printf("Set Content Type to %s", contentType)
-	client := &http.Client{}
-	res, err := client.Do(req)
-	data.Logger.Printf("Result of Client.DO = %s", err)
+	res, err := outbound.Do(transferTarget, req, false)
+	if limited, isLimited := body.(*LimitedReader); isLimited && limited.Exceeded() {
+		if err == nil {
+			res.Body.Close()
+		}
+		return http.StatusRequestEntityTooLarge, "", storageResponse
+	}
 	if err != nil {
-		return false, "", time.Now()
+		data.Logger.Printf("Upload to storage failed: %s", err)
+		if outbound.IsCircuitOpen(err) {
+			return http.StatusServiceUnavailable, "", storageResponse
+		}
+		return http.StatusInsufficientStorage, "", storageResponse
 	}
 	defer res.Body.Close()
-	data.Logger.Printf("Checking Status Code %d", res.StatusCode)
-	if res.StatusCode == http.StatusOK {
-		storageResponse := data.StorageServerUploadResponse{}
-		data.Logger.Printf("Checking Json")
-		err := json.NewDecoder(res.Body).Decode(&storageResponse)
-		if err == nil {
-			return true, storageResponse.BinaryDataId, storageResponse.Expires
+	switch res.StatusCode {
+	case http.StatusOK:
+		if json.NewDecoder(res.Body).Decode(&storageResponse) == nil {
+			return http.StatusOK, "", storageResponse
 		}
+	case http.StatusForbidden, http.StatusConflict, http.StatusGone, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusExpectationFailed, http.StatusInsufficientStorage:
+		return res.StatusCode, rejectionReason(res), storageResponse
 	}
-	return false, "", time.Now()
+	return http.StatusInsufficientStorage, "", storageResponse
 }
 
-func RetrieveBinaryData(applicationId int, applicationInstanceId int, identifier string) (int, []byte, string, time.Time) {
+/*
+ * The headers of a download that are passed on to the storage server, and
+ * those of its answer that are passed back to the client, so ranges and
+ * conditional requests work through FE.
+ */
+var downloadRequestHeaders = []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"}
+var downloadResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified", "Cache-Control"}
+
+/*
+ * RetrieveBinaryData returns the stored data as a stream together with the
+ * headers to send with it. Besides 200 it may answer 206 for a range, 304
+ * if the client's copy is current and 416 for a range beyond the data. The
+ * caller has to close the stream if there is one.
+ */
+func RetrieveBinaryData(ctx context.Context, applicationId int, applicationInstanceId int, identifier string, requestHeader http.Header) (int, io.ReadCloser, http.Header) {
+	responseHeader := http.Header{}
 	getURL := fmt.Sprintf("%s/download/%d/%d/%s", storageServerRootURL, applicationId, applicationInstanceId, identifier)
-	req, err := http.NewRequest("GET", getURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", getURL, nil)
 	data.Logger.Printf("Prepared GET Statement %s", getURL)
 	if err != nil {
-		return 404, nil, "", time.Now()
+		return http.StatusNotFound, nil, responseHeader
+	}
+	for _, name := range downloadRequestHeaders {
+		if value := requestHeader.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	res, err := outbound.Do(transferTarget, req, true)
+	if err != nil {
+		data.Logger.Printf("Download from storage failed: %s", err)
+		if outbound.IsCircuitOpen(err) {
+			return http.StatusServiceUnavailable, nil, responseHeader
+		}
+		return http.StatusNotFound, nil, responseHeader
+	}
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified, http.StatusRequestedRangeNotSatisfiable:
+		for _, name := range downloadResponseHeaders {
+			if value := res.Header.Get(name); value != "" {
+				responseHeader.Set(name, value)
+			}
+		}
+		if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent {
+			return res.StatusCode, res.Body, responseHeader
+		}
+		res.Body.Close()
+		return res.StatusCode, nil, responseHeader
+	}
+	res.Body.Close()
+	return http.StatusNotFound, nil, responseHeader
+}
+
+/*
+ * Resumable uploads are kept by the storage server as partial uploads until
+ * their last chunk arrived. StatusChecksumMismatch is the tus status of a
+ * chunk that does not match its checksum.
+ */
+const StatusChecksumMismatch = 460
+
+type ResumableUpload struct {
+	Offset  int64
+	Length  int64
+	Expires time.Time
+}
+
+func resumableUploadFromHeaders(header http.Header) ResumableUpload {
+	var upload ResumableUpload
+	upload.Offset, _ = strconv.ParseInt(header.Get("Upload-Offset"), 10, 64)
+	upload.Length, _ = strconv.ParseInt(header.Get("Upload-Length"), 10, 64)
+	upload.Expires, _ = http.ParseTime(header.Get("Upload-Expires"))
+	return upload
+}
+
+func resumableUploadURL(applicationId int, applicationInstanceId int, uploadId string) string {
+	return fmt.Sprintf("%s/resumable/%d/%d/%s", storageServerRootURL, applicationId, applicationInstanceId, uploadId)
+}
+
+/*
+ * storageStatus maps the answer of the storage server to the status FE
+ * gives its client; anything unexpected means the data could not be stored.
+ */
+func storageStatus(res *http.Response, err error, expected ...int) int {
+	if err != nil {
+		data.Logger.Printf("Storage request failed: %s", err)
+		if outbound.IsCircuitOpen(err) {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusInsufficientStorage
+	}
+	for _, status := range expected {
+		if res.StatusCode == status {
+			return status
+		}
+	}
+	return http.StatusInsufficientStorage
+}
+
+/*
+ * CreateResumableUpload prepares the storage server for an upload of the
+ * given length that is sent in chunks until it expires. The tus
+ * Upload-Metadata of the client is passed on. A refusal comes with the
+ * storage server's reason.
+ */
+func CreateResumableUpload(ctx context.Context, applicationId int, applicationInstanceId int, uploadId string, length int64, expires time.Time, metadata string) (int, string, ResumableUpload) {
+	req, err := http.NewRequestWithContext(ctx, "POST", resumableUploadURL(applicationId, applicationInstanceId, uploadId), nil)
+	if err != nil {
+		return http.StatusInsufficientStorage, "", ResumableUpload{}
+	}
+	req.Header.Set("Upload-Length", strconv.FormatInt(length, 10))
+	req.Header.Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	if metadata != "" {
+		req.Header.Set("Upload-Metadata", metadata)
 	}
-	client := &http.Client{}
-	res, err := client.Do(req)
-	data.Logger.Printf("Result of Client.DO = %s", err)
+	res, err := outbound.Do("storage", req, true)
+	responseCode := storageStatus(res, err, http.StatusCreated, http.StatusForbidden, http.StatusConflict, http.StatusGone, http.StatusRequestEntityTooLarge, http.StatusExpectationFailed, http.StatusInsufficientStorage)
 	if err != nil {
-		return 404, nil, "", time.Now()
+		return responseCode, "", ResumableUpload{}
 	}
 	defer res.Body.Close()
-	data.Logger.Printf("Checking Status Code %d", res.StatusCode)
-	if res.StatusCode == http.StatusOK {
-		data, err := ioutil.ReadAll(res.Body)
+	if responseCode != http.StatusCreated {
+		return responseCode, rejectionReason(res), ResumableUpload{}
+	}
+	return responseCode, "", resumableUploadFromHeaders(res.Header)
+}
+
+func ResumableUploadOffset(ctx context.Context, applicationId int, applicationInstanceId int, uploadId string) (int, ResumableUpload) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", resumableUploadURL(applicationId, applicationInstanceId, uploadId), nil)
+	if err != nil {
+		return http.StatusNotFound, ResumableUpload{}
+	}
+	res, err := outbound.Do("storage", req, true)
+	responseCode := storageStatus(res, err, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return responseCode, ResumableUpload{}
+	}
+	res.Body.Close()
+	return responseCode, resumableUploadFromHeaders(res.Header)
+}
+
+/*
+ * AppendBinaryData streams a chunk of a resumable upload to the storage
+ * server. It returns 204 while the upload is incomplete and 200 with the
+ * stored data once it is complete; 409 means the offset is not where the
+ * upload stands.
+ */
+func AppendBinaryData(ctx context.Context, applicationId int, applicationInstanceId int, uploadId string, offset int64, checksum string, body io.Reader, size int64) (int, ResumableUpload, data.StorageServerUploadResponse) {
+	var storageResponse data.StorageServerUploadResponse
+
+	req, err := http.NewRequestWithContext(ctx, "PATCH", resumableUploadURL(applicationId, applicationInstanceId, uploadId), body)
+	if err != nil {
+		return http.StatusInsufficientStorage, ResumableUpload{}, storageResponse
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	if checksum != "" {
+		req.Header.Set("Upload-Checksum", checksum)
+	}
+	res, err := outbound.Do(transferTarget, req, false)
+	if limited, isLimited := body.(*LimitedReader); isLimited && limited.Exceeded() {
 		if err == nil {
-			contentType := res.Header.Get("Content-Type")
-			return res.StatusCode, data, contentType, time.Now()
+			res.Body.Close()
 		}
+		return http.StatusRequestEntityTooLarge, ResumableUpload{}, storageResponse
+	}
+	responseCode := storageStatus(res, err, http.StatusOK, http.StatusNoContent, http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound, http.StatusConflict, http.StatusGone, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, StatusChecksumMismatch)
+	if err != nil {
+		return responseCode, ResumableUpload{}, storageResponse
+	}
+	defer res.Body.Close()
+	if responseCode == http.StatusOK && json.NewDecoder(res.Body).Decode(&storageResponse) != nil {
+		responseCode = http.StatusInsufficientStorage
 	}
-	return 404, nil, "", time.Now()
+	return responseCode, resumableUploadFromHeaders(res.Header), storageResponse
 }
 
-func DeleteBinaryData(applicationId int, applicationInstanceId int, identifier string) bool {
-	return true
+/*
+ * StorageUsage returns what the application keeps in storage and its
+ * quota.
+ */
+func StorageUsage(ctx context.Context, applicationId int) (int, data.StorageUsage) {
+	var usage data.StorageUsage
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/usage/%d", storageServerRootURL, applicationId), nil)
+	if err != nil {
+		return http.StatusInternalServerError, usage
+	}
+	res, err := outbound.Do("storage", req, true)
+	responseCode := storageStatus(res, err, http.StatusOK)
+	if err != nil {
+		return responseCode, usage
+	}
+	defer res.Body.Close()
+	if responseCode == http.StatusOK && json.NewDecoder(res.Body).Decode(&usage) != nil {
+		responseCode = http.StatusInsufficientStorage
+	}
+	return responseCode, usage
 }
 
-func ExpireBinaryData() {
+/*
+ * DeleteBinaryData has the storage server remove stored data right away. It
+ * answers 403 if the data belongs to another application and 409 while it
+ * is still being stored.
+ */
+func DeleteBinaryData(ctx context.Context, applicationId int, applicationInstanceId int, identifier string) int {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", fmt.Sprintf("%s/delete-data/%d/%d/%s", storageServerRootURL, applicationId, applicationInstanceId, identifier), nil)
+	if err != nil {
+		return http.StatusNotFound
+	}
+	res, err := outbound.Do("storage", req, true)
+	responseCode := storageStatus(res, err, http.StatusOK, http.StatusForbidden, http.StatusNotFound, http.StatusConflict)
+	if err == nil {
+		res.Body.Close()
+	}
+	return responseCode
+}
+
+/*
+ * ExpireBinaryData sets when the storage server removes stored data; an
+ * expiry in the past removes it with the next sweep and makes it
+ * unavailable at once.
+ */
+func ExpireBinaryData(applicationId int, applicationInstanceId int, identifier string, expires time.Time) int {
+	jsonV, err := json.Marshal(data.BinaryDataExpiry{Expires: expires})
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/expire-data/%d/%d/%s", storageServerRootURL, applicationId, applicationInstanceId, identifier), bytes.NewBuffer(jsonV))
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := outbound.Do("storage", req, true)
+	responseCode := storageStatus(res, err, http.StatusOK, http.StatusForbidden, http.StatusNotFound, http.StatusConflict)
+	if err == nil {
+		res.Body.Close()
+	}
+	return responseCode
 }
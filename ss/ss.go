@@ -5,128 +5,1610 @@ Copyright (c) 2018 Imdat Solak
 package main
 
 import (
+	"blobcrypt"
+	"blobstore"
+	"bufio"
 	"bytes"
+	"configfile"
 	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
 	"data"
+	"encoding"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/rakyll/magicmime"
 	"github.com/twinj/uuid"
+	"hash"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"outbound"
+	"path/filepath"
+	"signedurl"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+/*
+ * MIME types are sniffed from this many bytes at the start of the data.
+ */
+const sniffLength = 4096
+
 var apiVersion = "1.0"
 var rootURL = "/" + apiVersion
 
-var storagePath string = "/tmp/ul"
-var storageTTL time.Duration = time.Hour
+var storageTTL time.Duration = time.Hour
+
+var globalUploadId int = 100
+var globalCreateId int = 100
+
+type MyConfig struct {
+	Host string `json:"listen_host"`
+	Port int    `json:"listen_port"`
+}
+
+/*
+ * The default quota holds for every application without one of its own in
+ * applications; a limit of zero is no limit.
+ */
+type QuotaConfig struct {
+	Default      data.StorageQuota         `json:"default"`
+	Applications map[int]data.StorageQuota `json:"applications"`
+}
+
+/*
+ * me is where FE reaches ss; it answers everything but signed links and
+ * must not be reachable by clients. Signed links are only served at public,
+ * where clients and services follow them, and only with a url_signing_key.
+ * The staging path holds the upload grants and partial uploads, so like the
+ * blob store it has to survive a restart; so does the metadata path, which
+ * defaults to a directory in the staging path. Uploads are stopped as soon
+ * as they exceed max_upload_size bytes; transfer_timeout is how many seconds
+ * a single upload or download may take. Stored data is kept for data_ttl
+ * seconds unless FE sets another expiry. Links signed with url_signing_key,
+ * which FE has as well, download data without asking FE. With a keyring,
+ * the file of the applications' keys, all data is stored encrypted.
+ */
+type SSConfiguration struct {
+	Me              MyConfig                  `json:"me"`
+	Public          MyConfig                  `json:"public"`
+	StagingPath     string                    `json:"staging_path"`
+	MetadataPath    string                    `json:"metadata_path"`
+	MaxUploadSize   int64                     `json:"max_upload_size"`
+	TransferTimeout int                       `json:"transfer_timeout"`
+	DataTTL         int                       `json:"data_ttl"`
+	Quotas          QuotaConfig               `json:"quotas"`
+	URLSigningKey   string                    `json:"url_signing_key"`
+	Keyring         string                    `json:"keyring"`
+	BlobStore       blobstore.BlobStoreConfig `json:"blob_store"`
+	Outbound        outbound.OutboundConfig   `json:"outbound"`
+}
+
+const (
+	defaultListenHost      = "0.0.0.0"
+	defaultListenPort      = 9500
+	defaultPublicPort      = 9501
+	defaultMaxUploadSize   = 1024 * 1024 * 1024
+	defaultTransferTimeout = 600
+	defaultDataTTL         = 900
+)
+
+var configuration SSConfiguration
+var stagingPath string
+var metadataPath string
+var blobs blobstore.BlobStore
+var keyring *blobcrypt.Keyring
+
+func listenAddress(listener MyConfig, defaultPort int) string {
+	host, port := listener.Host, listener.Port
+	if host == "" {
+		host = defaultListenHost
+	}
+	if port == 0 {
+		port = defaultPort
+	}
+	return fmt.Sprintf("%s:%d", host, port)
+}
+
+func maxUploadSize() int64 {
+	if configuration.MaxUploadSize > 0 {
+		return configuration.MaxUploadSize
+	}
+	return defaultMaxUploadSize
+}
+
+func transferTimeout() time.Duration {
+	if configuration.TransferTimeout > 0 {
+		return time.Duration(configuration.TransferTimeout) * time.Second
+	}
+	return defaultTransferTimeout * time.Second
+}
+
+/*
+ * Bodies are streamed, so reading and writing them may take as long as a
+ * transfer instead of the server's timeouts.
+ */
+func extendTransferDeadlines(w http.ResponseWriter) {
+	deadline := time.Now().Add(transferTimeout())
+	controller := http.NewResponseController(w)
+	if err := controller.SetReadDeadline(deadline); err != nil {
+		data.Logger.Printf("Can't extend the read deadline: %s", err)
+	}
+	if err := controller.SetWriteDeadline(deadline); err != nil {
+		data.Logger.Printf("Can't extend the write deadline: %s", err)
+	}
+}
+
+func dataTTL() time.Duration {
+	if configuration.DataTTL > 0 {
+		return time.Duration(configuration.DataTTL) * time.Second
+	}
+	return defaultDataTTL * time.Second
+}
+
+/*
+ * Every upload id ss issues is tied to the application that may use it, an
+ * expiry, and the MIME types and size its service takes. The grants are
+ * kept as files so they survive a restart, and for a day past their expiry
+ * so a late attempt to reuse one is still recognized. Each upload id takes
+ * a single upload.
+ */
+const grantRetention = 24 * time.Hour
+
+type uploadGrant struct {
+	data.UploadIdRequest
+	Used bool `json:"used"`
+}
+
+var grantMutex sync.Mutex
+
+/*
+ * An upload claims its upload id before it writes anything, so of two
+ * uploads with the same id only one ever reaches the blob store. Claims
+ * are only kept in memory: after a restart no upload is in progress.
+ */
+var claimedUploads = make(map[string]bool)
+
+func grantFilename(uploadId string) string {
+	return fmt.Sprintf("%s/.grant-%s.json", stagingPath, uploadId)
+}
+
+func loadUploadGrant(uploadId string) (bool, uploadGrant) {
+	var grant uploadGrant
+	if _, err := uuid.Parse(uploadId); err != nil {
+		return false, grant
+	}
+	state, err := ioutil.ReadFile(grantFilename(uploadId))
+	if err != nil || json.Unmarshal(state, &grant) != nil {
+		return false, grant
+	}
+	return true, grant
+}
+
+func saveUploadGrant(uploadId string, grant uploadGrant) bool {
+	state, err := json.Marshal(grant)
+	if err != nil {
+		return false
+	}
+	filename := grantFilename(uploadId)
+	if err := ioutil.WriteFile(filename+".tmp", state, 0600); err != nil {
+		data.Logger.Printf("Could not save upload grant: %s", err)
+		return false
+	}
+	return os.Rename(filename+".tmp", filename) == nil
+}
+
+func CreateNewUploadId(uploadRequest data.UploadIdRequest) string {
+	var newUID string
+	newUID = uuid.NewV4().String()
+	grantMutex.Lock()
+	defer grantMutex.Unlock()
+	if !saveUploadGrant(newUID, uploadGrant{UploadIdRequest: uploadRequest}) {
+		return ""
+	}
+	data.Logger.Printf("new Upload ID: %s", newUID)
+	return newUID
+}
+
+/*
+ * The largest upload an upload id takes.
+ */
+func uploadSizeLimit(grant uploadGrant) int64 {
+	if grant.MaxSize > 0 && grant.MaxSize < maxUploadSize() {
+		return grant.MaxSize
+	}
+	return maxUploadSize()
+}
+
+/*
+ * CanUploadBinaryData checks an upload against the grant of its upload id
+ * and returns the status to refuse it with and why. A size below 0 or an
+ * empty MIME type is not known yet and not checked.
+ */
+func CanUploadBinaryData(applicationId int, applicationInstanceId int, uploadId string, binaryDataLen int64, mimeType string) (int, string) {
+	if _, err := uuid.Parse(uploadId); err != nil {
+		return http.StatusBadRequest, "invalid upload id"
+	}
+	grantMutex.Lock()
+	found, grant := loadUploadGrant(uploadId)
+	claimed := claimedUploads[uploadId]
+	grantMutex.Unlock()
+	switch {
+	case !found:
+		return http.StatusNotFound, "unknown upload id"
+	case grant.ApplicationId != applicationId || grant.ApplicationInstanceId != applicationInstanceId:
+		return http.StatusForbidden, "upload id was issued to another application"
+	case grant.Used:
+		return http.StatusConflict, "upload id was already used"
+	case claimed:
+		return http.StatusConflict, "upload id is used by another upload"
+	case grant.Expires.Before(time.Now()):
+		return http.StatusGone, fmt.Sprintf("upload id expired at %s", grant.Expires.UTC().Format(time.RFC3339))
+	case binaryDataLen > uploadSizeLimit(grant):
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("upload of %d bytes exceeds the limit of %d bytes", binaryDataLen, uploadSizeLimit(grant))
+	case mimeType != "" && !data.MediaTypeAccepted(grant.MimeTypes, mimeType):
+		return http.StatusUnsupportedMediaType, fmt.Sprintf("%s is not one of the accepted types %s", mimeType, strings.Join(grant.MimeTypes, ", "))
+	case !canEncrypt(applicationId):
+		return http.StatusForbidden, noKeyReason(applicationId)
+	}
+	// A resumable upload reserved its share of the quota when it was
+	// created.
+	if found, _ := loadPartialUpload(partialFilename(applicationId, applicationInstanceId, uploadId)); !found {
+		if withinQuota, reason := checkQuota(applicationId, binaryDataLen); !withinQuota {
+			return http.StatusInsufficientStorage, reason
+		}
+	}
+	return http.StatusOK, ""
+}
+
+func uploadIdUsed(uploadId string) bool {
+	grantMutex.Lock()
+	defer grantMutex.Unlock()
+	found, grant := loadUploadGrant(uploadId)
+	return found && grant.Used
+}
+
+/*
+ * claimUploadId reserves an upload id for the upload about to be stored. It
+ * fails if the id is unknown, used, or claimed by another upload.
+ */
+func claimUploadId(uploadId string) bool {
+	grantMutex.Lock()
+	defer grantMutex.Unlock()
+	found, grant := loadUploadGrant(uploadId)
+	if !found || grant.Used || claimedUploads[uploadId] {
+		return false
+	}
+	claimedUploads[uploadId] = true
+	return true
+}
+
+func releaseUploadId(uploadId string) {
+	grantMutex.Lock()
+	delete(claimedUploads, uploadId)
+	grantMutex.Unlock()
+}
+
+/*
+ * useUploadId marks a claimed upload id as used once its data is stored.
+ */
+func useUploadId(uploadId string) bool {
+	grantMutex.Lock()
+	defer grantMutex.Unlock()
+	found, grant := loadUploadGrant(uploadId)
+	if !found || grant.Used || !claimedUploads[uploadId] {
+		return false
+	}
+	grant.Used = true
+	if !saveUploadGrant(uploadId, grant) {
+		return false
+	}
+	delete(claimedUploads, uploadId)
+	return true
+}
+
+/*
+ * sniffMimeType tells the MIME type from the first bytes of the data
+ * without consuming them. It returns false if there is no data.
+ */
+func sniffMimeType(body *bufio.Reader) (bool, string) {
+	head, _ := body.Peek(sniffLength)
+	if len(head) == 0 {
+		return false, ""
+	}
+	contentType, err := magicmime.TypeByBuffer(head)
+	if err != nil {
+		contentType = "application/octet-stream"
+	}
+	return true, contentType
+}
+
+func writeUploadRejection(w http.ResponseWriter, responseCode int, reason string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(responseCode)
+	json.NewEncoder(w).Encode(data.UploadRejection{Reason: reason})
+}
+
+func binaryDataKey(applicationId int, applicationInstanceId int, identifier string) string {
+	return fmt.Sprintf("%d_%d_%s", applicationId, applicationInstanceId, identifier)
+}
+
+var errTooLarge = errors.New("upload exceeds the size limit")
+
+/*
+ * limitedReader fails as soon as more than limit bytes were read, which
+ * makes the blob store drop what it got so far.
+ */
+type limitedReader struct {
+	reader io.Reader
+	limit  int64
+	read   int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, errTooLarge
+	}
+	return n, err
+}
+
+/*
+ * Quotas are per application, over all its instances. An upload reserves
+ * its share of the quota before it is stored, a resumable one its whole
+ * length when it is created, so uploads in progress can't overrun it
+ * together. Usage and reservations are only kept in memory; ss counts
+ * them again from the metadata and partial uploads when it starts.
+ */
+type applicationUsage struct {
+	bytes           int64
+	objects         int64
+	reservedBytes   int64
+	reservedObjects int64
+}
+
+var quotaMutex sync.Mutex
+var storageUsage = make(map[int]*applicationUsage)
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+func quotaFor(applicationId int) data.StorageQuota {
+	if quota, found := configuration.Quotas.Applications[applicationId]; found {
+		return quota
+	}
+	return configuration.Quotas.Default
+}
+
+/*
+ * usageOf returns the usage of an application; the caller holds quotaMutex.
+ */
+func usageOf(applicationId int) *applicationUsage {
+	usage, found := storageUsage[applicationId]
+	if !found {
+		usage = &applicationUsage{}
+		storageUsage[applicationId] = usage
+	}
+	return usage
+}
+
+/*
+ * quotaRefusal tells why storing bytes more in objects more, with the
+ * largest of them objectSize bytes, would exceed the quota of the
+ * application; "" if it would not. The caller holds quotaMutex.
+ */
+func quotaRefusal(applicationId int, bytes int64, objects int64, objectSize int64) string {
+	quota := quotaFor(applicationId)
+	usage := usageOf(applicationId)
+	switch {
+	case quota.MaxObjectSize > 0 && objectSize > quota.MaxObjectSize:
+		return fmt.Sprintf("objects of application %d may have at most %d bytes", applicationId, quota.MaxObjectSize)
+	case quota.MaxObjects > 0 && usage.objects+usage.reservedObjects+objects > quota.MaxObjects:
+		return fmt.Sprintf("application %d may keep at most %d objects, %d are in use", applicationId, quota.MaxObjects, usage.objects+usage.reservedObjects)
+	case quota.MaxBytes > 0 && usage.bytes+usage.reservedBytes+bytes > quota.MaxBytes:
+		return fmt.Sprintf("application %d may keep at most %d bytes, %d are in use", applicationId, quota.MaxBytes, usage.bytes+usage.reservedBytes)
+	}
+	return ""
+}
+
+/*
+ * checkQuota tells whether an object of the given size, -1 if not known,
+ * would still fit. Only reserveQuota holds the space.
+ */
+func checkQuota(applicationId int, size int64) (bool, string) {
+	if size < 0 {
+		size = 0
+	}
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	reason := quotaRefusal(applicationId, size, 1, size)
+	return reason == "", reason
+}
+
+func reserveQuota(applicationId int, bytes int64, objects int64, objectSize int64) (bool, string) {
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	if reason := quotaRefusal(applicationId, bytes, objects, objectSize); reason != "" {
+		return false, reason
+	}
+	usage := usageOf(applicationId)
+	usage.reservedBytes += bytes
+	usage.reservedObjects += objects
+	return true, ""
+}
+
+func releaseQuota(applicationId int, bytes int64, objects int64) {
+	quotaMutex.Lock()
+	usage := usageOf(applicationId)
+	usage.reservedBytes -= bytes
+	usage.reservedObjects -= objects
+	quotaMutex.Unlock()
+}
+
+/*
+ * addStoredUsage counts stored objects; they are taken off again with
+ * negative numbers.
+ */
+func addStoredUsage(applicationId int, bytes int64, objects int64) {
+	quotaMutex.Lock()
+	usage := usageOf(applicationId)
+	usage.bytes += bytes
+	usage.objects += objects
+	quotaMutex.Unlock()
+}
+
+func applicationStorageUsage(applicationId int) data.StorageUsage {
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	usage := usageOf(applicationId)
+	return data.StorageUsage{ApplicationId: applicationId, Bytes: usage.bytes, Objects: usage.objects, ReservedBytes: usage.reservedBytes, ReservedObjects: usage.reservedObjects, Quota: quotaFor(applicationId)}
+}
+
+/*
+ * quotaReader reserves quota for everything read beyond what was reserved
+ * already, and fails as soon as the quota does not allow more.
+ */
+type quotaReader struct {
+	reader        io.Reader
+	applicationId int
+	reserved      int64
+	read          int64
+	refusal       string
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.reader.Read(p)
+	q.read += int64(n)
+	if q.read > q.reserved {
+		if reserved, reason := reserveQuota(q.applicationId, q.read-q.reserved, 0, q.read); !reserved {
+			q.refusal = reason
+			return n, errQuotaExceeded
+		}
+		q.reserved = q.read
+	}
+	return n, err
+}
+
+/*
+ * storeBinaryData hands the data to the blob store while hashing it; the
+ * store only keeps it once it is complete, so nobody ever reads half an
+ * upload. It answers 413 for data larger than limit, 417 for none at all,
+ * 409 if the upload id was used or is used by another upload, which is
+ * checked before anything is written, 403 with the reason if the
+ * application has no key to encrypt it with and 507 with the reason if the
+ * application's quota does not take the data. size is -1 if not known.
+ */
+func storeBinaryData(applicationId int, applicationInstanceId int, identifier string, body io.Reader, limit int64, size int64, contentType string) (int, string, data.StorageServerUploadResponse) {
+	var response data.StorageServerUploadResponse
+
+	key := binaryDataKey(applicationId, applicationInstanceId, identifier)
+	if !lockUpload(key) {
+		return http.StatusConflict, "", response
+	}
+	defer unlockUpload(key)
+	if !claimUploadId(identifier) {
+		return http.StatusConflict, "", response
+	}
+	defer releaseUploadId(identifier)
+	if size < 0 {
+		size = 0
+	}
+	if reserved, reason := reserveQuota(applicationId, size, 1, size); !reserved {
+		return http.StatusInsufficientStorage, reason, response
+	}
+	quota := &quotaReader{reader: body, applicationId: applicationId, reserved: size}
+	// Released only once the stored data is counted.
+	defer func() { releaseQuota(applicationId, quota.reserved, 1) }()
+	hash := sha256.New()
+	limited := &limitedReader{reader: quota, limit: limit}
+	responseCode, reason, sealed, seal := encryptBlob(applicationId, applicationInstanceId, identifier, io.TeeReader(limited, hash))
+	if responseCode != http.StatusOK {
+		return responseCode, reason, response
+	}
+	// What the store got may be encrypted; the size is that of the data.
+	_, err := blobs.Put(key, sealed)
+	size = limited.read
+	if limited.read > limit {
+		return http.StatusRequestEntityTooLarge, "", response
+	}
+	if quota.refusal != "" {
+		return http.StatusInsufficientStorage, quota.refusal, response
+	}
+	if err != nil {
+		data.Logger.Printf("Could not store upload: %s", err)
+		return http.StatusInternalServerError, "", response
+	}
+	if size == 0 {
+		blobs.Delete(key)
+		return http.StatusExpectationFailed, "", response
+	}
+	recorded, metadata := recordBlob(applicationId, applicationInstanceId, identifier, size, fmt.Sprintf("%x", hash.Sum(nil)), contentType, seal)
+	if !recorded {
+		blobs.Delete(key)
+		return http.StatusInternalServerError, "", response
+	}
+	if !useUploadId(identifier) {
+		removeBlob(identifier, metadata, false)
+		return http.StatusInternalServerError, "", response
+	}
+	response = data.StorageServerUploadResponse{BinaryDataId: identifier, Expires: metadata.Expires, Size: size, SHA256: metadata.SHA256}
+	return http.StatusOK, "", response
+}
+
+/*
+ * findBinaryData returns the metadata of stored data of the application
+ * that did not expire.
+ */
+func findBinaryData(applicationId int, applicationInstanceId int, identifier string) (bool, blobMetadata) {
+	found, metadata := loadBlobMetadata(identifier)
+	if !found || !metadata.ownedBy(applicationId, applicationInstanceId) || metadata.Expires.Before(time.Now()) {
+		return false, metadata
+	}
+	return true, metadata
+}
+
+/*
+ * Downloads are served from the metadata: the ETag is the SHA-256 of the
+ * data and Last-Modified the time it was stored. Conditional requests are
+ * answered with 304 and a single byte range with 206; requests for several
+ * ranges get the whole data.
+ */
+func etagMatches(list string, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * notModified follows RFC 7232: If-Modified-Since only counts without
+ * If-None-Match.
+ */
+func notModified(req *http.Request, etag string, modified time.Time) bool {
+	if list := req.Header.Get("If-None-Match"); list != "" {
+		return etagMatches(list, etag)
+	}
+	since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
+
+/*
+ * rangeApplies tells whether the Range of the request is for this data: an
+ * If-Range has to name its ETag or time exactly.
+ */
+func rangeApplies(req *http.Request, etag string, modified time.Time) bool {
+	condition := req.Header.Get("If-Range")
+	if condition == "" {
+		return true
+	}
+	if strings.HasPrefix(condition, "\"") || strings.HasPrefix(condition, "W/") {
+		return condition == etag
+	}
+	date, err := http.ParseTime(condition)
+	return err == nil && modified.Truncate(time.Second).Equal(date)
+}
+
+/*
+ * parseRange returns the offset and length a Range header asks for. It
+ * returns 206 for a range within the data, 416 for one beyond its end and
+ * 200 for headers it ignores.
+ */
+func parseRange(header string, size int64) (int, int64, int64) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return http.StatusOK, 0, size
+	}
+	bounds := strings.SplitN(strings.TrimSpace(spec), "-", 2)
+	if len(bounds) != 2 {
+		return http.StatusOK, 0, size
+	}
+	if bounds[0] == "" {
+		suffix, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || suffix < 0 {
+			return http.StatusOK, 0, size
+		}
+		if suffix == 0 {
+			return http.StatusRequestedRangeNotSatisfiable, 0, 0
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return http.StatusPartialContent, size - suffix, suffix
+	}
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || start < 0 {
+		return http.StatusOK, 0, size
+	}
+	end := size - 1
+	if bounds[1] != "" {
+		if end, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || end < start {
+			return http.StatusOK, 0, size
+		}
+	}
+	if start >= size {
+		return http.StatusRequestedRangeNotSatisfiable, 0, 0
+	}
+	if end >= size {
+		end = size - 1
+	}
+	return http.StatusPartialContent, start, end - start + 1
+}
+
+/*
+ * serveBinaryData answers a GET or HEAD of stored data. Caches may keep it
+ * for maxAge, nobody if it is 0. Data that can't be decrypted any more is
+ * gone, 410.
+ */
+func serveBinaryData(w http.ResponseWriter, req *http.Request, identifier string, metadata blobMetadata, maxAge time.Duration, link *oneTimeLink) {
+	readable, dataKey := blobDataKey(identifier, metadata)
+	if !readable {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	etag := "\"" + metadata.SHA256 + "\""
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", metadata.Stored.UTC().Format(http.TimeFormat))
+	if link == nil {
+		w.Header().Set("Accept-Ranges", "bytes")
+	} else {
+		w.Header().Set("Accept-Ranges", "none")
+	}
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(maxAge/time.Second)))
+	} else {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	if link == nil && notModified(req, etag, metadata.Stored) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	responseCode, offset, length := http.StatusOK, int64(0), metadata.Size
+	if rangeHeader := req.Header.Get("Range"); link == nil && rangeHeader != "" && rangeApplies(req, etag, metadata.Stored) {
+		responseCode, offset, length = parseRange(rangeHeader, metadata.Size)
+	}
+	switch responseCode {
+	case http.StatusRequestedRangeNotSatisfiable:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", metadata.Size))
+		w.WriteHeader(responseCode)
+		return
+	case http.StatusPartialContent:
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, metadata.Size))
+	}
+	contentType := metadata.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if req.Method == "HEAD" {
+		w.WriteHeader(responseCode)
+		return
+	}
+	if link != nil && !claimOneTimeLink(link.nonce, link.expires) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	blob, err := openBlob(identifier, metadata, dataKey, offset, length)
+	if err != nil {
+		data.Logger.Printf("Could not open blob %s, err = %s", identifier, err)
+		if link != nil {
+			releaseOneTimeLink(link.nonce)
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer blob.Close()
+	w.WriteHeader(responseCode)
+	written, err := io.Copy(w, blob)
+	if err == blobcrypt.ErrCorrupt {
+		data.Logger.Printf("Blob %s does not decrypt: %s", identifier, err)
+	}
+	if link != nil && (err != nil || written != length) {
+		data.Logger.Printf("One-time link for %s released, only %d of %d bytes sent", identifier, written, length)
+		releaseOneTimeLink(link.nonce)
+	}
+}
+
+/*
+ * maxAge is how long caches may keep data, at most until it expires.
+ */
+func maxAge(until time.Time) time.Duration {
+	if age := time.Until(until); age > 0 {
+		return age
+	}
+	return 0
+}
+
+/*
+ * Every stored blob has a metadata record, named by its identifier, that
+ * tells whose it is, what it is and when it expires. Data without a record
+ * is never handed out; a blob is removed before its record, so a record is
+ * only ever missing a blob after a crash.
+ */
+type blobMetadata struct {
+	ApplicationId         int       `json:"application_id"`
+	ApplicationInstanceId int       `json:"application_instance_id"`
+	Size                  int64     `json:"size"`
+	SHA256                string    `json:"sha256"`
+	ContentType           string    `json:"content_type"`
+	Stored                time.Time `json:"stored"`
+	Expires               time.Time `json:"expires"`
+	blobSeal
+}
+
+func (m blobMetadata) ownedBy(applicationId int, applicationInstanceId int) bool {
+	return m.ApplicationId == applicationId && m.ApplicationInstanceId == applicationInstanceId
+}
+
+func (m blobMetadata) key(identifier string) string {
+	return binaryDataKey(m.ApplicationId, m.ApplicationInstanceId, identifier)
+}
+
+func metadataFilename(identifier string) string {
+	return fmt.Sprintf("%s/%s.json", metadataPath, identifier)
+}
+
+func loadBlobMetadata(identifier string) (bool, blobMetadata) {
+	var metadata blobMetadata
+	if _, err := uuid.Parse(identifier); err != nil {
+		return false, metadata
+	}
+	state, err := ioutil.ReadFile(metadataFilename(identifier))
+	if err != nil || json.Unmarshal(state, &metadata) != nil {
+		return false, metadata
+	}
+	return true, metadata
+}
+
+func saveBlobMetadata(identifier string, metadata blobMetadata) bool {
+	state, err := json.Marshal(metadata)
+	if err != nil {
+		return false
+	}
+	filename := metadataFilename(identifier)
+	if err := ioutil.WriteFile(filename+".tmp", state, 0600); err != nil {
+		data.Logger.Printf("Could not save blob metadata: %s", err)
+		return false
+	}
+	return os.Rename(filename+".tmp", filename) == nil
+}
+
+/*
+ * With a keyring, every blob is stored encrypted with a data key of its
+ * own, which its metadata keeps wrapped with the key of its application,
+ * along with the id of that key. An application without a key can't store
+ * data. Once its key is removed from the keyring or replaced, none of its
+ * data can be read any more; it is only left to expire. Data stored before
+ * there was a keyring stays readable as it is.
+ */
+type blobSeal struct {
+	KeyId      string `json:"key_id,omitempty"`
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+}
+
+func (s blobSeal) encrypted() bool {
+	return len(s.WrappedKey) > 0
+}
+
+func canEncrypt(applicationId int) bool {
+	if keyring == nil {
+		return true
+	}
+	hasKey, _, _ := keyring.Key(applicationId)
+	return hasKey
+}
+
+func noKeyReason(applicationId int) string {
+	return fmt.Sprintf("application %d has no encryption key", applicationId)
+}
+
+/*
+ * keyContext ties a wrapped data key to its blob.
+ */
+func keyContext(applicationId int, applicationInstanceId int, identifier string) []byte {
+	return []byte(binaryDataKey(applicationId, applicationInstanceId, identifier))
+}
+
+/*
+ * newBlobSeal returns a new data key for a blob and the seal that keeps it
+ * wrapped, nil without a keyring. It answers 403 with the reason if the
+ * application has no key.
+ */
+func newBlobSeal(applicationId int, applicationInstanceId int, identifier string) (int, string, []byte, blobSeal) {
+	if keyring == nil {
+		return http.StatusOK, "", nil, blobSeal{}
+	}
+	hasKey, keyId, applicationKey := keyring.Key(applicationId)
+	if !hasKey {
+		return http.StatusForbidden, noKeyReason(applicationId), nil, blobSeal{}
+	}
+	var wrappedKey []byte
+	dataKey, err := blobcrypt.NewDataKey()
+	if err == nil {
+		wrappedKey, err = blobcrypt.WrapKey(applicationKey, dataKey, keyContext(applicationId, applicationInstanceId, identifier))
+	}
+	if err != nil {
+		data.Logger.Printf("Could not make a data key for %s: %s", identifier, err)
+		return http.StatusInternalServerError, "", nil, blobSeal{}
+	}
+	return http.StatusOK, "", dataKey, blobSeal{KeyId: keyId, WrappedKey: wrappedKey}
+}
+
+/*
+ * encryptBlob returns what to store of body: body itself without a keyring,
+ * else body encrypted with a new data key, and the seal to record with it.
+ */
+func encryptBlob(applicationId int, applicationInstanceId int, identifier string, body io.Reader) (int, string, io.Reader, blobSeal) {
+	responseCode, reason, dataKey, seal := newBlobSeal(applicationId, applicationInstanceId, identifier)
+	if responseCode != http.StatusOK || dataKey == nil {
+		return responseCode, reason, body, seal
+	}
+	sealed, err := blobcrypt.NewEncryptingReader(body, dataKey)
+	if err != nil {
+		data.Logger.Printf("Could not encrypt %s: %s", identifier, err)
+		return http.StatusInternalServerError, "", nil, blobSeal{}
+	}
+	return http.StatusOK, "", sealed, seal
+}
+
+/*
+ * blobDataKey returns the data key of a blob, nil if it is not encrypted,
+ * and false if the key of its application was removed or replaced since.
+ */
+func blobDataKey(identifier string, metadata blobMetadata) (bool, []byte) {
+	if !metadata.encrypted() {
+		return true, nil
+	}
+	if keyring == nil {
+		data.Logger.Printf("Blob %s is encrypted, but there is no keyring", identifier)
+		return false, nil
+	}
+	hasKey, keyId, applicationKey := keyring.Key(metadata.ApplicationId)
+	if !hasKey || keyId != metadata.KeyId {
+		return false, nil
+	}
+	dataKey, err := blobcrypt.UnwrapKey(applicationKey, metadata.WrappedKey, keyContext(metadata.ApplicationId, metadata.ApplicationInstanceId, identifier))
+	if err != nil {
+		data.Logger.Printf("The data key of %s does not unwrap with key %s of application %d", identifier, keyId, metadata.ApplicationId)
+		return false, nil
+	}
+	return true, dataKey
+}
+
+/*
+ * openBlob returns length bytes of a blob from offset on, decrypted with
+ * dataKey if it has one; only the chunks holding them are read.
+ */
+func openBlob(identifier string, metadata blobMetadata, dataKey []byte, offset int64, length int64) (io.ReadCloser, error) {
+	if dataKey == nil {
+		return blobs.GetRange(metadata.key(identifier), offset, length)
+	}
+	sealedOffset, sealedLength := blobcrypt.CiphertextRange(offset, length, metadata.Size)
+	blob, err := blobs.GetRange(metadata.key(identifier), sealedOffset, sealedLength)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := blobcrypt.NewRangeDecrypter(blob, dataKey, offset, length, metadata.Size)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{plain, blob}, nil
+}
+
+/*
+ * Counters of what ss keeps and what it gave back, served as JSON on
+ * /metrics. Bytes are those of the blobs as uploaded; a content-addressed
+ * store may need less.
+ */
+type storageMetrics struct {
+	BlobsStored    int64 `json:"blobs_stored"`
+	BytesStored    int64 `json:"bytes_stored"`
+	BlobsExpired   int64 `json:"blobs_expired"`
+	BlobsDeleted   int64 `json:"blobs_deleted"`
+	BytesReclaimed int64 `json:"bytes_reclaimed"`
+}
+
+var metricsMutex sync.Mutex
+var metrics storageMetrics
+
+/*
+ * countStoredBlobs sets the stored counters and the usage of every
+ * application from the metadata records when ss starts, and reserves the
+ * quota of the partial uploads.
+ */
+func countStoredBlobs() {
+	records, _ := filepath.Glob(metadataPath + "/*.json")
+	for _, filename := range records {
+		if found, metadata := loadBlobMetadata(strings.TrimSuffix(filepath.Base(filename), ".json")); found {
+			metricsMutex.Lock()
+			metrics.BlobsStored++
+			metrics.BytesStored += metadata.Size
+			metricsMutex.Unlock()
+			addStoredUsage(metadata.ApplicationId, metadata.Size, 1)
+		}
+	}
+	states, _ := filepath.Glob(stagingPath + "/.partial-*.json")
+	for _, state := range states {
+		if found, upload := loadPartialUpload(strings.TrimSuffix(state, ".json")); found {
+			quotaMutex.Lock()
+			usage := usageOf(upload.ApplicationId)
+			usage.reservedBytes += upload.Length
+			usage.reservedObjects++
+			quotaMutex.Unlock()
+		}
+	}
+}
+
+/*
+ * recordBlob writes the metadata of a blob that was just stored; it expires
+ * after the data TTL.
+ */
+func recordBlob(applicationId int, applicationInstanceId int, identifier string, size int64, digest string, contentType string, seal blobSeal) (bool, blobMetadata) {
+	now := time.Now()
+	metadata := blobMetadata{ApplicationId: applicationId, ApplicationInstanceId: applicationInstanceId, Size: size, SHA256: digest, ContentType: contentType, Stored: now, Expires: now.Add(dataTTL()), blobSeal: seal}
+	replaced, previous := loadBlobMetadata(identifier)
+	if !saveBlobMetadata(identifier, metadata) {
+		return false, metadata
+	}
+	metricsMutex.Lock()
+	if replaced {
+		metrics.BlobsStored--
+		metrics.BytesStored -= previous.Size
+	}
+	metrics.BlobsStored++
+	metrics.BytesStored += size
+	metricsMutex.Unlock()
+	if replaced {
+		addStoredUsage(previous.ApplicationId, -previous.Size, -1)
+	}
+	addStoredUsage(applicationId, size, 1)
+	return true, metadata
+}
 
-var globalUploadId int = 100
-var globalCreateId int = 100
+/*
+ * removeBlob deletes a blob and then its metadata. The caller holds the
+ * upload lock of its key.
+ */
+func removeBlob(identifier string, metadata blobMetadata, expired bool) bool {
+	if err := blobs.Delete(metadata.key(identifier)); err != nil && err != blobstore.ErrNotFound {
+		data.Logger.Printf("Could not delete blob %s: %s", identifier, err)
+		return false
+	}
+	if err := os.Remove(metadataFilename(identifier)); err != nil && !os.IsNotExist(err) {
+		data.Logger.Printf("Could not delete the metadata of %s: %s", identifier, err)
+		return false
+	}
+	metricsMutex.Lock()
+	metrics.BlobsStored--
+	metrics.BytesStored -= metadata.Size
+	metrics.BytesReclaimed += metadata.Size
+	if expired {
+		metrics.BlobsExpired++
+	} else {
+		metrics.BlobsDeleted++
+	}
+	metricsMutex.Unlock()
+	addStoredUsage(metadata.ApplicationId, -metadata.Size, -1)
+	return true
+}
 
-func CreateNewUploadId() string {
-	var newUID string
-	newUID = uuid.NewV4().String()
-	data.Logger.Printf("new Upload ID: %s", newUID)
-	return newUID
+/*
+ * doDeleteBinaryData removes data at the request of the application that
+ * stored it. It answers 403 for data of another application and 409 while
+ * the data is being stored.
+ */
+func doDeleteBinaryData(applicationId int, applicationInstanceId int, identifier string) int {
+	found, metadata := loadBlobMetadata(identifier)
+	if !found {
+		return http.StatusNotFound
+	}
+	if !metadata.ownedBy(applicationId, applicationInstanceId) {
+		return http.StatusForbidden
+	}
+	key := metadata.key(identifier)
+	if !lockUpload(key) {
+		return http.StatusConflict
+	}
+	defer unlockUpload(key)
+	found, metadata = loadBlobMetadata(identifier)
+	if !found {
+		return http.StatusNotFound
+	}
+	if !removeBlob(identifier, metadata, false) {
+		return http.StatusInternalServerError
+	}
+	data.Logger.Printf("Deleted %s, %d bytes", identifier, metadata.Size)
+	return http.StatusOK
 }
 
-func CanUploadBinaryData(applicationId int, applicationInstanceId int, uploadId string, binaryDataLen int, mimeType string) bool {
-	_, err := uuid.Parse(uploadId)
-	if err == nil {
-		return true
+/*
+ * setBinaryDataExpiry moves the expiry of stored data, e.g. to keep it
+ * while a job needs it longer or to let it go early.
+ */
+func setBinaryDataExpiry(applicationId int, applicationInstanceId int, identifier string, expires time.Time) int {
+	found, metadata := loadBlobMetadata(identifier)
+	if !found {
+		return http.StatusNotFound
 	}
-	return false
+	if !metadata.ownedBy(applicationId, applicationInstanceId) {
+		return http.StatusForbidden
+	}
+	key := metadata.key(identifier)
+	if !lockUpload(key) {
+		return http.StatusConflict
+	}
+	defer unlockUpload(key)
+	found, metadata = loadBlobMetadata(identifier)
+	if !found {
+		return http.StatusNotFound
+	}
+	metadata.Expires = expires
+	if !saveBlobMetadata(identifier, metadata) {
+		return http.StatusInternalServerError
+	}
+	return http.StatusOK
+}
+
+/*
+ * A one-time link is used up by the first download that sends all of its
+ * data: its nonce is written to a file of its own, which only one request
+ * can create, and removed once the link expired. A download that fails
+ * releases the link again.
+ */
+type oneTimeLink struct {
+	nonce   string
+	expires time.Time
+}
+
+func linkFilename(nonce string) string {
+	return fmt.Sprintf("%s/.link-%s", stagingPath, nonce)
 }
 
-func storeBinaryData(applicationId int, applicationInstanceId int, identifier string, binaryData []byte, ttl int64) (bool, time.Time) {
-	filename := fmt.Sprintf("%s/%d_%d_%s", storagePath, applicationId, applicationInstanceId, identifier)
-	f, err := os.Create(filename)
+func oneTimeLinkUsed(nonce string) bool {
+	_, err := os.Stat(linkFilename(nonce))
+	return err == nil
+}
+
+func claimOneTimeLink(nonce string, expires time.Time) bool {
+	f, err := os.OpenFile(linkFilename(nonce), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
-		data.Logger.Print("Could not create file")
-		return false, time.Now()
+		return false
 	}
-	defer f.Close()
-	f.Write(binaryData)
-	return true, time.Now().Add(time.Duration(ttl) * time.Second)
+	fmt.Fprintf(f, "%d", expires.Unix())
+	f.Close()
+	return true
 }
 
-func storeUploadedBinaryData(applicationId int, applicationInstanceId int, uploadId string, binaryData []byte, ttl int64) (success bool, identifier string, expires time.Time) {
-	saved, expires := storeBinaryData(applicationId, applicationInstanceId, uploadId, binaryData, ttl)
-	return saved, uploadId, expires
+func releaseOneTimeLink(nonce string) {
+	os.Remove(linkFilename(nonce))
 }
 
-func retrieveBinaryData(applicationId int, applicationInstanceId int, identifier string) ([]byte, string, time.Time) {
-	var contentType string
-	filename := fmt.Sprintf("%s/%d_%d_%s", storagePath, applicationId, applicationInstanceId, identifier)
-	content, err := ioutil.ReadFile(filename)
-	if err == nil {
-		data.Logger.Printf("File %s found and opened", filename)
-		data.Logger.Printf("Content Length: %d...", len(content))
-		if len(content) > 0 {
-			contentType, err = magicmime.TypeByBuffer(content)
-			if err != nil {
-				contentType = "application/octet-stream"
-			}
-			return content, contentType, time.Now().Add(storageTTL)
+func expireOneTimeLinks() {
+	links, _ := filepath.Glob(stagingPath + "/.link-*")
+	for _, filename := range links {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			continue
+		}
+		if expires, err := strconv.ParseInt(string(content), 10, 64); err != nil || time.Unix(expires, 0).Before(time.Now()) {
+			os.Remove(filename)
 		}
-	} else {
-		data.Logger.Printf("Could not open file %s, err = %s", identifier, err)
 	}
-	return nil, "", time.Now()
 }
 
-func doDeleteBinaryData(applicationId int, applicationInstanceId int, identifier string) bool {
+/*
+ * Resumable uploads follow the tus protocol (https://tus.io): FE creates the
+ * upload with its length and expiry, then appends chunks at the offset the
+ * upload has reached, each optionally with a checksum. The data is kept in
+ * a partial file next to its state until the last byte arrived, then moved
+ * into place like a single upload. Partial uploads are removed once they
+ * expired.
+ *
+ * With a keyring, an upload gets its data key when it is created, and the
+ * partial file holds the chunks of the encrypted blob that are complete;
+ * the start of the next one is kept sealed in the state as Pending. So
+ * nothing lies in the staging path in the clear, and the partial file is
+ * stored as it is once complete. Uploads begun without a keyring are
+ * encrypted when they are stored.
+ */
+const statusChecksumMismatch = 460
+
+type partialUpload struct {
+	ApplicationId int       `json:"application_id"`
+	Length        int64     `json:"length"`
+	Offset        int64     `json:"offset"`
+	Expires       time.Time `json:"expires"`
+	SHA256        string    `json:"sha256"`
+	HashState     []byte    `json:"hash_state"`
+	Pending       []byte    `json:"pending,omitempty"`
+	blobSeal
+}
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+/*
+ * Keys of the uploads being stored or appended to; a second upload or chunk
+ * for the same key is refused until the first one is done.
+ */
+var uploadMutex sync.Mutex
+var uploadBusy = make(map[string]bool)
+
+func partialFilename(applicationId int, applicationInstanceId int, uploadId string) string {
+	return fmt.Sprintf("%s/.partial-%s", stagingPath, binaryDataKey(applicationId, applicationInstanceId, uploadId))
+}
+
+func lockUpload(key string) bool {
+	uploadMutex.Lock()
+	defer uploadMutex.Unlock()
+	if uploadBusy[key] {
+		return false
+	}
+	uploadBusy[key] = true
 	return true
 }
 
-/* Auxiliary Functions */
+func unlockUpload(key string) {
+	uploadMutex.Lock()
+	delete(uploadBusy, key)
+	uploadMutex.Unlock()
+}
 
-func getVars(req *http.Request) map[string]string {
-	body, _ := ioutil.ReadAll(req.Body)
-	vars := mux.Vars(req)
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-	return vars
+func loadPartialUpload(filename string) (bool, partialUpload) {
+	var upload partialUpload
+	state, err := ioutil.ReadFile(filename + ".json")
+	if err != nil || json.Unmarshal(state, &upload) != nil {
+		return false, upload
+	}
+	return true, upload
 }
 
-func uploadBinaryDataInt(w http.ResponseWriter, req *http.Request, applicationId int, applicationInstanceId int, uploadId string) {
-	binaryData, err := ioutil.ReadAll(req.Body)
-	if err == nil && CanUploadBinaryData(applicationId, applicationInstanceId, uploadId, 1024, "image/jpg") {
-		if len(binaryData) == 0 {
-			w.WriteHeader(http.StatusExpectationFailed)
+func savePartialUpload(filename string, upload partialUpload) bool {
+	state, err := json.Marshal(upload)
+	if err != nil {
+		return false
+	}
+	if err := ioutil.WriteFile(filename+".json.tmp", state, 0600); err != nil {
+		data.Logger.Printf("Could not save upload state: %s", err)
+		return false
+	}
+	return os.Rename(filename+".json.tmp", filename+".json") == nil
+}
+
+func removePartialUpload(filename string) {
+	os.Remove(filename + ".json")
+	os.Remove(filename)
+}
+
+/*
+ * dropPartialUpload removes a partial upload and gives back the quota it
+ * reserved.
+ */
+func dropPartialUpload(filename string, upload partialUpload) {
+	removePartialUpload(filename)
+	releaseQuota(upload.ApplicationId, upload.Length, 1)
+}
+
+/*
+ * parseChecksum reads an Upload-Checksum header ("sha1 <base64 digest>").
+ * Without the header it returns a nil hash.
+ */
+func parseChecksum(header string) (bool, hash.Hash, []byte) {
+	if header == "" {
+		return true, nil, nil
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return false, nil, nil
+	}
+	newHash, known := checksumAlgorithms[fields[0]]
+	digest, err := base64.StdEncoding.DecodeString(fields[1])
+	if !known || err != nil {
+		return false, nil, nil
+	}
+	return true, newHash(), digest
+}
+
+/*
+ * uploadMetadataValue returns a value of the Upload-Metadata header, which
+ * holds comma-separated keys with base64 encoded values.
+ */
+func uploadMetadataValue(header string, key string) string {
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 2 && fields[0] == key {
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err == nil {
+				return string(value)
+			}
+		}
+	}
+	return ""
+}
+
+/*
+ * A client's sha256 in the Upload-Metadata is checked against the whole
+ * upload once it is complete. An upload that was already created is
+ * returned as it is, so a client may repeat the creation. The upload holds
+ * its length of the application's quota until it is complete or dropped;
+ * if the quota does not allow that, it answers 507 with the reason.
+ */
+func createPartialUpload(applicationId int, applicationInstanceId int, uploadId string, length int64, expires time.Time, expectedSHA256 string) (int, string, partialUpload) {
+	key := binaryDataKey(applicationId, applicationInstanceId, uploadId)
+	filename := partialFilename(applicationId, applicationInstanceId, uploadId)
+	if !lockUpload(key) {
+		return http.StatusConflict, "", partialUpload{}
+	}
+	defer unlockUpload(key)
+	if found, upload := loadPartialUpload(filename); found {
+		if upload.Expires.Before(time.Now()) {
+			dropPartialUpload(filename, upload)
+		} else if upload.Length != length {
+			return http.StatusConflict, "", upload
 		} else {
-			var ttl int64 = 900 // 15 Minutes time for keeping the data
-			success, identifier, expires := storeUploadedBinaryData(applicationId, applicationInstanceId, uploadId, binaryData, ttl)
-			if success {
-				data.Logger.Printf("Successfully saved data with identifier = %s", identifier)
-				w.Header().Set("Content-Type", "application/json; charset=utf-8")
-				json.NewEncoder(w).Encode(data.StorageServerUploadResponse{BinaryDataId: identifier, Expires: expires})
-			} else {
-				data.Logger.Printf("Could not store file = %s", err)
-				w.WriteHeader(http.StatusInternalServerError)
+			return http.StatusCreated, "", upload
+		}
+	}
+	upload := partialUpload{ApplicationId: applicationId, Length: length, Expires: expires, SHA256: strings.ToLower(expectedSHA256)}
+	responseCode, reason, _, seal := newBlobSeal(applicationId, applicationInstanceId, uploadId)
+	if responseCode != http.StatusOK {
+		return responseCode, reason, upload
+	}
+	upload.blobSeal = seal
+	if reserved, reason := reserveQuota(applicationId, length, 1, length); !reserved {
+		return http.StatusInsufficientStorage, reason, upload
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		data.Logger.Printf("Could not create partial upload: %s", err)
+		releaseQuota(applicationId, length, 1)
+		return http.StatusInternalServerError, "", upload
+	}
+	f.Close()
+	if !savePartialUpload(filename, upload) {
+		dropPartialUpload(filename, upload)
+		return http.StatusInternalServerError, "", upload
+	}
+	return http.StatusCreated, "", upload
+}
+
+/*
+ * readErrorReader remembers whether reading failed, which tells a client
+ * that went away from a file that could not be written.
+ */
+type readErrorReader struct {
+	io.Reader
+	err error
+}
+
+func (r *readErrorReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+/*
+ * appendPartialUpload writes a chunk at the given offset. It answers 204
+ * while the upload is incomplete and 200 with the stored data once the last
+ * chunk arrived. A chunk with a wrong checksum is thrown away with 460; one
+ * without a checksum that broke off is kept as far as it came, so the client
+ * can resume from there.
+ */
+func appendPartialUpload(applicationId int, applicationInstanceId int, uploadId string, offset int64, checksum string, body io.Reader) (int, partialUpload, data.StorageServerUploadResponse) {
+	var response data.StorageServerUploadResponse
+
+	validChecksum, chunkHash, expectedDigest := parseChecksum(checksum)
+	if !validChecksum {
+		return http.StatusBadRequest, partialUpload{}, response
+	}
+	key := binaryDataKey(applicationId, applicationInstanceId, uploadId)
+	filename := partialFilename(applicationId, applicationInstanceId, uploadId)
+	if !lockUpload(key) {
+		return http.StatusConflict, partialUpload{}, response
+	}
+	defer unlockUpload(key)
+	found, upload := loadPartialUpload(filename)
+	if !found || upload.Expires.Before(time.Now()) {
+		return http.StatusNotFound, upload, response
+	}
+	if offset != upload.Offset {
+		return http.StatusConflict, upload, response
+	}
+	uploadHash := sha256.New()
+	if len(upload.HashState) > 0 {
+		if uploadHash.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState) != nil {
+			return http.StatusInternalServerError, upload, response
+		}
+	}
+	hasKey, dataKey := blobDataKey(uploadId, blobMetadata{ApplicationId: applicationId, ApplicationInstanceId: applicationInstanceId, blobSeal: upload.blobSeal})
+	if !hasKey {
+		data.Logger.Printf("The key of upload %s is gone, removed", uploadId)
+		dropPartialUpload(filename, upload)
+		return http.StatusGone, upload, response
+	}
+	fileSize := upload.Offset
+	if dataKey != nil {
+		fileSize = blobcrypt.WrittenSize(upload.Offset, upload.Length)
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0600)
+	if err != nil {
+		return http.StatusInternalServerError, upload, response
+	}
+	defer f.Close()
+	// Whatever lies behind the offset is left over from a chunk that was
+	// not recorded.
+	if f.Truncate(fileSize) != nil {
+		return http.StatusInternalServerError, upload, response
+	}
+	if _, err := f.Seek(fileSize, io.SeekStart); err != nil {
+		return http.StatusInternalServerError, upload, response
+	}
+	var partial io.Writer = f
+	var sealer *blobcrypt.ChunkWriter
+	if dataKey != nil {
+		sealer, err = blobcrypt.NewChunkWriter(f, dataKey, upload.Length, upload.Offset, upload.Pending)
+		if err != nil {
+			data.Logger.Printf("Could not continue encrypting upload %s: %s", uploadId, err)
+			return http.StatusInternalServerError, upload, response
+		}
+		partial = sealer
+	}
+	writers := []io.Writer{partial, uploadHash}
+	if chunkHash != nil {
+		writers = append(writers, chunkHash)
+	}
+	remaining := upload.Length - upload.Offset
+	chunk := &readErrorReader{Reader: io.LimitReader(body, remaining+1)}
+	written, err := io.Copy(io.MultiWriter(writers...), chunk)
+	discard := func(status int) (int, partialUpload, data.StorageServerUploadResponse) {
+		f.Truncate(fileSize)
+		return status, upload, response
+	}
+	switch {
+	case written > remaining || err == blobcrypt.ErrTooLong:
+		return discard(http.StatusRequestEntityTooLarge)
+	case err != nil && (chunk.err == nil || chunkHash != nil):
+		data.Logger.Printf("Chunk of upload %s dropped: %s", uploadId, err)
+		return discard(http.StatusInternalServerError)
+	case chunkHash != nil && !bytes.Equal(chunkHash.Sum(nil), expectedDigest):
+		return discard(statusChecksumMismatch)
+	}
+	state, err := uploadHash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return discard(http.StatusInternalServerError)
+	}
+	var pending []byte
+	if sealer != nil {
+		if pending, err = sealer.Pending(); err != nil {
+			return discard(http.StatusInternalServerError)
+		}
+	}
+	previous := upload
+	upload.Offset += written
+	upload.HashState = state
+	upload.Pending = pending
+	if !savePartialUpload(filename, upload) {
+		upload = previous
+		return discard(http.StatusInternalServerError)
+	}
+	if upload.Offset < upload.Length {
+		return http.StatusNoContent, upload, response
+	}
+	digest := fmt.Sprintf("%x", uploadHash.Sum(nil))
+	if upload.SHA256 != "" && upload.SHA256 != digest {
+		data.Logger.Printf("Upload %s does not match its checksum, removed", uploadId)
+		dropPartialUpload(filename, upload)
+		return statusChecksumMismatch, upload, response
+	}
+	if !claimUploadId(uploadId) {
+		if uploadIdUsed(uploadId) {
+			dropPartialUpload(filename, upload)
+		}
+		return http.StatusConflict, upload, response
+	}
+	defer releaseUploadId(uploadId)
+	// A failed store leaves the complete partial upload behind; appending
+	// nothing at its end tries again.
+	f.Close()
+	complete, err := os.Open(filename)
+	if err != nil {
+		return http.StatusInternalServerError, upload, response
+	}
+	var contentType string
+	var sealed io.Reader
+	seal := upload.blobSeal
+	if dataKey != nil {
+		contentType, err = sniffEncryptedMimeType(complete, dataKey, upload.Length)
+		sealed = complete
+	} else {
+		head := bufio.NewReaderSize(complete, sniffLength)
+		_, contentType = sniffMimeType(head)
+		var responseCode int
+		responseCode, _, sealed, seal = encryptBlob(applicationId, applicationInstanceId, uploadId, head)
+		if responseCode != http.StatusOK {
+			complete.Close()
+			return responseCode, upload, response
+		}
+	}
+	if err == nil {
+		_, err = blobs.Put(key, sealed)
+	}
+	complete.Close()
+	if err != nil {
+		data.Logger.Printf("Could not store upload: %s", err)
+		return http.StatusInternalServerError, upload, response
+	}
+	recorded, metadata := recordBlob(applicationId, applicationInstanceId, uploadId, upload.Length, digest, contentType, seal)
+	if !recorded {
+		blobs.Delete(key)
+		return http.StatusInternalServerError, upload, response
+	}
+	if !useUploadId(uploadId) {
+		removeBlob(uploadId, metadata, false)
+		return http.StatusInternalServerError, upload, response
+	}
+	dropPartialUpload(filename, upload)
+	response = data.StorageServerUploadResponse{BinaryDataId: uploadId, Expires: metadata.Expires, Size: upload.Length, SHA256: digest}
+	return http.StatusOK, upload, response
+}
+
+/*
+ * sniffEncryptedMimeType decrypts the start of a complete encrypted upload
+ * to tell its MIME type, and leaves file at its start again.
+ */
+func sniffEncryptedMimeType(file *os.File, dataKey []byte, size int64) (string, error) {
+	length := int64(sniffLength)
+	if length > size {
+		length = size
+	}
+	plain, err := blobcrypt.NewRangeDecrypter(file, dataKey, 0, length, size)
+	if err != nil {
+		return "", err
+	}
+	head, err := ioutil.ReadAll(plain)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	_, contentType := sniffMimeType(bufio.NewReaderSize(bytes.NewReader(head), sniffLength))
+	return contentType, nil
+}
+
+/*
+ * expireUploads removes partial uploads past their expiry, the grants of
+ * upload ids that expired more than grantRetention ago, used one-time links
+ * that expired and expired data.
+ */
+func expireUploads() {
+	for {
+		time.Sleep(time.Minute)
+		grants, _ := filepath.Glob(stagingPath + "/.grant-*.json")
+		for _, filename := range grants {
+			uploadId := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(filename), ".grant-"), ".json")
+			grantMutex.Lock()
+			if found, grant := loadUploadGrant(uploadId); found && grant.Expires.Add(grantRetention).Before(time.Now()) {
+				os.Remove(filename)
+			}
+			grantMutex.Unlock()
+		}
+		states, _ := filepath.Glob(stagingPath + "/.partial-*.json")
+		for _, state := range states {
+			filename := strings.TrimSuffix(state, ".json")
+			key := strings.TrimPrefix(filepath.Base(filename), ".partial-")
+			if !lockUpload(key) {
+				continue
+			}
+			if found, upload := loadPartialUpload(filename); found && upload.Expires.Before(time.Now()) {
+				data.Logger.Printf("Partial upload %s expired", key)
+				dropPartialUpload(filename, upload)
 			}
+			unlockUpload(key)
 		}
+		expireOneTimeLinks()
+		ExpireBinaryData()
+	}
+}
+
+func setPartialUploadHeaders(w http.ResponseWriter, upload partialUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+}
+
+/* Auxiliary Functions */
+
+func uploadBinaryDataInt(w http.ResponseWriter, req *http.Request, applicationId int, applicationInstanceId int, uploadId string) {
+	if responseCode, reason := CanUploadBinaryData(applicationId, applicationInstanceId, uploadId, req.ContentLength, ""); responseCode != http.StatusOK {
+		writeUploadRejection(w, responseCode, reason)
+		return
+	}
+	body := bufio.NewReaderSize(req.Body, sniffLength)
+	hasData, mimeType := sniffMimeType(body)
+	if !hasData {
+		w.WriteHeader(http.StatusExpectationFailed)
+		return
+	}
+	if responseCode, reason := CanUploadBinaryData(applicationId, applicationInstanceId, uploadId, -1, mimeType); responseCode != http.StatusOK {
+		writeUploadRejection(w, responseCode, reason)
+		return
+	}
+	_, grant := loadUploadGrant(uploadId)
+	responseCode, reason, response := storeBinaryData(applicationId, applicationInstanceId, uploadId, body, uploadSizeLimit(grant), req.ContentLength, mimeType)
+	if responseCode == http.StatusOK {
+		data.Logger.Printf("Successfully saved %d bytes with identifier = %s", response.Size, response.BinaryDataId)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(response)
+	} else if reason != "" {
+		writeUploadRejection(w, responseCode, reason)
 	} else {
-		data.Logger.Printf("Reading Upload Body Failed = %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(responseCode)
 	}
 }
 
 /* File API Functions */
 func CanUploadData(w http.ResponseWriter, req *http.Request) {
+	var checkInfo data.UploadCheckInfo
+	if err := json.NewDecoder(req.Body).Decode(&checkInfo); err != nil {
+		writeUploadRejection(w, http.StatusBadRequest, "invalid upload check")
+		return
+	}
+	if responseCode, reason := CanUploadBinaryData(checkInfo.ApplicationId, checkInfo.ApplicationInstanceId, checkInfo.UploadId, checkInfo.UploadLen, checkInfo.MimeType); responseCode != http.StatusOK {
+		writeUploadRejection(w, responseCode, reason)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
 func UploadBinaryData(w http.ResponseWriter, req *http.Request) {
-	var vars = getVars(req)
+	var vars = mux.Vars(req)
+	extendTransferDeadlines(w)
 	uploadId := vars["uploadId"]
 	applicationId, err := strconv.Atoi(vars["applicationId"])
 	applicationInstanceId, err := strconv.Atoi(vars["applicationInstanceId"])
@@ -139,41 +1621,210 @@ func UploadBinaryData(w http.ResponseWriter, req *http.Request) {
 }
 
 func GetBinaryData(w http.ResponseWriter, req *http.Request) {
-	var vars = getVars(req)
+	var vars = mux.Vars(req)
+	extendTransferDeadlines(w)
 	identifier := vars["identifier"]
 	applicationId, _ := strconv.Atoi(vars["applicationId"])
 	applicationInstanceId, _ := strconv.Atoi(vars["applicationInstanceId"])
-	binaryData, contentType, expires := retrieveBinaryData(applicationId, applicationInstanceId, identifier)
-	if len(binaryData) > 0 && expires.After(time.Now()) {
-		w.Header().Set("Content-Type", contentType)
-		w.Write(binaryData)
+	found, metadata := findBinaryData(applicationId, applicationInstanceId, identifier)
+	if found {
+		serveBinaryData(w, req, identifier, metadata, maxAge(metadata.Expires), nil)
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 	}
 }
 
+/*
+ * GetSignedBinaryData serves a link FE signed. It answers 403 for a link
+ * that is not signed properly and 410 for one that expired or, if it works
+ * only once, was used already. A one-time link always sends the whole data
+ * and is not cached; only a GET that sent all of it uses it up.
+ */
+func GetSignedBinaryData(w http.ResponseWriter, req *http.Request) {
+	var vars = mux.Vars(req)
+	extendTransferDeadlines(w)
+	identifier := vars["identifier"]
+	applicationId, errApplication := strconv.Atoi(vars["applicationId"])
+	applicationInstanceId, errInstance := strconv.Atoi(vars["applicationInstanceId"])
+	if errApplication != nil || errInstance != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	responseCode, nonce, expires := signedurl.Verify([]byte(configuration.URLSigningKey), applicationId, applicationInstanceId, identifier, req.URL.Query(), time.Now())
+	if responseCode != http.StatusOK {
+		w.WriteHeader(responseCode)
+		return
+	}
+	found, metadata := findBinaryData(applicationId, applicationInstanceId, identifier)
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if nonce != "" {
+		if oneTimeLinkUsed(nonce) {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		serveBinaryData(w, req, identifier, metadata, 0, &oneTimeLink{nonce: nonce, expires: expires})
+		return
+	}
+	if expires.After(metadata.Expires) {
+		expires = metadata.Expires
+	}
+	serveBinaryData(w, req, identifier, metadata, maxAge(expires), nil)
+}
+
 func DeleteBinaryData(w http.ResponseWriter, req *http.Request) {
-	var vars = getVars(req)
+	var vars = mux.Vars(req)
 	identifier := vars["identifier"]
 	applicationId, _ := strconv.Atoi(vars["applicationId"])
 	applicationInstanceId, _ := strconv.Atoi(vars["applicationInstanceId"])
-	if doDeleteBinaryData(applicationId, applicationInstanceId, identifier) {
-		w.WriteHeader(http.StatusOK)
-	} else {
-		w.WriteHeader(http.StatusNotFound)
+	w.WriteHeader(doDeleteBinaryData(applicationId, applicationInstanceId, identifier))
+}
+
+func SetBinaryDataExpiry(w http.ResponseWriter, req *http.Request) {
+	var vars = mux.Vars(req)
+	var expiry data.BinaryDataExpiry
+	identifier := vars["identifier"]
+	applicationId, _ := strconv.Atoi(vars["applicationId"])
+	applicationInstanceId, _ := strconv.Atoi(vars["applicationInstanceId"])
+	if err := json.NewDecoder(req.Body).Decode(&expiry); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(setBinaryDataExpiry(applicationId, applicationInstanceId, identifier, expiry.Expires))
+}
+
+func StorageUsage(w http.ResponseWriter, req *http.Request) {
+	applicationId, err := strconv.Atoi(mux.Vars(req)["applicationId"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(applicationStorageUsage(applicationId))
+}
+
+func Metrics(w http.ResponseWriter, req *http.Request) {
+	metricsMutex.Lock()
+	current := metrics
+	metricsMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(current)
 }
 
 func UploadBinaryDataInternal(w http.ResponseWriter, req *http.Request) {
-	var vars = getVars(req)
+	var vars = mux.Vars(req)
+	extendTransferDeadlines(w)
 	applicationId, _ := strconv.Atoi(vars["applicationId"])
 	applicationInstanceId, _ := strconv.Atoi(vars["applicationInstanceId"])
-	uploadId := CreateNewUploadId()
+	uploadId := CreateNewUploadId(data.UploadIdRequest{ApplicationId: applicationId, ApplicationInstanceId: applicationInstanceId, Expires: time.Now().Add(storageTTL)})
+	if uploadId == "" {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	uploadBinaryDataInt(w, req, applicationId, applicationInstanceId, uploadId)
 }
 
+func resumableUploadVars(req *http.Request) (bool, int, int, string) {
+	vars := mux.Vars(req)
+	applicationId, err := strconv.Atoi(vars["applicationId"])
+	if err != nil {
+		return false, 0, 0, ""
+	}
+	applicationInstanceId, err := strconv.Atoi(vars["applicationInstanceId"])
+	return err == nil, applicationId, applicationInstanceId, vars["uploadId"]
+}
+
+func CreateResumableUpload(w http.ResponseWriter, req *http.Request) {
+	ok, applicationId, applicationInstanceId, uploadId := resumableUploadVars(req)
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if !ok || err != nil || length < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	expires, err := http.ParseTime(req.Header.Get("Upload-Expires"))
+	if err != nil {
+		expires = time.Now().Add(storageTTL)
+	}
+	if responseCode, reason := CanUploadBinaryData(applicationId, applicationInstanceId, uploadId, length, ""); responseCode != http.StatusOK {
+		writeUploadRejection(w, responseCode, reason)
+		return
+	}
+	if length == 0 {
+		w.WriteHeader(http.StatusExpectationFailed)
+		return
+	}
+	responseCode, reason, upload := createPartialUpload(applicationId, applicationInstanceId, uploadId, length, expires, uploadMetadataValue(req.Header.Get("Upload-Metadata"), "sha256"))
+	if responseCode == http.StatusCreated {
+		setPartialUploadHeaders(w, upload)
+	} else if reason != "" {
+		writeUploadRejection(w, responseCode, reason)
+		return
+	}
+	w.WriteHeader(responseCode)
+}
+
+func ResumableUploadOffset(w http.ResponseWriter, req *http.Request) {
+	ok, applicationId, applicationInstanceId, uploadId := resumableUploadVars(req)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	found, upload := loadPartialUpload(partialFilename(applicationId, applicationInstanceId, uploadId))
+	if found && upload.Expires.After(time.Now()) {
+		setPartialUploadHeaders(w, upload)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func AppendToResumableUpload(w http.ResponseWriter, req *http.Request) {
+	extendTransferDeadlines(w)
+	ok, applicationId, applicationInstanceId, uploadId := resumableUploadVars(req)
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if !ok || err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if responseCode, reason := CanUploadBinaryData(applicationId, applicationInstanceId, uploadId, -1, ""); responseCode != http.StatusOK {
+		writeUploadRejection(w, responseCode, reason)
+		return
+	}
+	body := bufio.NewReaderSize(req.Body, sniffLength)
+	if offset == 0 {
+		// The first chunk tells the MIME type of the whole upload.
+		if hasData, mimeType := sniffMimeType(body); hasData {
+			if responseCode, reason := CanUploadBinaryData(applicationId, applicationInstanceId, uploadId, -1, mimeType); responseCode != http.StatusOK {
+				writeUploadRejection(w, responseCode, reason)
+				return
+			}
+		}
+	}
+	responseCode, upload, response := appendPartialUpload(applicationId, applicationInstanceId, uploadId, offset, req.Header.Get("Upload-Checksum"), body)
+	switch responseCode {
+	case http.StatusOK:
+		data.Logger.Printf("Resumable upload %s complete, %d bytes", uploadId, response.Size)
+		setPartialUploadHeaders(w, upload)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(response)
+	case http.StatusNoContent, http.StatusConflict:
+		setPartialUploadHeaders(w, upload)
+		w.WriteHeader(responseCode)
+	default:
+		w.WriteHeader(responseCode)
+	}
+}
+
 func NewUploadId(w http.ResponseWriter, req *http.Request) {
-	uploadId := CreateNewUploadId()
+	var uploadRequest data.UploadIdRequest
+	if err := json.NewDecoder(req.Body).Decode(&uploadRequest); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	uploadId := CreateNewUploadId(uploadRequest)
 	if uploadId != "" {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		json.NewEncoder(w).Encode(data.UploadIdT{UploadId: uploadId})
@@ -182,7 +1833,27 @@ func NewUploadId(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+/*
+ * ExpireBinaryData removes all data past its expiry. Data that is being
+ * stored right now is left for the next run.
+ */
 func ExpireBinaryData() {
+	records, _ := filepath.Glob(metadataPath + "/*.json")
+	for _, filename := range records {
+		identifier := strings.TrimSuffix(filepath.Base(filename), ".json")
+		found, metadata := loadBlobMetadata(identifier)
+		if !found || metadata.Expires.After(time.Now()) {
+			continue
+		}
+		key := metadata.key(identifier)
+		if !lockUpload(key) {
+			continue
+		}
+		if found, metadata = loadBlobMetadata(identifier); found && metadata.Expires.Before(time.Now()) && removeBlob(identifier, metadata, true) {
+			data.Logger.Printf("Data %s expired, %d bytes reclaimed", identifier, metadata.Size)
+		}
+		unlockUpload(key)
+	}
 }
 
 /*
@@ -191,10 +1862,45 @@ MUX Middleware (check out https://github.com/gorilla/mux#middleware)
 */
 func main() {
 	var wait time.Duration
+	var configFile string
 	uuid.Init()
 	data.Logger = log.New(os.Stdout, "MARCURIE (ss) - ", log.Ldate|log.Ltime|log.Lmicroseconds|log.Lshortfile)
 	flag.DurationVar(&wait, "graceful-timeout", time.Second*15, "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m")
+	flag.StringVar(&configFile, "config", "config.json", "the configuration file")
 	flag.Parse()
+	if configfile.ReadConfiguration(configFile, &configuration) == false {
+		data.Logger.Printf("Missing my config file %s", configFile)
+		os.Exit(1)
+	}
+	outbound.Init(configuration.Outbound)
+	stagingPath = configuration.StagingPath
+	if stagingPath == "" {
+		data.Logger.Printf("The configuration has no staging_path")
+		os.Exit(1)
+	}
+	if err := os.MkdirAll(stagingPath, 0700); err != nil {
+		data.Logger.Fatal(err)
+	}
+	metadataPath = configuration.MetadataPath
+	if metadataPath == "" {
+		metadataPath = filepath.Join(stagingPath, "metadata")
+	}
+	if err := os.MkdirAll(metadataPath, 0700); err != nil {
+		data.Logger.Fatal(err)
+	}
+	store, err := blobstore.New(configuration.BlobStore, stagingPath)
+	if err != nil {
+		data.Logger.Printf("Can't open the blob store: %s", err)
+		os.Exit(1)
+	}
+	blobs = store
+	if configuration.Keyring != "" {
+		if keyring, err = blobcrypt.OpenKeyring(configuration.Keyring); err != nil {
+			data.Logger.Printf("Can't read the keyring: %s", err)
+			os.Exit(1)
+		}
+	}
+	countStoredBlobs()
 
 	if err := magicmime.Open(magicmime.MAGIC_MIME_TYPE | magicmime.MAGIC_SYMLINK | magicmime.MAGIC_ERROR); err != nil {
 		data.Logger.Fatal(err)
@@ -208,11 +1914,19 @@ func main() {
 	router.HandleFunc(rootURL+"/upload/{applicationId}/{applicationInstanceId}/{uploadId}", UploadBinaryData)
 	router.HandleFunc(rootURL+"/download/{applicationId}/{applicationInstanceId}/{identifier}", GetBinaryData)
 	router.HandleFunc(rootURL+"/delete-data/{applicationId}/{applicationInstanceId}/{identifier}", DeleteBinaryData)
+	router.HandleFunc(rootURL+"/expire-data/{applicationId}/{applicationInstanceId}/{identifier}", SetBinaryDataExpiry).Methods("POST")
 	router.HandleFunc(rootURL+"/store-data/{applicationId}/{applicationInstanceId}", UploadBinaryDataInternal)
+	router.HandleFunc(rootURL+"/resumable/{applicationId}/{applicationInstanceId}/{uploadId}", CreateResumableUpload).Methods("POST")
+	router.HandleFunc(rootURL+"/resumable/{applicationId}/{applicationInstanceId}/{uploadId}", ResumableUploadOffset).Methods("HEAD")
+	router.HandleFunc(rootURL+"/resumable/{applicationId}/{applicationInstanceId}/{uploadId}", AppendToResumableUpload).Methods("PATCH")
+	router.HandleFunc(rootURL+"/metrics", Metrics).Methods("GET")
+	router.HandleFunc(rootURL+"/usage/{applicationId}", StorageUsage).Methods("GET")
+
+	go expireUploads()
 
 	/* Prepare our server */
 	srv := &http.Server{
-		Addr: "0.0.0.0:9500",
+		Addr: listenAddress(configuration.Me, defaultListenPort),
 		// Good practice to set timeouts to avoid Slowloris attacks.
 		WriteTimeout: time.Second * 15,
 		ReadTimeout:  time.Second * 15,
@@ -227,6 +1941,25 @@ func main() {
 		}
 	}()
 
+	/* Signed links are served apart from the internal API */
+	var publicSrv *http.Server
+	if configuration.URLSigningKey != "" {
+		publicRouter := mux.NewRouter()
+		publicRouter.HandleFunc(rootURL+"/signed/{applicationId}/{applicationInstanceId}/{identifier}", GetSignedBinaryData).Methods("GET", "HEAD")
+		publicSrv = &http.Server{
+			Addr:         listenAddress(configuration.Public, defaultPublicPort),
+			WriteTimeout: time.Second * 15,
+			ReadTimeout:  time.Second * 15,
+			IdleTimeout:  time.Second * 60,
+			Handler:      publicRouter,
+		}
+		go func() {
+			if err := publicSrv.ListenAndServe(); err != nil {
+				data.Logger.Println(err)
+			}
+		}()
+	}
+
 	c := make(chan os.Signal, 1)
 	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
 	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
@@ -241,6 +1974,9 @@ func main() {
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
 	srv.Shutdown(ctx)
+	if publicSrv != nil {
+		publicSrv.Shutdown(ctx)
+	}
 	// Optionally, you could run srv.Shutdown in a goroutine and block on
 	// <-ctx.Done() if your application should wait for other services
 	// to finalize based on context cancellation.
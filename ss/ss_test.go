@@ -0,0 +1,116 @@
+package main
+
+import (
+	"blobstore"
+	"data"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"signedurl"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const testIdentifier = "0f8fad5b-d9cb-469f-a165-70867728950e"
+
+/*
+ * setupSignedLinks gives ss a local blob store in a temporary directory
+ * with one stored file and returns a router that serves signed links.
+ */
+func setupSignedLinks(t *testing.T, content string) *mux.Router {
+	t.Helper()
+	data.Logger = log.New(ioutil.Discard, "", 0)
+	stagingPath = t.TempDir()
+	metadataPath = filepath.Join(stagingPath, "metadata")
+	configuration = SSConfiguration{URLSigningKey: "signing key"}
+	store, err := blobstore.New(blobstore.BlobStoreConfig{Type: blobstore.TypeLocal, Path: t.TempDir()}, stagingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs = store
+	keyring = nil
+	if err := os.MkdirAll(metadataPath, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blobs.Put(binaryDataKey(1, 2, testIdentifier), strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if recorded, _ := recordBlob(1, 2, testIdentifier, int64(len(content)), "", "text/plain", blobSeal{}); !recorded {
+		t.Fatal("blob not recorded")
+	}
+	router := mux.NewRouter()
+	router.HandleFunc(rootURL+"/signed/{applicationId}/{applicationInstanceId}/{identifier}", GetSignedBinaryData).Methods("GET", "HEAD")
+	return router
+}
+
+func signedLink(t *testing.T, oneTime bool) string {
+	t.Helper()
+	ok, query := signedurl.Query([]byte(configuration.URLSigningKey), 1, 2, testIdentifier, time.Now().Add(time.Hour), oneTime)
+	if !ok {
+		t.Fatal("link not signed")
+	}
+	return rootURL + signedurl.Path(1, 2, testIdentifier) + "?" + query.Encode()
+}
+
+func get(router *mux.Router, method string, link string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, link, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestOneTimeLinkWorksOnce(t *testing.T) {
+	router := setupSignedLinks(t, "the content")
+	link := signedLink(t, true)
+
+	if response := get(router, "HEAD", link, nil); response.Code != http.StatusOK {
+		t.Fatalf("HEAD got %d", response.Code)
+	}
+	// A range request gets all of the data, so it uses the link up too.
+	response := get(router, "GET", link, http.Header{"Range": {"bytes=0-2"}})
+	if response.Code != http.StatusOK || response.Body.String() != "the content" {
+		t.Fatalf("first download got %d, %q", response.Code, response.Body.String())
+	}
+	if response.Header().Get("Accept-Ranges") != "none" {
+		t.Errorf("one-time link offers ranges: %q", response.Header().Get("Accept-Ranges"))
+	}
+	if response := get(router, "GET", link, nil); response.Code != http.StatusGone {
+		t.Fatalf("second download got %d, want 410", response.Code)
+	}
+
+	other := signedLink(t, true)
+	if response := get(router, "GET", other, nil); response.Code != http.StatusOK {
+		t.Fatalf("another one-time link got %d", response.Code)
+	}
+}
+
+func TestSignedLinkWorksRepeatedly(t *testing.T) {
+	router := setupSignedLinks(t, "the content")
+	link := signedLink(t, false)
+	for i := 0; i < 2; i++ {
+		if response := get(router, "GET", link, nil); response.Code != http.StatusOK || response.Body.String() != "the content" {
+			t.Fatalf("download %d got %d", i, response.Code)
+		}
+	}
+}
+
+func TestSignedLinkRefused(t *testing.T) {
+	router := setupSignedLinks(t, "the content")
+	link := signedLink(t, true)
+	if response := get(router, "GET", strings.Replace(link, testIdentifier, "7c9e6679-7425-40de-944b-e07fc1f90ae7", 1), nil); response.Code != http.StatusForbidden {
+		t.Errorf("link for another file got %d, want 403", response.Code)
+	}
+	configuration.URLSigningKey = ""
+	if response := get(router, "GET", link, nil); response.Code != http.StatusForbidden {
+		t.Errorf("link without a key got %d, want 403", response.Code)
+	}
+}